@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bsclient "github.com/ipfs/boxo/bitswap/client"
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	bsserver "github.com/ipfs/boxo/bitswap/server"
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// bitswapInspectIdle is how long the stats of a peer we stopped exchanging
+// messages with are kept.
+const bitswapInspectIdle = 10 * time.Minute
+
+// inspectedWant is what we know about a CID requested from the exchange.
+type inspectedWant struct {
+	since     time.Time
+	sessions  map[uint64]int
+	asked     map[peer.ID]struct{}
+	dontHaves map[peer.ID]struct{}
+}
+
+// bitswapPeerStats are the messages exchanged with a peer by the Bitswap
+// client.
+type bitswapPeerStats struct {
+	WantsSent      uint64
+	BlocksReceived uint64
+	BytesReceived  uint64
+	DontHaves      uint64
+	LastSeen       time.Time
+}
+
+// bitswapInspector tracks what Bitswap is waiting on: the CIDs requested from
+// the exchange and by which session, the peers they were asked to and the
+// DONT_HAVEs received, so that hanging requests can be investigated. As it
+// sees every message, it is only enabled by RAINBOW_BITSWAP_INSPECT.
+type bitswapInspector struct {
+	client *bsclient.Client
+	server *bsserver.Server
+
+	sessions atomic.Uint64
+
+	mu    sync.Mutex
+	wants map[cid.Cid]*inspectedWant
+	peers map[peer.ID]*bitswapPeerStats
+}
+
+func newBitswapInspector() *bitswapInspector {
+	return &bitswapInspector{
+		wants: make(map[cid.Cid]*inspectedWant),
+		peers: make(map[peer.ID]*bitswapPeerStats),
+	}
+}
+
+// newSession returns the ID of a new session.
+func (bi *bitswapInspector) newSession() uint64 {
+	return bi.sessions.Add(1)
+}
+
+// want records that session requested cids.
+func (bi *bitswapInspector) want(session uint64, cids ...cid.Cid) {
+	now := time.Now()
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	for _, c := range cids {
+		w, ok := bi.wants[c]
+		if !ok {
+			w = &inspectedWant{
+				since:     now,
+				sessions:  make(map[uint64]int),
+				asked:     make(map[peer.ID]struct{}),
+				dontHaves: make(map[peer.ID]struct{}),
+			}
+			bi.wants[c] = w
+		}
+		w.sessions[session]++
+	}
+}
+
+// done records that session is no longer waiting for cids.
+func (bi *bitswapInspector) done(session uint64, cids ...cid.Cid) {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	for _, c := range cids {
+		w, ok := bi.wants[c]
+		if !ok {
+			continue
+		}
+		if w.sessions[session]--; w.sessions[session] <= 0 {
+			delete(w.sessions, session)
+		}
+		if len(w.sessions) == 0 {
+			delete(bi.wants, c)
+		}
+	}
+}
+
+func (bi *bitswapInspector) peerLocked(p peer.ID, now time.Time) *bitswapPeerStats {
+	st, ok := bi.peers[p]
+	if !ok {
+		st = &bitswapPeerStats{}
+		bi.peers[p] = st
+	}
+	st.LastSeen = now
+	return st
+}
+
+// sent records the wants of a message sent to p.
+func (bi *bitswapInspector) sent(p peer.ID, msg bsmsg.BitSwapMessage) {
+	entries := msg.Wantlist()
+	if len(entries) == 0 {
+		return
+	}
+
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	st := bi.peerLocked(p, time.Now())
+	for _, e := range entries {
+		if e.Cancel {
+			continue
+		}
+		st.WantsSent++
+		if w, ok := bi.wants[e.Cid]; ok {
+			w.asked[p] = struct{}{}
+		}
+	}
+}
+
+// received records the blocks and DONT_HAVEs of a message received from p.
+func (bi *bitswapInspector) received(p peer.ID, msg bsmsg.BitSwapMessage) {
+	blks := msg.Blocks()
+	dontHaves := msg.DontHaves()
+	if len(blks) == 0 && len(dontHaves) == 0 {
+		return
+	}
+
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	st := bi.peerLocked(p, time.Now())
+	for _, b := range blks {
+		st.BlocksReceived++
+		st.BytesReceived += uint64(len(b.RawData()))
+	}
+	for _, c := range dontHaves {
+		st.DontHaves++
+		if w, ok := bi.wants[c]; ok {
+			w.dontHaves[p] = struct{}{}
+		}
+	}
+}
+
+// bitswapWant is a CID in the wantlist of the Bitswap client.
+type bitswapWant struct {
+	Cid       cid.Cid
+	WantType  string
+	Age       string   `json:",omitempty"`
+	Sessions  []uint64 `json:",omitempty"`
+	Asked     []peer.ID
+	DontHaves []peer.ID
+}
+
+// wantlist returns the wantlist of the Bitswap client, oldest wants first.
+// Wants that were not requested through the exchange have no age.
+func (bi *bitswapInspector) wantlist() []bitswapWant {
+	if bi.client == nil {
+		return nil
+	}
+	types := make(map[cid.Cid]string)
+	for _, c := range bi.client.GetWantHaves() {
+		types[c] = "have"
+	}
+	for _, c := range bi.client.GetWantBlocks() {
+		types[c] = "block"
+	}
+
+	now := time.Now()
+	out := make([]bitswapWant, 0, len(types))
+	since := make(map[cid.Cid]time.Time, len(types))
+	bi.mu.Lock()
+	for c, t := range types {
+		bw := bitswapWant{Cid: c, WantType: t, Asked: []peer.ID{}, DontHaves: []peer.ID{}}
+		if w, ok := bi.wants[c]; ok {
+			since[c] = w.since
+			bw.Age = now.Sub(w.since).Round(time.Millisecond).String()
+			for s := range w.sessions {
+				bw.Sessions = append(bw.Sessions, s)
+			}
+			for p := range w.asked {
+				bw.Asked = append(bw.Asked, p)
+			}
+			for p := range w.dontHaves {
+				bw.DontHaves = append(bw.DontHaves, p)
+			}
+			slices.Sort(bw.Sessions)
+			slices.Sort(bw.Asked)
+			slices.Sort(bw.DontHaves)
+		}
+		out = append(out, bw)
+	}
+	bi.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b bitswapWant) int {
+		sa, oka := since[a.Cid]
+		sb, okb := since[b.Cid]
+		switch {
+		case oka && !okb:
+			return -1
+		case !oka && okb:
+			return 1
+		case oka && okb && !sa.Equal(sb):
+			return sa.Compare(sb)
+		}
+		return strings.Compare(a.Cid.KeyString(), b.Cid.KeyString())
+	})
+	return out
+}
+
+// bitswapPeer are the stats of a peer, and its ledger when the Bitswap
+// server is enabled.
+type bitswapPeer struct {
+	Peer peer.ID
+	bitswapPeerStats
+	Ledger *bsserver.Receipt `json:",omitempty"`
+}
+
+type bitswapClientStats struct {
+	Wants            int
+	BlocksReceived   uint64
+	DataReceived     uint64
+	DupBlksReceived  uint64
+	DupDataReceived  uint64
+	MessagesReceived uint64
+}
+
+type bitswapServerStats struct {
+	BlocksSent uint64
+	DataSent   uint64
+}
+
+// bitswapStats are the stats of the Bitswap client and server.
+type bitswapStats struct {
+	Client bitswapClientStats
+	Server *bitswapServerStats `json:",omitempty"`
+	Peers  []bitswapPeer
+}
+
+// stats returns the stats of the Bitswap client and server, and of the peers
+// we recently exchanged messages with.
+func (bi *bitswapInspector) stats() (bitswapStats, error) {
+	var out bitswapStats
+	if bi.client != nil {
+		st, err := bi.client.Stat()
+		if err != nil {
+			return out, err
+		}
+		out.Client = bitswapClientStats{
+			Wants:            len(st.Wantlist),
+			BlocksReceived:   st.BlocksReceived,
+			DataReceived:     st.DataReceived,
+			DupBlksReceived:  st.DupBlksReceived,
+			DupDataReceived:  st.DupDataReceived,
+			MessagesReceived: st.MessagesReceived,
+		}
+	}
+
+	peers := make(map[peer.ID]*bitswapPeer)
+	bi.mu.Lock()
+	for p, st := range bi.peers {
+		peers[p] = &bitswapPeer{Peer: p, bitswapPeerStats: *st}
+	}
+	bi.mu.Unlock()
+
+	if bi.server != nil {
+		st, err := bi.server.Stat()
+		if err != nil {
+			return out, err
+		}
+		out.Server = &bitswapServerStats{BlocksSent: st.BlocksSent, DataSent: st.DataSent}
+
+		for _, s := range st.Peers {
+			p, err := peer.Decode(s)
+			if err != nil {
+				continue
+			}
+			if _, ok := peers[p]; !ok {
+				peers[p] = &bitswapPeer{Peer: p}
+			}
+		}
+		for p, bp := range peers {
+			bp.Ledger = bi.server.LedgerForPeer(p)
+		}
+	}
+
+	out.Peers = make([]bitswapPeer, 0, len(peers))
+	for _, bp := range peers {
+		out.Peers = append(out.Peers, *bp)
+	}
+	slices.SortFunc(out.Peers, func(a, b bitswapPeer) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return out, nil
+}
+
+// prune forgets the stats of the peers that went idle.
+func (bi *bitswapInspector) prune(now time.Time) {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	for p, st := range bi.peers {
+		if now.Sub(st.LastSeen) > bitswapInspectIdle {
+			delete(bi.peers, p)
+		}
+	}
+}
+
+// start prunes the idle peers until ctx is cancelled. The pruning goroutine
+// is added to wg.
+func (bi *bitswapInspector) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		ticker := time.NewTicker(bitswapInspectIdle)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				bi.prune(now)
+			}
+		}
+	})
+}
+
+// inspectingExchange records the CIDs requested from the exchange, and the
+// session requesting them. Every call outside of a session is its own
+// session, like in the Bitswap client.
+type inspectingExchange struct {
+	exchange.SessionExchange
+	bi *bitswapInspector
+}
+
+func (e *inspectingExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return inspectedGetBlock(ctx, e.SessionExchange, e.bi, e.bi.newSession(), c)
+}
+
+func (e *inspectingExchange) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	return inspectedGetBlocks(ctx, e.SessionExchange, e.bi, e.bi.newSession(), cids)
+}
+
+func (e *inspectingExchange) NewSession(ctx context.Context) exchange.Fetcher {
+	return &inspectingFetcher{
+		Fetcher: e.SessionExchange.NewSession(ctx),
+		bi:      e.bi,
+		session: e.bi.newSession(),
+	}
+}
+
+type inspectingFetcher struct {
+	exchange.Fetcher
+	bi      *bitswapInspector
+	session uint64
+}
+
+func (f *inspectingFetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return inspectedGetBlock(ctx, f.Fetcher, f.bi, f.session, c)
+}
+
+func (f *inspectingFetcher) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	return inspectedGetBlocks(ctx, f.Fetcher, f.bi, f.session, cids)
+}
+
+func inspectedGetBlock(ctx context.Context, f exchange.Fetcher, bi *bitswapInspector, session uint64, c cid.Cid) (blocks.Block, error) {
+	bi.want(session, c)
+	defer bi.done(session, c)
+	return f.GetBlock(ctx, c)
+}
+
+func inspectedGetBlocks(ctx context.Context, f exchange.Fetcher, bi *bitswapInspector, session uint64, cids []cid.Cid) (<-chan blocks.Block, error) {
+	// A block is returned once, however many times it is requested: count
+	// every CID once, so that all of them are done when the blocks arrive.
+	pending := make(map[cid.Cid]struct{}, len(cids))
+	for _, c := range cids {
+		pending[c] = struct{}{}
+	}
+	wanted := slices.Collect(maps.Keys(pending))
+	bi.want(session, wanted...)
+	in, err := f.GetBlocks(ctx, cids)
+	if err != nil {
+		bi.done(session, wanted...)
+		return nil, err
+	}
+
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		defer func() {
+			for c := range pending {
+				bi.done(session, c)
+			}
+		}()
+		for b := range in {
+			if _, ok := pending[b.Cid()]; ok {
+				delete(pending, b.Cid())
+				bi.done(session, b.Cid())
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+var (
+	_ exchange.SessionExchange = (*inspectingExchange)(nil)
+	_ exchange.Fetcher         = (*inspectingFetcher)(nil)
+)
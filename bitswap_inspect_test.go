@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/bitswap"
+	bsclient "github.com/ipfs/boxo/bitswap/client"
+	bsnet "github.com/ipfs/boxo/bitswap/network/bsnet"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapInspector(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	newBlockstore := func() blockstore.Blockstore {
+		return blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	}
+
+	// The remote peer serves one block and answers DONT_HAVE for the others.
+	remote, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer remote.Close()
+	cached := blocks.NewBlock([]byte("cached"))
+	missing := blocks.NewBlock([]byte("missing"))
+	remoteBs := newBlockstore()
+	require.NoError(t, remoteBs.Put(ctx, cached))
+	remoteNet := bsnet.NewFromIpfsHost(remote)
+	server := bitswap.New(ctx, remoteNet, nil, remoteBs, bitswap.SetSendDontHaves(true))
+	remoteNet.Start(server)
+	defer server.Close()
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer h.Close()
+	bi := newBitswapInspector()
+	exnet := &observingNetwork{BitSwapNetwork: bsnet.NewFromIpfsHost(h), sent: []messageHook{bi.sent}, received: []messageHook{bi.received}}
+	client := bsclient.New(ctx, exnet, nil, newBlockstore())
+	exnet.Start(client)
+	defer client.Close()
+	bi.client = client
+	ex := &inspectingExchange{SessionExchange: client, bi: bi}
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: remote.ID(), Addrs: remote.Addrs()}))
+
+	// DONT_HAVEs are only asked to the peers of the session.
+	wantCtx, stop := context.WithCancel(ctx)
+	ses := ex.NewSession(wantCtx)
+	getCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err = ses.GetBlock(getCtx, cached.Cid())
+	require.NoError(t, err)
+	go func() {
+		_, _ = ses.GetBlock(wantCtx, missing.Cid())
+	}()
+
+	wantlist := func() []bitswapWant {
+		rec := httptest.NewRecorder()
+		bitswapWantlistHandler(bi)(rec, httptest.NewRequest(http.MethodGet, "/mgr/bitswap/wantlist", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var body struct {
+			Count int
+			Wants []bitswapWant
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		require.Len(t, body.Wants, body.Count)
+		return body.Wants
+	}
+
+	// The pending want shows its session, the peer asked and its DONT_HAVE.
+	require.Eventually(t, func() bool {
+		wants := wantlist()
+		i := slices.IndexFunc(wants, func(w bitswapWant) bool { return w.Cid == missing.Cid() })
+		return i >= 0 && wants[i].Age != "" && len(wants[i].Sessions) == 1 &&
+			slices.Contains(wants[i].Asked, remote.ID()) && slices.Contains(wants[i].DontHaves, remote.ID())
+	}, 10*time.Second, 50*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	bitswapStatsHandler(bi)(rec, httptest.NewRequest(http.MethodGet, "/mgr/bitswap/stats", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats bitswapStats
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&stats))
+	require.Nil(t, stats.Server)
+	require.EqualValues(t, 1, stats.Client.BlocksReceived)
+	require.Len(t, stats.Peers, 1)
+	require.Equal(t, remote.ID(), stats.Peers[0].Peer)
+	require.EqualValues(t, 1, stats.Peers[0].BlocksReceived)
+	require.EqualValues(t, len(cached.RawData()), stats.Peers[0].BytesReceived)
+	require.NotZero(t, stats.Peers[0].WantsSent)
+	require.NotZero(t, stats.Peers[0].DontHaves)
+
+	// Wants are forgotten once no session waits for them anymore.
+	stop()
+	require.Eventually(t, func() bool {
+		bi.mu.Lock()
+		defer bi.mu.Unlock()
+		return len(bi.wants) == 0
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// Duplicate CIDs are only waited for once.
+	blks, err := ex.GetBlocks(getCtx, []cid.Cid{cached.Cid(), cached.Cid()})
+	require.NoError(t, err)
+	for range blks {
+	}
+	bi.mu.Lock()
+	require.Empty(t, bi.wants)
+	bi.mu.Unlock()
+
+	rec = httptest.NewRecorder()
+	bitswapStatsHandler(bi)(rec, httptest.NewRequest(http.MethodPost, "/mgr/bitswap/stats", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	bitswapWantlistHandler(nil)(rec, httptest.NewRequest(http.MethodGet, "/mgr/bitswap/wantlist", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// servingLimiterIdle is how long the budgets of a peer that stopped sending
+// us wants are kept.
+const servingLimiterIdle = 5 * time.Minute
+
+var (
+	servingRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "bitswap_server_requests_total",
+		Help:      "Number of wants received by the public Bitswap server, by outcome: 'allowed', or the budget that was exhausted ('peer_requests', 'peer_bandwidth', 'bandwidth').",
+	}, []string{"outcome"})
+	servingBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "bitswap_server_sent_blocks_total",
+		Help:      "Number of blocks sent by the Bitswap server.",
+	})
+	servingBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "bitswap_server_sent_bytes_total",
+		Help:      "Number of block bytes sent by the Bitswap server.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(servingRequests, servingBlocks, servingBytes)
+}
+
+// tokenBucket is a rate limiter that can go into debt, so that the bytes of a
+// block are accounted for once it is sent. A zero rate means no limit.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	// Allow bursts of one second worth of tokens.
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// available reports whether the bucket is not in debt.
+func (b *tokenBucket) available(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens > 0
+}
+
+// take removes n tokens if they are available.
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// spend removes n tokens, going into debt if needed.
+func (b *tokenBucket) spend(n float64, now time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens -= n
+}
+
+type peerBudget struct {
+	requests  *tokenBucket
+	bandwidth *tokenBucket
+	lastSeen  time.Time
+}
+
+// servingLimiter enforces the budgets of the public Bitswap server, so that
+// serving the network never competes with the gateway for bandwidth.
+type servingLimiter struct {
+	peerRequests  float64
+	peerBandwidth float64
+
+	mu        sync.Mutex
+	bandwidth *tokenBucket
+	peers     map[peer.ID]*peerBudget
+}
+
+func newServingLimiter(peerRequests int, peerBandwidth, maxBandwidth int64) *servingLimiter {
+	return &servingLimiter{
+		peerRequests:  float64(peerRequests),
+		peerBandwidth: float64(peerBandwidth),
+		bandwidth:     newTokenBucket(float64(maxBandwidth), time.Now()),
+		peers:         make(map[peer.ID]*peerBudget),
+	}
+}
+
+// setLimits changes the budgets, including the ones of the peers already
+// seen.
+func (l *servingLimiter) setLimits(peerRequests int, peerBandwidth, maxBandwidth int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peerRequests = float64(peerRequests)
+	l.peerBandwidth = float64(peerBandwidth)
+	l.bandwidth.rate = float64(maxBandwidth)
+	for _, b := range l.peers {
+		b.requests.rate = l.peerRequests
+		b.bandwidth.rate = l.peerBandwidth
+	}
+}
+
+func (l *servingLimiter) budget(p peer.ID, now time.Time) *peerBudget {
+	b, ok := l.peers[p]
+	if !ok {
+		b = &peerBudget{
+			requests:  newTokenBucket(l.peerRequests, now),
+			bandwidth: newTokenBucket(l.peerBandwidth, now),
+		}
+		l.peers[p] = b
+	}
+	b.lastSeen = now
+	return b
+}
+
+// allow reports whether a want from p can be answered.
+func (l *servingLimiter) allow(p peer.ID) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.budget(p, now)
+	var outcome string
+	switch {
+	case !l.bandwidth.available(now):
+		outcome = "bandwidth"
+	case !b.bandwidth.available(now):
+		outcome = "peer_bandwidth"
+	case !b.requests.take(1, now):
+		outcome = "peer_requests"
+	default:
+		servingRequests.WithLabelValues("allowed").Inc()
+		return true
+	}
+	servingRequests.WithLabelValues(outcome).Inc()
+	return false
+}
+
+// sent accounts for the blocks sent to p.
+func (l *servingLimiter) sent(p peer.ID, msg bsmsg.BitSwapMessage) {
+	blks := msg.Blocks()
+	if len(blks) == 0 {
+		return
+	}
+	var size int
+	for _, b := range blks {
+		size += len(b.RawData())
+	}
+	servingBlocks.Add(float64(len(blks)))
+	servingBytes.Add(float64(size))
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bandwidth.spend(float64(size), now)
+	l.budget(p, now).bandwidth.spend(float64(size), now)
+}
+
+// prune forgets the budgets of the peers that went idle.
+func (l *servingLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for p, b := range l.peers {
+		if now.Sub(b.lastSeen) > servingLimiterIdle {
+			delete(l.peers, p)
+		}
+	}
+}
+
+// start prunes the idle peers until ctx is cancelled. The pruning goroutine
+// is added to wg.
+func (l *servingLimiter) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		ticker := time.NewTicker(servingLimiterIdle)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				l.prune(now)
+			}
+		}
+	})
+}
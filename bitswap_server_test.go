@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	b := newTokenBucket(10, now)
+	for range 10 {
+		require.True(t, b.take(1, now))
+	}
+	require.False(t, b.take(1, now))
+	require.False(t, b.available(now))
+
+	// Tokens come back over time, up to one second worth of them.
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, b.take(5, now))
+	require.False(t, b.take(1, now))
+	now = now.Add(time.Hour)
+	require.True(t, b.take(10, now))
+	require.False(t, b.take(1, now))
+
+	// Spending can go into debt, which has to be paid back.
+	b.spend(20, now)
+	require.False(t, b.available(now.Add(time.Second)))
+	require.True(t, b.available(now.Add(2100*time.Millisecond)))
+
+	// A zero rate means no limit.
+	unlimited := newTokenBucket(0, now)
+	require.True(t, unlimited.take(1e9, now))
+	unlimited.spend(1e9, now)
+	require.True(t, unlimited.available(now))
+}
+
+func TestServingLimiter(t *testing.T) {
+	t.Parallel()
+
+	blk := blocks.NewBlock(make([]byte, 1000))
+	msg := bsmsg.New(false)
+	msg.AddBlock(blk)
+
+	t.Run("peer requests", func(t *testing.T) {
+		t.Parallel()
+		l := newServingLimiter(2, 0, 0)
+		p, other := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+		require.True(t, l.allow(p))
+		require.True(t, l.allow(p))
+		require.False(t, l.allow(p))
+		require.True(t, l.allow(other))
+	})
+
+	t.Run("peer bandwidth", func(t *testing.T) {
+		t.Parallel()
+		l := newServingLimiter(0, 500, 0)
+		p, other := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+		require.True(t, l.allow(p))
+		l.sent(p, msg)
+		require.False(t, l.allow(p))
+		require.True(t, l.allow(other))
+	})
+
+	t.Run("global bandwidth", func(t *testing.T) {
+		t.Parallel()
+		l := newServingLimiter(0, 0, 500)
+		p, other := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+		require.True(t, l.allow(p))
+		l.sent(p, msg)
+		require.False(t, l.allow(p))
+		require.False(t, l.allow(other))
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		t.Parallel()
+		l := newServingLimiter(1, 0, 0)
+		p := test.RandPeerIDFatal(t)
+		require.True(t, l.allow(p))
+		l.prune(time.Now())
+		require.Len(t, l.peers, 1)
+		l.prune(time.Now().Add(2 * servingLimiterIdle))
+		require.Empty(t, l.peers)
+		require.True(t, l.allow(p))
+	})
+
+	t.Run("set limits", func(t *testing.T) {
+		t.Parallel()
+		l := newServingLimiter(1, 0, 0)
+		p := test.RandPeerIDFatal(t)
+		require.True(t, l.allow(p))
+		require.False(t, l.allow(p))
+
+		// New budgets apply to the peers already seen.
+		l.setLimits(0, 0, 0)
+		require.True(t, l.allow(p))
+	})
+}
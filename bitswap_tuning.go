@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// bitswapTunables are the Bitswap client and provider query settings, as
+// returned by /mgr/bitswap/tuning.
+type bitswapTunables struct {
+	ProviderSearchDelay string
+	RebroadcastDelay    string
+
+	RoutingMaxRequests  int
+	RoutingMaxProviders int
+	RoutingMaxTimeout   string
+}
+
+// bitswapTuningResult is returned by /mgr/bitswap/tuning. RestartRequired
+// holds the parameters of a POST with a value other than the current one.
+type bitswapTuningResult struct {
+	bitswapTunables
+	RestartRequired []string
+}
+
+// bitswapTuningUpdate holds the settings to change, the nil ones are left
+// as they are.
+type bitswapTuningUpdate struct {
+	providerSearchDelay *time.Duration
+	rebroadcastDelay    *time.Duration
+	maxRequests         *int
+	maxProviders        *int
+	maxTimeout          *time.Duration
+}
+
+// bitswapTuning holds the Bitswap session delays and the provider query
+// limits the Bitswap client and the provider query manager were created
+// with. Boxo only takes them as options when these are created, so changing
+// them requires a restart.
+type bitswapTuning struct {
+	providerSearchDelay time.Duration
+	rebroadcastDelay    time.Duration
+	maxRequests         int
+	maxProviders        int
+	maxTimeout          time.Duration
+}
+
+func newBitswapTuning(cfg Config) *bitswapTuning {
+	return &bitswapTuning{
+		providerSearchDelay: cfg.BitswapProviderSearchDelay,
+		rebroadcastDelay:    cfg.BitswapRebroadcastDelay,
+		maxRequests:         cfg.RoutingMaxRequests,
+		maxProviders:        cfg.RoutingMaxProviders,
+		maxTimeout:          cfg.RoutingMaxTimeout,
+	}
+}
+
+// get returns the current settings.
+func (t *bitswapTuning) get() bitswapTunables {
+	return bitswapTunables{
+		ProviderSearchDelay: t.providerSearchDelay.String(),
+		RebroadcastDelay:    t.rebroadcastDelay.String(),
+		RoutingMaxRequests:  t.maxRequests,
+		RoutingMaxProviders: t.maxProviders,
+		RoutingMaxTimeout:   t.maxTimeout.String(),
+	}
+}
+
+// check returns an error when the settings of u are invalid.
+func (t *bitswapTuning) check(u bitswapTuningUpdate) error {
+	switch {
+	case u.providerSearchDelay != nil && *u.providerSearchDelay <= 0:
+		return errors.New("bitswap-provider-search-delay must be positive")
+	case u.rebroadcastDelay != nil && *u.rebroadcastDelay <= 0:
+		return errors.New("bitswap-rebroadcast-delay must be positive")
+	case u.maxRequests != nil && *u.maxRequests < 0:
+		return errors.New("routing-max-requests must not be negative")
+	case u.maxProviders != nil && *u.maxProviders < 0:
+		return errors.New("routing-max-providers must not be negative")
+	case u.maxTimeout != nil && *u.maxTimeout <= 0:
+		return errors.New("routing-max-timeout must be positive")
+	}
+	return nil
+}
+
+// changed returns the parameters of the settings of u that differ from the
+// current ones.
+func (t *bitswapTuning) changed(u bitswapTuningUpdate) []string {
+	var params []string
+	if u.providerSearchDelay != nil && *u.providerSearchDelay != t.providerSearchDelay {
+		params = append(params, "bitswap-provider-search-delay")
+	}
+	if u.rebroadcastDelay != nil && *u.rebroadcastDelay != t.rebroadcastDelay {
+		params = append(params, "bitswap-rebroadcast-delay")
+	}
+	if u.maxRequests != nil && *u.maxRequests != t.maxRequests {
+		params = append(params, "routing-max-requests")
+	}
+	if u.maxProviders != nil && *u.maxProviders != t.maxProviders {
+		params = append(params, "routing-max-providers")
+	}
+	if u.maxTimeout != nil && *u.maxTimeout != t.maxTimeout {
+		params = append(params, "routing-max-timeout")
+	}
+	return params
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapTuningHandler(t *testing.T) {
+	t.Parallel()
+
+	tuning := newBitswapTuning(Config{
+		BitswapProviderSearchDelay: time.Second,
+		BitswapRebroadcastDelay:    10 * time.Second,
+		RoutingMaxRequests:         16,
+		RoutingMaxTimeout:          10 * time.Second,
+	})
+	handler := bitswapTuningHandler(tuning)
+	for _, target := range []string{
+		"/mgr/bitswap/tuning?routing-max-requests=-1",
+		"/mgr/bitswap/tuning?routing-max-providers=x",
+		"/mgr/bitswap/tuning?routing-max-timeout=0s",
+		"/mgr/bitswap/tuning?bitswap-rebroadcast-delay=0s",
+		"/mgr/bitswap/tuning?bitswap-provider-search-delay=x",
+		"/mgr/bitswap/tuning?unknown=1",
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		require.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+
+	want := bitswapTunables{
+		ProviderSearchDelay: "1s",
+		RebroadcastDelay:    "10s",
+		RoutingMaxRequests:  16,
+		RoutingMaxTimeout:   "10s",
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/mgr/bitswap/tuning", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got bitswapTuningResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	require.Equal(t, bitswapTuningResult{bitswapTunables: want, RestartRequired: []string{}}, got)
+
+	// The settings that differ require a restart, and are left as they are.
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/mgr/bitswap/tuning?bitswap-provider-search-delay=10ms&routing-max-requests=16&routing-max-timeout=1m", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	require.Equal(t, bitswapTuningResult{
+		bitswapTunables: want,
+		RestartRequired: []string{"bitswap-provider-search-delay", "routing-max-timeout"},
+	}, got)
+	require.Equal(t, want, tuning.get())
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodDelete, "/mgr/bitswap/tuning", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	bitswapTuningHandler(nil)(rec, httptest.NewRequest(http.MethodGet, "/mgr/bitswap/tuning", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
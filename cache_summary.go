@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/ipfs/bbloom"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	cacheSummaryProtocol = protocol.ID("/rainbow/cache-summary/1.0.0")
+	// cacheSummaryFalsePositives is the false positive rate of the Bloom
+	// filters. A false positive costs a Bitswap want to a peered peer.
+	cacheSummaryFalsePositives = 0.01
+	// cacheSummaryMinEntries is the minimum capacity of a filter, so that it
+	// does not saturate right away on a node with an empty cache.
+	cacheSummaryMinEntries = 1 << 16
+	// cacheSummaryMaxSize bounds the size of a summary received from a peer.
+	cacheSummaryMaxSize = 64 << 20
+	// cacheSummaryTimeout bounds the exchange of a summary with a peer.
+	cacheSummaryTimeout = time.Minute
+)
+
+var cacheSummaryHints = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ipfs",
+	Subsystem: "rainbow",
+	Name:      "cache_summary_hints_total",
+	Help:      "Number of peered peers returned first as providers of a CID because their cache summary likely contains it.",
+})
+
+func init() {
+	prometheus.MustRegister(cacheSummaryHints)
+}
+
+// cacheSummaries periodically builds a Bloom filter over the blocks in our
+// blockstore and exchanges it with the peered peers sharing their cache, so
+// that the peers that likely have a block can be asked before routing.
+type cacheSummaries struct {
+	h        host.Host
+	bs       blockstore.Blockstore
+	pm       *peeringManager
+	interval time.Duration
+	// entries is the number of blocks found by the last build, only used
+	// by the refresh loop.
+	entries int
+
+	mu     sync.RWMutex
+	local  []byte
+	remote map[peer.ID]*bbloom.Bloom
+}
+
+func newCacheSummaries(h host.Host, bs blockstore.Blockstore, pm *peeringManager, interval time.Duration) *cacheSummaries {
+	return &cacheSummaries{
+		h:        h,
+		bs:       bs,
+		pm:       pm,
+		interval: interval,
+		remote:   make(map[peer.ID]*bbloom.Bloom),
+	}
+}
+
+// build returns a Bloom filter over the multihashes in the blockstore. The
+// filter is sized for twice the number of blocks found by the previous build,
+// so that the blockstore is walked once, unless the number of blocks more
+// than doubled since, like at the first build.
+func (cs *cacheSummaries) build(ctx context.Context) (*bbloom.Bloom, error) {
+	for {
+		capacity := max(2*cs.entries, cacheSummaryMinEntries)
+		bf, count, err := cs.fill(ctx, capacity)
+		if err != nil {
+			return nil, err
+		}
+		cs.entries = count
+		if count <= capacity {
+			return bf, nil
+		}
+		goLog.Debugw("cache summary over capacity, building it again", "entries", count, "capacity", capacity)
+	}
+}
+
+// fill returns a Bloom filter sized for capacity entries over the
+// multihashes in the blockstore, and their number.
+func (cs *cacheSummaries) fill(ctx context.Context, capacity int) (*bbloom.Bloom, int, error) {
+	// The filter hashes content chosen by third parties: use secret keys.
+	var keys [16]byte
+	if _, err := rand.Read(keys[:]); err != nil {
+		return nil, 0, err
+	}
+	bf, err := bbloom.NewWithKeys(binary.LittleEndian.Uint64(keys[:8]), binary.LittleEndian.Uint64(keys[8:]),
+		float64(capacity), cacheSummaryFalsePositives)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ch, err := cs.bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var count int
+	for c := range ch {
+		bf.Add(c.Hash())
+		count++
+	}
+	return bf, count, ctx.Err()
+}
+
+// handle sends our summary to the peers allowed to use our cache.
+func (cs *cacheSummaries) handle(s network.Stream) {
+	if !cs.pm.sharesCache(s.Conn().RemotePeer()) {
+		_ = s.Reset()
+		return
+	}
+
+	cs.mu.RLock()
+	data := cs.local
+	cs.mu.RUnlock()
+
+	_ = s.SetWriteDeadline(time.Now().Add(cacheSummaryTimeout))
+	if _, err := s.Write(data); err != nil {
+		_ = s.Reset()
+		return
+	}
+	_ = s.Close()
+}
+
+// fetch retrieves the summary of p.
+func (cs *cacheSummaries) fetch(ctx context.Context, p peer.ID) (*bbloom.Bloom, error) {
+	ctx, cancel := context.WithTimeout(ctx, cacheSummaryTimeout)
+	defer cancel()
+
+	s, err := cs.h.NewStream(ctx, p, cacheSummaryProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	_ = s.SetReadDeadline(time.Now().Add(cacheSummaryTimeout))
+
+	data, err := io.ReadAll(io.LimitReader(s, cacheSummaryMaxSize+1))
+	if err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	if len(data) > cacheSummaryMaxSize {
+		_ = s.Reset()
+		return nil, errors.New("cache summary too large")
+	}
+	return decodeCacheSummary(data)
+}
+
+// decodeCacheSummary checks the summary sent by a peer before decoding it, as
+// bbloom panics on malformed filters.
+func decodeCacheSummary(data []byte) (*bbloom.Bloom, error) {
+	var raw struct {
+		FilterSet []byte
+		SetLocs   uint64
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	// bbloom filters have at least 512 bits, and a power of two.
+	n := len(raw.FilterSet)
+	if n < 64 || bits.OnesCount(uint(n)) != 1 {
+		return nil, fmt.Errorf("invalid filter size %d", n)
+	}
+	if raw.SetLocs < 1 || raw.SetLocs > 64 {
+		return nil, fmt.Errorf("invalid number of hash locations %d", raw.SetLocs)
+	}
+	return bbloom.JSONUnmarshal(data)
+}
+
+// refresh rebuilds our summary, then fetches the summaries of the connected
+// peered peers.
+func (cs *cacheSummaries) refresh(ctx context.Context) {
+	start := time.Now()
+	bf, err := cs.build(ctx)
+	if err != nil {
+		goLog.Warnw("error building cache summary", "err", err)
+	} else {
+		data := bf.JSONMarshal()
+		cs.mu.Lock()
+		cs.local = data
+		cs.mu.Unlock()
+		goLog.Debugw("built cache summary", "entries", bf.ElementsAdded(), "size", len(data), "took", time.Since(start))
+	}
+
+	remote := make(map[peer.ID]*bbloom.Bloom)
+	for _, p := range cs.pm.list() {
+		if !p.Connected {
+			continue
+		}
+		bf, err := cs.fetch(ctx, p.ID)
+		if err != nil {
+			goLog.Debugw("cannot fetch cache summary", "peer", p.ID, "err", err)
+			continue
+		}
+		remote[p.ID] = bf
+	}
+
+	cs.mu.Lock()
+	cs.remote = remote
+	cs.mu.Unlock()
+}
+
+// likelyHave returns the peered peers whose summary contains c.
+func (cs *cacheSummaries) likelyHave(c cid.Cid) []peer.ID {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	var out []peer.ID
+	for p, bf := range cs.remote {
+		if bf.Has(c.Hash()) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// start serves our summary, and refreshes the summaries every interval until
+// ctx is cancelled. The refreshing goroutine is added to wg.
+func (cs *cacheSummaries) start(ctx context.Context, wg *sync.WaitGroup) {
+	cs.h.SetStreamHandler(cacheSummaryProtocol, cs.handle)
+	context.AfterFunc(ctx, func() {
+		cs.h.RemoveStreamHandler(cacheSummaryProtocol)
+	})
+
+	wg.Go(func() {
+		ticker := time.NewTicker(cs.interval)
+		defer ticker.Stop()
+		for {
+			cs.refresh(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// summaryFinder returns the peered peers that likely have a CID as its first
+// providers, ahead of the ones found by routing. It is the provider finder
+// of the Bitswap client, so the wants sent to them are tracked and cancelled
+// by the client like the ones sent to any provider.
+type summaryFinder struct {
+	routing.ContentDiscovery
+	cs *cacheSummaries
+}
+
+func (f *summaryFinder) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	hints := f.cs.likelyHave(c)
+	if len(hints) == 0 {
+		return f.ContentDiscovery.FindProvidersAsync(ctx, c, count)
+	}
+
+	in := f.ContentDiscovery.FindProvidersAsync(ctx, c, count)
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		seen := make(map[peer.ID]struct{}, len(hints))
+		for _, p := range hints {
+			seen[p] = struct{}{}
+			select {
+			case out <- peer.AddrInfo{ID: p, Addrs: f.cs.h.Peerstore().Addrs(p)}:
+				cacheSummaryHints.Inc()
+			case <-ctx.Done():
+				return
+			}
+		}
+		for ai := range in {
+			if _, ok := seen[ai.ID]; ok {
+				continue
+			}
+			select {
+			case out <- ai:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSummaries(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	type node struct {
+		h  host.Host
+		pm *peeringManager
+		cs *cacheSummaries
+	}
+	newNode := func() node {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() { h.Close() })
+		pm, err := newPeeringManager(ctx, &sync.WaitGroup{}, h, dssync.MutexWrap(datastore.NewMapDatastore()))
+		require.NoError(t, err)
+		bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+		return node{h: h, pm: pm, cs: newCacheSummaries(h, bs, pm, 0)}
+	}
+	a, b, stranger := newNode(), newNode(), newNode()
+	a.pm.addConfigured(peeringSourceConfig, peer.AddrInfo{ID: b.h.ID(), Addrs: b.h.Addrs()})
+	b.pm.addConfigured(peeringSourceConfig, peer.AddrInfo{ID: a.h.ID(), Addrs: a.h.Addrs()})
+	stranger.pm.addConfigured(peeringSourceConfig, peer.AddrInfo{ID: b.h.ID(), Addrs: b.h.Addrs()})
+	for _, n := range []node{a, stranger} {
+		require.NoError(t, n.h.Connect(ctx, peer.AddrInfo{ID: b.h.ID(), Addrs: b.h.Addrs()}))
+	}
+
+	cached := blocks.NewBlock([]byte("cached"))
+	require.NoError(t, b.cs.bs.Put(ctx, cached))
+	missing := blocks.NewBlock([]byte("missing"))
+
+	// b only sends its summary to the peers sharing its cache.
+	b.cs.h.SetStreamHandler(cacheSummaryProtocol, b.cs.handle)
+	b.cs.refresh(ctx)
+	a.cs.refresh(ctx)
+	require.Equal(t, []peer.ID{b.h.ID()}, a.cs.likelyHave(cached.Cid()))
+	require.Empty(t, a.cs.likelyHave(missing.Cid()))
+
+	_, err := stranger.cs.fetch(ctx, b.h.ID())
+	require.Error(t, err)
+
+	// The peers that likely have a block are returned first.
+	other := peer.AddrInfo{ID: stranger.h.ID()}
+	f := &summaryFinder{
+		ContentDiscovery: staticFinder{other, {ID: b.h.ID()}},
+		cs:               a.cs,
+	}
+	provs := collectProviders(f.FindProvidersAsync(ctx, cached.Cid(), 0))
+	require.Len(t, provs, 2)
+	require.Equal(t, b.h.ID(), provs[0].ID)
+	require.NotEmpty(t, provs[0].Addrs)
+	require.Equal(t, other.ID, provs[1].ID)
+	provs = collectProviders(f.FindProvidersAsync(ctx, missing.Cid(), 0))
+	require.Equal(t, other.ID, provs[0].ID)
+}
+
+func TestDecodeCacheSummary(t *testing.T) {
+	t.Parallel()
+
+	summary := func(size int, locs uint64) string {
+		data, err := json.Marshal(map[string]any{"FilterSet": make([]byte, size), "SetLocs": locs})
+		require.NoError(t, err)
+		return string(data)
+	}
+	for _, data := range []string{
+		`not json`,
+		summary(8, 3),
+		summary(96, 3),
+		summary(64, 0),
+	} {
+		_, err := decodeCacheSummary([]byte(data))
+		require.Error(t, err, data)
+	}
+	_, err := decodeCacheSummary([]byte(summary(64, 3)))
+	require.NoError(t, err)
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	cs := newCacheSummaries(nil, bs, nil, 0)
+	bf, err := cs.build(t.Context())
+	require.NoError(t, err)
+	_, err = decodeCacheSummary(bf.JSONMarshal())
+	require.NoError(t, err)
+}
+
+// walkCountingBlockstore counts the walks of the blockstore.
+type walkCountingBlockstore struct {
+	blockstore.Blockstore
+	walks int
+}
+
+func (bs *walkCountingBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	bs.walks++
+	return bs.Blockstore.AllKeysChan(ctx)
+}
+
+func TestCacheSummaryBuild(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	bs := &walkCountingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+	blk := blocks.NewBlock([]byte("cache summary build"))
+	require.NoError(t, bs.Put(ctx, blk))
+
+	// The blockstore is walked once per build.
+	cs := newCacheSummaries(nil, bs, nil, 0)
+	for i := range 2 {
+		bf, err := cs.build(ctx)
+		require.NoError(t, err)
+		require.True(t, bf.Has(blk.Cid().Hash()))
+		require.Equal(t, i+1, bs.walks)
+	}
+	require.Equal(t, 1, cs.entries)
+}
+
+// staticFinder returns the same providers for every CID.
+type staticFinder []peer.AddrInfo
+
+func (f staticFinder) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	ch := make(chan peer.AddrInfo, len(f))
+	for _, ai := range f {
+		ch <- ai
+	}
+	close(ch)
+	return ch
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/namesys"
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/boxo/path/resolver"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+const (
+	// warmMaxRunning bounds the number of cache warming jobs running at the
+	// same time.
+	warmMaxRunning = 8
+	// warmMaxJobs is the number of jobs kept to report their status. The
+	// oldest finished jobs are forgotten first.
+	warmMaxJobs = 100
+	// warmBatchSize is the number of blocks requested at once.
+	warmBatchSize = 256
+	// warmStallTimeout is how long a job waits for the next block, or for a
+	// path to resolve, before giving up on it.
+	warmStallTimeout = time.Minute
+	// warmMaxErrors is the number of error messages kept for every job.
+	warmMaxErrors = 10
+	// warmTracked bounds the number of CIDs a job remembers to skip the
+	// blocks it already fetched. Blocks shared by parts of the DAGs further
+	// apart are fetched again, from the blockstore.
+	warmTracked = 1 << 18
+)
+
+var (
+	errWarmBusy     = errors.New("too many cache warming jobs running")
+	errWarmNotFound = errors.New("unknown cache warming job")
+)
+
+// warmJob is the status of a cache warming job.
+type warmJob struct {
+	ID       uint64
+	Paths    []string
+	Depth    int   // -1 for the full DAG
+	MaxBytes int64 `json:",omitempty"`
+
+	State     string // running, done or cancelled
+	Blocks    uint64
+	Bytes     uint64
+	Failures  uint64
+	Errors    []string `json:",omitempty"`
+	Truncated bool     `json:",omitempty"`
+	Started   time.Time
+	Finished  time.Time `json:",omitzero"`
+
+	cancel context.CancelFunc
+}
+
+// cacheWarmer fetches DAGs through the blockservice in the background, so
+// that their blocks are in the blockstore before traffic arrives. Warmed
+// blocks are not pinned: garbage collection removes them like any other. Jobs
+// run in wg and stop when ctx is cancelled.
+type cacheWarmer struct {
+	ctx  context.Context
+	wg   *sync.WaitGroup
+	bsrv blockservice.BlockService
+	ns   namesys.NameSystem
+	r    resolver.Resolver
+
+	mu     sync.Mutex
+	nextID uint64
+	jobs   []*warmJob
+}
+
+func newCacheWarmer(ctx context.Context, wg *sync.WaitGroup, bsrv blockservice.BlockService, ns namesys.NameSystem, r resolver.Resolver) *cacheWarmer {
+	return &cacheWarmer{ctx: ctx, wg: wg, bsrv: bsrv, ns: ns, r: r}
+}
+
+// start runs a job fetching the DAGs of paths, down to depth levels of links
+// (-1 for no limit) and up to maxBytes (0 for no limit).
+func (cw *cacheWarmer) start(paths []string, depth int, maxBytes int64) (warmJob, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	var running int
+	for _, j := range cw.jobs {
+		if j.State == "running" {
+			running++
+		}
+	}
+	if running >= warmMaxRunning {
+		return warmJob{}, errWarmBusy
+	}
+
+	ctx, cancel := context.WithCancel(cw.ctx)
+	cw.nextID++
+	job := &warmJob{
+		ID:       cw.nextID,
+		Paths:    paths,
+		Depth:    depth,
+		MaxBytes: maxBytes,
+		State:    "running",
+		Started:  time.Now(),
+		cancel:   cancel,
+	}
+	cw.jobs = append(cw.jobs, job)
+	cw.pruneLocked()
+
+	cw.wg.Go(func() {
+		defer cancel()
+		cw.run(ctx, job)
+		cw.mu.Lock()
+		defer cw.mu.Unlock()
+		if job.State == "running" {
+			job.State = "done"
+		}
+		job.Finished = time.Now()
+	})
+	return job.snapshot(), nil
+}
+
+// pruneLocked forgets the oldest finished jobs beyond warmMaxJobs.
+func (cw *cacheWarmer) pruneLocked() {
+	for i := 0; len(cw.jobs) > warmMaxJobs && i < len(cw.jobs); {
+		if cw.jobs[i].State == "running" {
+			i++
+			continue
+		}
+		cw.jobs = slices.Delete(cw.jobs, i, i+1)
+	}
+}
+
+func (j *warmJob) snapshot() warmJob {
+	s := *j
+	s.Paths = slices.Clone(j.Paths)
+	s.Errors = slices.Clone(j.Errors)
+	s.cancel = nil
+	return s
+}
+
+// list returns the status of all jobs, oldest first.
+func (cw *cacheWarmer) list() []warmJob {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	out := make([]warmJob, 0, len(cw.jobs))
+	for _, j := range cw.jobs {
+		out = append(out, j.snapshot())
+	}
+	return out
+}
+
+// get returns the status of a job.
+func (cw *cacheWarmer) get(id uint64) (warmJob, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	for _, j := range cw.jobs {
+		if j.ID == id {
+			return j.snapshot(), nil
+		}
+	}
+	return warmJob{}, errWarmNotFound
+}
+
+// stop cancels a running job.
+func (cw *cacheWarmer) stop(id uint64) (warmJob, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	for _, j := range cw.jobs {
+		if j.ID == id {
+			if j.State == "running" {
+				j.State = "cancelled"
+				j.cancel()
+			}
+			return j.snapshot(), nil
+		}
+	}
+	return warmJob{}, errWarmNotFound
+}
+
+// fail records a failure of job.
+func (cw *cacheWarmer) fail(job *warmJob, n int, err error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	job.Failures += uint64(n)
+	if len(job.Errors) < warmMaxErrors {
+		job.Errors = append(job.Errors, err.Error())
+	}
+}
+
+// fetched records a block fetched by job, and reports whether the job can go
+// on.
+func (cw *cacheWarmer) fetched(job *warmJob, b blocks.Block) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	job.Blocks++
+	job.Bytes += uint64(len(b.RawData()))
+	if job.MaxBytes > 0 && job.Bytes >= uint64(job.MaxBytes) {
+		job.Truncated = true
+		return false
+	}
+	return true
+}
+
+func (cw *cacheWarmer) run(ctx context.Context, job *warmJob) {
+	var roots []cid.Cid
+	for _, p := range job.Paths {
+		c, err := cw.resolve(ctx, p)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			cw.fail(job, 1, fmt.Errorf("cannot resolve %s: %w", p, err))
+			continue
+		}
+		roots = append(roots, c)
+	}
+
+	// DAGs have no cycles: forgetting a CID only fetches it again.
+	seen, _ := lru.New[cid.Cid, struct{}](warmTracked)
+	level := make([]cid.Cid, 0, len(roots))
+	for _, c := range roots {
+		if ok, _ := seen.ContainsOrAdd(c, struct{}{}); !ok {
+			level = append(level, c)
+		}
+	}
+	for depth := 0; len(level) > 0; depth++ {
+		var next []cid.Cid
+		for batch := range slices.Chunk(level, warmBatchSize) {
+			links, ok := cw.fetch(ctx, job, batch, job.Depth < 0 || depth < job.Depth)
+			if !ok {
+				return
+			}
+			for _, c := range links {
+				if ok, _ := seen.ContainsOrAdd(c, struct{}{}); !ok {
+					next = append(next, c)
+				}
+			}
+		}
+		level = next
+	}
+}
+
+// parseWarmPath parses a CID, or an /ipfs/ or /ipns/ path.
+func parseWarmPath(s string) (path.Path, error) {
+	if c, err := cid.Decode(s); err == nil {
+		return path.FromCid(c), nil
+	}
+	return path.NewPath(s)
+}
+
+// resolve returns the CID at the end of a CID, /ipfs/ or /ipns/ path.
+func (cw *cacheWarmer) resolve(ctx context.Context, s string) (cid.Cid, error) {
+	ctx, cancel := context.WithTimeout(ctx, warmStallTimeout)
+	defer cancel()
+
+	p, err := parseWarmPath(s)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if p.Mutable() {
+		res, err := namesys.Resolve(ctx, cw.ns, p)
+		if err != nil {
+			return cid.Undef, err
+		}
+		p = res.Path
+	}
+	ip, err := path.NewImmutablePath(p)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(ip.Segments()) == 2 {
+		return ip.RootCid(), nil
+	}
+	c, _, err := cw.r.ResolveToLastNode(ctx, ip)
+	return c, err
+}
+
+// fetch gets a batch of blocks and returns their links when withLinks is
+// set. It returns false when the job must stop.
+func (cw *cacheWarmer) fetch(ctx context.Context, job *warmJob, batch []cid.Cid, withLinks bool) ([]cid.Cid, bool) {
+	// Give up on the batch when no block arrives for too long.
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stall := time.AfterFunc(warmStallTimeout, cancel)
+	defer stall.Stop()
+
+	var links []cid.Cid
+	got := make(map[cid.Cid]struct{}, len(batch))
+	for b := range cw.bsrv.GetBlocks(batchCtx, batch) {
+		stall.Reset(warmStallTimeout)
+		got[b.Cid()] = struct{}{}
+		if !cw.fetched(job, b) {
+			return nil, false
+		}
+		if !withLinks {
+			continue
+		}
+		ls, err := blockLinks(b)
+		if err != nil {
+			cw.fail(job, 1, fmt.Errorf("cannot decode %s: %w", b.Cid(), err))
+			continue
+		}
+		links = append(links, ls...)
+	}
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	if missing := len(batch) - len(got); missing > 0 {
+		for _, c := range batch {
+			if _, ok := got[c]; !ok {
+				cw.fail(job, missing, fmt.Errorf("cannot fetch %s (and %d other blocks)", c, missing-1))
+				break
+			}
+		}
+	}
+	return links, true
+}
+
+// blockLinks returns the links of a block.
+func blockLinks(b blocks.Block) ([]cid.Cid, error) {
+	switch b.Cid().Type() {
+	case cid.Raw:
+		return nil, nil
+	case cid.DagProtobuf:
+		nd, err := merkledag.DecodeProtobufBlock(b)
+		if err != nil {
+			return nil, err
+		}
+		links := make([]cid.Cid, 0, len(nd.Links()))
+		for _, l := range nd.Links() {
+			links = append(links, l.Cid)
+		}
+		return links, nil
+	}
+
+	dec, err := multicodec.LookupDecoder(b.Cid().Type())
+	if err != nil {
+		return nil, err
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dec(nb, bytes.NewReader(b.RawData())); err != nil {
+		return nil, err
+	}
+	ls, err := traversal.SelectLinks(nb.Build())
+	if err != nil {
+		return nil, err
+	}
+	links := make([]cid.Cid, 0, len(ls))
+	for _, l := range ls {
+		if cl, ok := l.(cidlink.Link); ok {
+			links = append(links, cl.Cid)
+		}
+	}
+	return links, nil
+}
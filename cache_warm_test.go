@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheWarmer(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	newBlockstore := func() blockstore.Blockstore {
+		return blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	}
+
+	// A file of 64 leaves, with 4 links per node: 1+4+16+64 blocks.
+	src := newBlockstore()
+	dserv := merkledag.NewDAGService(blockservice.New(src, offline.Exchange(src)))
+	var data bytes.Buffer
+	for i := range 64 {
+		data.WriteString(strconv.Itoa(1000 + i))
+	}
+	db, err := (&helpers.DagBuilderParams{
+		Dagserv:   dserv,
+		Maxlinks:  4,
+		RawLeaves: true,
+	}).New(chunker.NewSizeSplitter(&data, 4))
+	require.NoError(t, err)
+	root, err := balanced.Layout(db)
+	require.NoError(t, err)
+
+	newWarmer := func() (*cacheWarmer, blockstore.Blockstore) {
+		local := newBlockstore()
+		return newCacheWarmer(ctx, &sync.WaitGroup{}, blockservice.New(local, &blockstoreExchange{bs: src}), nil, nil), local
+	}
+	wait := func(cw *cacheWarmer, id uint64) warmJob {
+		var job warmJob
+		require.Eventually(t, func() bool {
+			job, err = cw.get(id)
+			require.NoError(t, err)
+			return job.State != "running"
+		}, 10*time.Second, 10*time.Millisecond)
+		return job
+	}
+
+	// The full DAG is fetched into the blockstore.
+	cw, local := newWarmer()
+	job, err := cw.start([]string{"/ipfs/" + root.Cid().String()}, -1, 0)
+	require.NoError(t, err)
+	job = wait(cw, job.ID)
+	require.Equal(t, "done", job.State)
+	require.EqualValues(t, 85, job.Blocks)
+	require.Zero(t, job.Failures)
+	require.False(t, job.Truncated)
+	require.False(t, job.Finished.IsZero())
+	keys, err := local.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var stored int
+	for range keys {
+		stored++
+	}
+	require.Equal(t, 85, stored)
+
+	// The depth limits the levels of links followed.
+	cw, _ = newWarmer()
+	job, err = cw.start([]string{root.Cid().String()}, 1, 0)
+	require.NoError(t, err)
+	job = wait(cw, job.ID)
+	require.EqualValues(t, 5, job.Blocks)
+
+	// The byte limit stops the job early.
+	cw, _ = newWarmer()
+	job, err = cw.start([]string{root.Cid().String()}, -1, 1)
+	require.NoError(t, err)
+	job = wait(cw, job.ID)
+	require.Equal(t, "done", job.State)
+	require.EqualValues(t, 1, job.Blocks)
+	require.True(t, job.Truncated)
+
+	// Blocks that cannot be fetched are counted as failures.
+	cw, _ = newWarmer()
+	missing := blocks.NewBlock([]byte("missing"))
+	job, err = cw.start([]string{missing.Cid().String()}, -1, 0)
+	require.NoError(t, err)
+	job = wait(cw, job.ID)
+	require.Zero(t, job.Blocks)
+	require.EqualValues(t, 1, job.Failures)
+	require.Len(t, job.Errors, 1)
+
+	// Running jobs can be cancelled.
+	local = newBlockstore()
+	cw = newCacheWarmer(ctx, &sync.WaitGroup{}, blockservice.New(local, &blockstoreExchange{bs: src, hold: true}), nil, nil)
+	job, err = cw.start([]string{root.Cid().String()}, -1, 0)
+	require.NoError(t, err)
+	job, err = cw.stop(job.ID)
+	require.NoError(t, err)
+	require.Equal(t, "cancelled", job.State)
+	job = wait(cw, job.ID)
+	require.Equal(t, "cancelled", job.State)
+	require.Zero(t, job.Blocks)
+	_, err = cw.stop(job.ID + 1)
+	require.ErrorIs(t, err, errWarmNotFound)
+
+	// Closing the node stops the running jobs, which are waited for.
+	var wg sync.WaitGroup
+	nodeCtx, closeNode := context.WithCancel(ctx)
+	cw = newCacheWarmer(nodeCtx, &wg, blockservice.New(newBlockstore(), &blockstoreExchange{bs: src, hold: true}), nil, nil)
+	job, err = cw.start([]string{root.Cid().String()}, -1, 0)
+	require.NoError(t, err)
+	closeNode()
+	wg.Wait()
+	job, err = cw.get(job.ID)
+	require.NoError(t, err)
+	require.NotEqual(t, "running", job.State)
+
+	// The handler starts and reports jobs.
+	cw, _ = newWarmer()
+	handler := prefetchHandler(cw)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/mgr/prefetch?path="+root.Cid().String()+"&depth=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+	require.Equal(t, 2, job.Depth)
+	wait(cw, job.ID)
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/mgr/prefetch?id="+strconv.FormatUint(job.ID, 10), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+	require.EqualValues(t, 21, job.Blocks)
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/mgr/prefetch", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Count int
+		Jobs  []warmJob
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	require.Equal(t, 1, list.Count)
+
+	for _, target := range []string{
+		"/mgr/prefetch",
+		"/mgr/prefetch?path=notacid",
+		"/mgr/prefetch?path=" + root.Cid().String() + "&depth=-1",
+		"/mgr/prefetch?path=" + root.Cid().String() + "&bytes=0",
+	} {
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		require.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodDelete, "/mgr/prefetch?id=42", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPut, "/mgr/prefetch", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	prefetchHandler(nil)(rec, httptest.NewRequest(http.MethodGet, "/mgr/prefetch", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/boxo/gateway"
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type DHTProvideStrategy string
+
+const (
+	DHTProvidePopular DHTProvideStrategy = "popular"
+	DHTProvideRecent  DHTProvideStrategy = "recent"
+)
+
+const (
+	// rootProviderInitialDelay leaves time for the DHT to bootstrap and for
+	// requests to be recorded before the first announcements.
+	rootProviderInitialDelay = 5 * time.Minute
+	// rootProviderTrackedFactor bounds the number of roots tracked to this
+	// many times the number of roots provided.
+	rootProviderTrackedFactor = 4
+	// rootProviderWorkers is the number of concurrent DHT announcements.
+	rootProviderWorkers = 8
+)
+
+var rootProviderKey = datastore.NewKey("dht-provide/roots")
+
+var providedRoots = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ipfs",
+	Subsystem: "rainbow",
+	Name:      "dht_provided_roots_total",
+	Help:      "Number of cached roots announced on the DHT, by outcome.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(providedRoots)
+}
+
+// rootStats counts the gateway requests served for a root CID. Counts are
+// halved after every round of announcements.
+type rootStats struct {
+	Requests      float64
+	LastRequested time.Time
+}
+
+// rootProvider records the roots served by the gateway and periodically
+// announces on the DHT the ones selected by the strategy that are still in
+// the blockstore.
+type rootProvider struct {
+	router   routing.ContentRouting
+	bstore   blockstore.Blockstore
+	ds       datastore.Datastore
+	strategy DHTProvideStrategy
+	maxRoots int
+	interval time.Duration
+
+	mu    sync.Mutex
+	roots map[cid.Cid]*rootStats
+}
+
+func newRootProvider(ctx context.Context, cfg Config, router routing.ContentRouting, bstore blockstore.Blockstore, ds datastore.Datastore) (*rootProvider, error) {
+	rp := &rootProvider{
+		router:   router,
+		bstore:   bstore,
+		ds:       ds,
+		strategy: cfg.DHTProvideStrategy,
+		maxRoots: cfg.DHTProvideMaxRoots,
+		interval: cfg.DHTProvideInterval,
+		roots:    make(map[cid.Cid]*rootStats),
+	}
+
+	data, err := ds.Get(ctx, rootProviderKey)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return rp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved map[string]*rootStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		goLog.Warnw("ignoring invalid provided roots", "err", err)
+		return rp, nil
+	}
+	for k, st := range saved {
+		if c, err := cid.Decode(k); err == nil {
+			rp.roots[c] = st
+		}
+	}
+	return rp, nil
+}
+
+// compare orders the roots best first for the strategy.
+func (rp *rootProvider) compare(a, b *rootStats) int {
+	if rp.strategy == DHTProvideRecent {
+		return b.LastRequested.Compare(a.LastRequested)
+	}
+	if c := cmp.Compare(b.Requests, a.Requests); c != 0 {
+		return c
+	}
+	return b.LastRequested.Compare(a.LastRequested)
+}
+
+// rankedLocked returns the tracked roots, best first.
+func (rp *rootProvider) rankedLocked() []cid.Cid {
+	ranked := make([]cid.Cid, 0, len(rp.roots))
+	for c := range rp.roots {
+		ranked = append(ranked, c)
+	}
+	slices.SortFunc(ranked, func(a, b cid.Cid) int {
+		return rp.compare(rp.roots[a], rp.roots[b])
+	})
+	return ranked
+}
+
+// requested records that the gateway served root.
+func (rp *rootProvider) requested(root cid.Cid) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	st, ok := rp.roots[root]
+	if !ok {
+		st = &rootStats{}
+		rp.roots[root] = st
+	}
+	st.Requests++
+	st.LastRequested = time.Now()
+
+	// Forget the lowest ranked half when the table is full.
+	if limit := rp.maxRoots * rootProviderTrackedFactor; len(rp.roots) > limit {
+		for _, c := range rp.rankedLocked()[limit/2:] {
+			delete(rp.roots, c)
+		}
+	}
+}
+
+// selected returns the roots to announce, best first.
+func (rp *rootProvider) selected(ctx context.Context) []cid.Cid {
+	rp.mu.Lock()
+	ranked := rp.rankedLocked()
+	rp.mu.Unlock()
+
+	out := make([]cid.Cid, 0, min(len(ranked), rp.maxRoots))
+	for _, c := range ranked {
+		if len(out) == rp.maxRoots {
+			break
+		}
+		// Roots that were garbage collected cannot be served back.
+		if has, err := rp.bstore.Has(ctx, c); err != nil || !has {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// provide announces the selected roots on the DHT and decays the request
+// counts.
+func (rp *rootProvider) provide(ctx context.Context) {
+	roots := rp.selected(ctx)
+	goLog.Infow("announcing cached roots on the DHT", "roots", len(roots), "strategy", rp.strategy)
+
+	ch := make(chan cid.Cid)
+	var wg sync.WaitGroup
+	for range rootProviderWorkers {
+		wg.Go(func() {
+			for c := range ch {
+				if err := rp.router.Provide(ctx, c, true); err != nil {
+					goLog.Debugw("error providing root", "cid", c, "err", err)
+					providedRoots.WithLabelValues("error").Inc()
+					continue
+				}
+				providedRoots.WithLabelValues("success").Inc()
+			}
+		})
+	}
+feed:
+	for _, c := range roots {
+		select {
+		case ch <- c:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	rp.mu.Lock()
+	for c, st := range rp.roots {
+		st.Requests /= 2
+		if st.Requests < 1 && time.Since(st.LastRequested) > rp.interval {
+			delete(rp.roots, c)
+		}
+	}
+	rp.mu.Unlock()
+}
+
+// save persists the tracked roots.
+func (rp *rootProvider) save(ctx context.Context) error {
+	rp.mu.Lock()
+	saved := make(map[string]*rootStats, len(rp.roots))
+	for c, st := range rp.roots {
+		saved[c.String()] = st
+	}
+	data, err := json.Marshal(saved)
+	rp.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return rp.ds.Put(ctx, rootProviderKey, data)
+}
+
+// start announces the selected roots every interval until ctx is cancelled,
+// when the tracked roots are saved one last time. The goroutine is added to
+// wg.
+func (rp *rootProvider) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		timer := time.NewTimer(rootProviderInitialDelay)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				if err := rp.save(context.Background()); err != nil {
+					goLog.Warnw("error saving provided roots", "err", err)
+				}
+				return
+			case <-timer.C:
+				rp.provide(ctx)
+				if err := rp.save(ctx); err != nil {
+					goLog.Warnw("error saving provided roots", "err", err)
+				}
+				timer.Reset(rp.interval)
+			}
+		}
+	})
+}
+
+// providingBackend records the roots of the content paths served by the
+// gateway.
+type providingBackend struct {
+	gateway.IPFSBackend
+	rp *rootProvider
+}
+
+func (b *providingBackend) served(p path.ImmutablePath, err error) {
+	if err == nil {
+		b.rp.requested(p.RootCid())
+	}
+}
+
+func (b *providingBackend) Get(ctx context.Context, p path.ImmutablePath, ranges ...gateway.ByteRange) (gateway.ContentPathMetadata, *gateway.GetResponse, error) {
+	md, res, err := b.IPFSBackend.Get(ctx, p, ranges...)
+	b.served(p, err)
+	return md, res, err
+}
+
+func (b *providingBackend) GetAll(ctx context.Context, p path.ImmutablePath) (gateway.ContentPathMetadata, files.Node, error) {
+	md, n, err := b.IPFSBackend.GetAll(ctx, p)
+	b.served(p, err)
+	return md, n, err
+}
+
+func (b *providingBackend) GetBlock(ctx context.Context, p path.ImmutablePath) (gateway.ContentPathMetadata, files.File, error) {
+	md, f, err := b.IPFSBackend.GetBlock(ctx, p)
+	b.served(p, err)
+	return md, f, err
+}
+
+func (b *providingBackend) Head(ctx context.Context, p path.ImmutablePath) (gateway.ContentPathMetadata, *gateway.HeadResponse, error) {
+	md, res, err := b.IPFSBackend.Head(ctx, p)
+	b.served(p, err)
+	return md, res, err
+}
+
+func (b *providingBackend) GetCAR(ctx context.Context, p path.ImmutablePath, params gateway.CarParams) (gateway.ContentPathMetadata, io.ReadCloser, error) {
+	md, rc, err := b.IPFSBackend.GetCAR(ctx, p, params)
+	b.served(p, err)
+	return md, rc, err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+type providingRouter struct {
+	countingContentRouter
+
+	mu       sync.Mutex
+	provided []cid.Cid
+}
+
+func (r *providingRouter) Provide(_ context.Context, c cid.Cid, _ bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.provided = append(r.provided, c)
+	return nil
+}
+
+func TestRootProvider(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	bs := blockstore.NewBlockstore(ds)
+
+	var roots []cid.Cid
+	for _, data := range []string{"a", "b", "c", "d"} {
+		blk := blocks.NewBlock([]byte(data))
+		require.NoError(t, bs.Put(ctx, blk))
+		roots = append(roots, blk.Cid())
+	}
+	// Served once, then garbage collected.
+	gone := blocks.NewBlock([]byte("gone")).Cid()
+
+	newProvider := func(strategy DHTProvideStrategy, r *providingRouter) *rootProvider {
+		rp, err := newRootProvider(ctx, Config{
+			DHTProvideStrategy: strategy,
+			DHTProvideMaxRoots: 2,
+			DHTProvideInterval: time.Hour,
+		}, r, bs, ds)
+		require.NoError(t, err)
+		return rp
+	}
+
+	rp := newProvider(DHTProvidePopular, &providingRouter{})
+	for i, c := range roots {
+		for range i + 1 {
+			rp.requested(c)
+		}
+	}
+	rp.requested(gone)
+	for range 10 {
+		rp.requested(gone)
+	}
+
+	// The most requested roots still in the blockstore are announced.
+	require.Equal(t, []cid.Cid{roots[3], roots[2]}, rp.selected(ctx))
+
+	// The most recently requested ones otherwise.
+	rp.requested(roots[0])
+	rp.strategy = DHTProvideRecent
+	require.Equal(t, []cid.Cid{roots[0], roots[3]}, rp.selected(ctx))
+	rp.strategy = DHTProvidePopular
+
+	// No more than maxRoots * rootProviderTrackedFactor roots are tracked.
+	for i := range 2 * rootProviderTrackedFactor {
+		rp.requested(mustTestCid(t, string(rune('e'+i))))
+	}
+	require.LessOrEqual(t, len(rp.roots), 2*rootProviderTrackedFactor)
+	require.Contains(t, rp.roots, roots[3])
+
+	// Tracked roots survive restarts.
+	require.NoError(t, rp.save(ctx))
+	r := &providingRouter{}
+	rp = newProvider(DHTProvidePopular, r)
+	rp.provide(ctx)
+	require.ElementsMatch(t, []cid.Cid{roots[3], roots[2]}, r.provided)
+	require.Equal(t, 2.0, rp.roots[roots[3]].Requests)
+}
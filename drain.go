@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainer coordinates the graceful shutdown of Rainbow. Once the drain starts,
+// the node is no longer ready, and after the grace period the servers stop
+// accepting new requests and the requests in flight get up to timeout to
+// finish before the node is closed.
+type drainer struct {
+	grace   time.Duration
+	timeout time.Duration
+
+	once     sync.Once
+	start    chan struct{}
+	draining atomic.Bool
+
+	// requests counts the requests being served by the tracked handlers.
+	requests sync.WaitGroup
+}
+
+func newDrainer(grace, timeout time.Duration) *drainer {
+	return &drainer{grace: grace, timeout: timeout, start: make(chan struct{})}
+}
+
+// trigger starts the drain. It reports false when it had already started.
+func (d *drainer) trigger() bool {
+	triggered := false
+	d.once.Do(func() {
+		d.draining.Store(true)
+		close(d.start)
+		triggered = true
+	})
+	return triggered
+}
+
+// started is closed when the drain starts.
+func (d *drainer) started() <-chan struct{} {
+	return d.start
+}
+
+// ready reports whether the node accepts new requests.
+func (d *drainer) ready() bool {
+	return !d.draining.Load()
+}
+
+// track counts the requests served by h, so that shutdown waits for their
+// handlers to return, including the ones of the aborted requests.
+func (d *drainer) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.requests.Add(1)
+		defer d.requests.Done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdown waits for the grace period, during which the node is not ready but
+// the servers still accept new requests, so that load balancers stop sending
+// requests before the connections are refused. It then stops the servers,
+// giving the requests in flight up to timeout to finish. Closing abort skips
+// the rest of the wait. It returns once the tracked handlers returned: the
+// ones of the aborted requests see their context cancelled.
+func (d *drainer) shutdown(abort <-chan struct{}, servers ...*http.Server) {
+	grace := time.NewTimer(d.grace)
+	select {
+	case <-grace.C:
+	case <-abort:
+	}
+	grace.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	shutdownServers(ctx, servers...)
+	d.requests.Wait()
+}
+
+// shutdownServers stops the servers from accepting new requests and waits for
+// the requests in flight to finish, until ctx is done, when the remaining
+// connections are closed. Nil servers are ignored.
+func shutdownServers(ctx context.Context, servers ...*http.Server) {
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		wg.Go(func() {
+			err := srv.Shutdown(ctx)
+			if err == nil {
+				return
+			}
+			goLog.Warnw("aborting requests in flight", "addr", srv.Addr, "err", err)
+			_ = srv.Close()
+		})
+	}
+	wg.Wait()
+}
+
+// close stops the node in order: Bitswap first, so that blocks are no longer
+// requested nor served, then the background tasks, which save their state,
+// and the cache warming jobs and prefetch walks, routing, peering, the libp2p
+// hosts and finally the datastores.
+func (nd *Node) close() error {
+	var errs []error
+	if nd.bsrv != nil {
+		errs = append(errs, nd.bsrv.Close())
+	}
+	if nd.cancel != nil {
+		nd.cancel()
+	}
+	nd.background.Wait()
+	for _, r := range nd.routers {
+		errs = append(errs, r.Close())
+	}
+	if nd.peering != nil {
+		nd.peering.ps.Stop()
+	}
+	if nd.dhtHost != nil {
+		errs = append(errs, nd.dhtHost.Close())
+	}
+	if nd.host != nil {
+		errs = append(errs, nd.host.Close())
+	}
+	if nd.datastore != nil {
+		errs = append(errs, nd.datastore.Close())
+	}
+	if nd.metadata != nil {
+		errs = append(errs, nd.metadata.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	pb "github.com/ipfs/boxo/bitswap/message/pb"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownServers(t *testing.T) {
+	t.Parallel()
+
+	// serve starts a server whose requests wait for release, or for their
+	// connection to be closed.
+	serve := func(t *testing.T) (*http.Server, string, chan struct{}, chan struct{}) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		received := make(chan struct{})
+		release := make(chan struct{})
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(received)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		})}
+		go func() { _ = srv.Serve(ln) }()
+		return srv, "http://" + ln.Addr().String(), received, release
+	}
+
+	t.Run("Requests in flight finish", func(t *testing.T) {
+		srv, url, received, release := serve(t)
+		errc := make(chan error, 1)
+		go func() {
+			res, err := http.Get(url)
+			if err == nil {
+				res.Body.Close()
+			}
+			errc <- err
+		}()
+		<-received
+
+		shuttingDown := make(chan struct{})
+		srv.RegisterOnShutdown(func() { close(shuttingDown) })
+		done := make(chan struct{})
+		go func() {
+			shutdownServers(context.Background(), srv, nil)
+			close(done)
+		}()
+
+		// New connections are refused while draining.
+		<-shuttingDown
+		_, err := http.Get(url)
+		require.Error(t, err)
+		select {
+		case <-done:
+			t.Fatal("shutdown did not wait for the request in flight")
+		default:
+		}
+
+		close(release)
+		require.NoError(t, <-errc)
+		<-done
+	})
+
+	t.Run("Requests in flight are aborted after the deadline", func(t *testing.T) {
+		srv, url, received, _ := serve(t)
+		errc := make(chan error, 1)
+		go func() {
+			res, err := http.Get(url)
+			if err == nil {
+				res.Body.Close()
+			}
+			errc <- err
+		}()
+		<-received
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		shutdownServers(ctx, srv)
+		assert.Error(t, <-errc)
+	})
+}
+
+func TestDrainWaitsForHandlers(t *testing.T) {
+	t.Parallel()
+
+	// The handler keeps running for a while after its request is aborted.
+	d := newDrainer(0, 50*time.Millisecond)
+	received := make(chan struct{})
+	var returned atomic.Bool
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: d.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-r.Context().Done()
+		time.Sleep(200 * time.Millisecond)
+		returned.Store(true)
+	}))}
+	go func() { _ = srv.Serve(ln) }()
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-received
+
+	d.shutdown(make(chan struct{}), srv)
+	assert.True(t, returned.Load())
+}
+
+func TestDrainGrace(t *testing.T) {
+	t.Parallel()
+
+	d := newDrainer(time.Hour, time.Minute)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", healthHandler(newReadiness(Config{}, &Node{}, d)))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(ln) }()
+	url := "http://" + ln.Addr().String() + "/readyz"
+
+	abort, done := make(chan struct{}), make(chan struct{})
+	d.trigger()
+	go func() {
+		d.shutdown(abort, srv)
+		close(done)
+	}()
+
+	// During the grace period, the node is not ready but new connections
+	// are still accepted.
+	for range 3 {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := client.Get(url)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for the grace period")
+	default:
+	}
+
+	// Aborting skips the rest of the grace period.
+	close(abort)
+	<-done
+	_, err = http.Get(url)
+	require.Error(t, err)
+}
+
+func TestDrainHandler(t *testing.T) {
+	t.Parallel()
+
+	d := newDrainer(0, time.Minute)
+	ts := httptest.NewServer(http.HandlerFunc(drainHandler(d)))
+	t.Cleanup(ts.Close)
+
+	status := func(t *testing.T, res *http.Response) drainStatus {
+		defer res.Body.Close()
+		var s drainStatus
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&s))
+		return s
+	}
+
+	res, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, drainStatus{Draining: false, Timeout: "1m0s"}, status(t, res))
+	assert.True(t, d.ready())
+
+	res, err = http.Post(ts.URL, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.True(t, status(t, res).Draining)
+	assert.False(t, d.ready())
+	select {
+	case <-d.started():
+	default:
+		t.Fatal("drain did not start")
+	}
+
+	// Draining again is a no-op.
+	res, err = http.Post(ts.URL, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.True(t, status(t, res).Draining)
+	assert.False(t, d.trigger())
+
+	req, err := http.NewRequest(http.MethodDelete, ts.URL, nil)
+	require.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestNodeClose(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		DataDir:            t.TempDir(),
+		Bitswap:            true,
+		ProviderReputation: true,
+	}
+	nd := mustTestNode(t, cfg)
+
+	_, p := mustTestPeer(t)
+	blk := blocks.NewBlock([]byte("drain"))
+	want := bsmsg.New(false)
+	want.AddEntry(blk.Cid(), 1, pb.Message_Wantlist_Block, true)
+	nd.reputation.sent(p, want)
+	res := bsmsg.New(false)
+	res.AddBlock(blk)
+	nd.reputation.received(p, res)
+
+	require.NoError(t, nd.close())
+
+	// The datastores are released, and the state saved on close is found
+	// by the next node.
+	nd = mustTestNode(t, cfg)
+	t.Cleanup(func() { _ = nd.close() })
+	scores := nd.reputation.scores()
+	require.Len(t, scores, 1)
+	assert.Equal(t, p, scores[0].ID)
+}
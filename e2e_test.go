@@ -25,6 +25,8 @@ func TestEndToEndTrustlessGatewayDomains(t *testing.T) {
 	}
 
 	runner := testcmd.NewRunner(t, t.TempDir())
+	// Keep the keys and datastores out of the working directory.
+	runner.Env = append(runner.Env, "RAINBOW_DATADIR="+t.TempDir())
 
 	ctx, cancel := context.WithTimeout(context.Background(), installTimeout)
 	defer cancel()
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-kad-dht/crawler"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// fullRTTableMaxAge is the age after which a saved routing table is
+	// ignored and the network is crawled from scratch.
+	fullRTTableMaxAge = 24 * time.Hour
+	// fullRTWarmStartTimeout bounds the time spent reconnecting to the peers
+	// of a saved routing table at startup.
+	fullRTWarmStartTimeout = 30 * time.Second
+	// fullRTCrawlParallelism matches the default of the fullrt crawler.
+	fullRTCrawlParallelism = 200
+)
+
+var fullRTTableKey = datastore.NewKey("dht/fullrt-routing-table")
+
+// savedRoutingTable is the peer set found by the last crawl of the
+// accelerated DHT client.
+type savedRoutingTable struct {
+	Saved time.Time
+	Peers []peer.AddrInfo
+}
+
+// persistentCrawler saves the peers found by every crawl of the accelerated
+// DHT client. On the first run after a restart, it reconnects to the peers of
+// the saved routing table instead of crawling, so that the client is ready
+// almost immediately, and triggers a full crawl right after.
+type persistentCrawler struct {
+	crawler.Crawler
+	h  host.Host
+	ds datastore.Datastore
+
+	// keep is the filter fullrt applies to the crawled peers.
+	keep func(peer.ID) bool
+	// refresh triggers a new crawl. It is set once the fullrt client, which
+	// starts crawling right away, exists.
+	refresh atomic.Pointer[func(context.Context) error]
+
+	restored bool
+}
+
+// newPersistentCrawler returns a crawler that saves the crawled peers kept by
+// filter, which must be the routing table filter of the fullrt client.
+func newPersistentCrawler(h host.Host, ds datastore.Datastore, prefix protocol.ID, filter dht.RouteTableFilterFunc) (*persistentCrawler, error) {
+	c, err := crawler.NewDefaultCrawler(h,
+		crawler.WithParallelism(fullRTCrawlParallelism),
+		crawler.WithProtocols([]protocol.ID{prefix + "/kad/1.0.0"}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &persistentCrawler{
+		Crawler: c,
+		h:       h,
+		ds:      ds,
+	}
+	pc.keep = func(p peer.ID) bool {
+		return filter(pc, p)
+	}
+	return pc, nil
+}
+
+// Host lets the crawler be used with the DHT routing table filters.
+func (pc *persistentCrawler) Host() host.Host {
+	return pc.h
+}
+
+// Run is called sequentially by the fullrt client.
+func (pc *persistentCrawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo, handleSuccess crawler.HandleQueryResult, handleFail crawler.HandleQueryFail) {
+	if !pc.restored {
+		pc.restored = true
+		if pc.restore(ctx, handleSuccess) {
+			if refresh := pc.refresh.Load(); refresh != nil {
+				// Blocks until this run returns and the crawler loop picks
+				// it up.
+				go func() { _ = (*refresh)(ctx) }()
+			}
+			return
+		}
+	}
+
+	var (
+		mu    sync.Mutex
+		found []peer.AddrInfo
+	)
+	pc.Crawler.Run(ctx, startingPeers, func(p peer.ID, rtPeers []*peer.AddrInfo) {
+		handleSuccess(p, rtPeers)
+		if !pc.keep(p) {
+			return
+		}
+		ai := peer.AddrInfo{ID: p, Addrs: pc.h.Peerstore().Addrs(p)}
+		mu.Lock()
+		found = append(found, ai)
+		mu.Unlock()
+	}, handleFail)
+
+	if ctx.Err() != nil || len(found) == 0 {
+		return
+	}
+	if err := pc.save(ctx, found); err != nil {
+		goLog.Warnw("error saving accelerated DHT routing table", "err", err)
+	}
+}
+
+func (pc *persistentCrawler) save(ctx context.Context, peers []peer.AddrInfo) error {
+	data, err := json.Marshal(savedRoutingTable{Saved: time.Now(), Peers: peers})
+	if err != nil {
+		return err
+	}
+	return pc.ds.Put(ctx, fullRTTableKey, data)
+}
+
+// restore reconnects to the peers of a recent saved routing table, and
+// reports the ones that are still reachable as crawled. It returns false if
+// none could be restored.
+func (pc *persistentCrawler) restore(ctx context.Context, handleSuccess crawler.HandleQueryResult) bool {
+	data, err := pc.ds.Get(ctx, fullRTTableKey)
+	if err != nil {
+		if !errors.Is(err, datastore.ErrNotFound) {
+			goLog.Warnw("error loading accelerated DHT routing table", "err", err)
+		}
+		return false
+	}
+
+	var table savedRoutingTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		goLog.Warnw("ignoring invalid accelerated DHT routing table", "err", err)
+		return false
+	}
+	age := time.Since(table.Saved)
+	if age > fullRTTableMaxAge {
+		goLog.Infow("ignoring stale accelerated DHT routing table", "age", age)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fullRTWarmStartTimeout)
+	defer cancel()
+
+	start := time.Now()
+	peers := make(chan peer.AddrInfo)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		restored int
+	)
+	for range fullRTCrawlParallelism {
+		wg.Go(func() {
+			for ai := range peers {
+				if err := pc.h.Connect(ctx, ai); err != nil || !pc.keep(ai.ID) {
+					continue
+				}
+				handleSuccess(ai.ID, nil)
+				mu.Lock()
+				restored++
+				mu.Unlock()
+			}
+		})
+	}
+feed:
+	for _, ai := range table.Peers {
+		select {
+		case peers <- ai:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(peers)
+	wg.Wait()
+
+	goLog.Infow("restored accelerated DHT routing table", "peers", restored, "saved", len(table.Peers), "age", age, "took", time.Since(start))
+	return restored > 0
+}
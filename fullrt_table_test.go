@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-kad-dht/crawler"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCrawler struct {
+	runs  int
+	peers []peer.ID
+}
+
+func (c *fakeCrawler) Run(_ context.Context, _ []*peer.AddrInfo, handleSuccess crawler.HandleQueryResult, _ crawler.HandleQueryFail) {
+	c.runs++
+	for _, p := range c.peers {
+		handleSuccess(p, nil)
+	}
+}
+
+func TestPersistentCrawler(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	defer h.Close()
+	remote, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer remote.Close()
+
+	newCrawler := func() (*persistentCrawler, *fakeCrawler, *atomic.Int32) {
+		inner := &fakeCrawler{peers: []peer.ID{remote.ID()}}
+		refreshes := new(atomic.Int32)
+		refresh := func(context.Context) error {
+			refreshes.Add(1)
+			return nil
+		}
+		pc := &persistentCrawler{Crawler: inner, h: h, ds: ds, keep: func(peer.ID) bool { return true }}
+		pc.refresh.Store(&refresh)
+		return pc, inner, refreshes
+	}
+	run := func(pc *persistentCrawler) []peer.ID {
+		var found []peer.ID
+		pc.Run(ctx, nil, func(p peer.ID, _ []*peer.AddrInfo) { found = append(found, p) }, nil)
+		return found
+	}
+
+	// Without a saved table, the network is crawled and the result saved.
+	h.Peerstore().AddAddrs(remote.ID(), remote.Addrs(), time.Hour)
+	pc, inner, _ := newCrawler()
+	require.Equal(t, []peer.ID{remote.ID()}, run(pc))
+	require.Equal(t, 1, inner.runs)
+
+	// After a restart, the saved peers are reconnected to instead, and a
+	// full crawl is triggered.
+	h.Peerstore().ClearAddrs(remote.ID())
+	pc, inner, refreshes := newCrawler()
+	require.Equal(t, []peer.ID{remote.ID()}, run(pc))
+	require.Zero(t, inner.runs)
+	require.Eventually(t, func() bool { return refreshes.Load() == 1 }, time.Second, 10*time.Millisecond)
+	require.Len(t, h.Network().ConnsToPeer(remote.ID()), 1)
+
+	// The next runs crawl the network.
+	require.Equal(t, []peer.ID{remote.ID()}, run(pc))
+	require.Equal(t, 1, inner.runs)
+
+	// Stale tables are ignored.
+	data, err := json.Marshal(savedRoutingTable{
+		Saved: time.Now().Add(-2 * fullRTTableMaxAge),
+		Peers: []peer.AddrInfo{{ID: remote.ID(), Addrs: remote.Addrs()}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ds.Put(ctx, fullRTTableKey, data))
+	pc, inner, _ = newCrawler()
+	run(pc)
+	require.Equal(t, 1, inner.runs)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ipfs/boxo/gateway"
+)
+
+// defaultGatewayPaths are the paths served on every gateway hostname, unless
+// configured otherwise.
+var defaultGatewayPaths = []string{"/ipfs", "/ipns", "/version"}
+
+// GatewayDomainsConfig is the content of RAINBOW_GATEWAY_DOMAINS_FILE.
+type GatewayDomainsConfig struct {
+	// PublicGateways maps hostnames, or wildcards like *.example.com, to
+	// their policy.
+	PublicGateways map[string]*GatewayDomain
+}
+
+// GatewayDomain is the policy of a gateway hostname.
+type GatewayDomain struct {
+	// Paths served on the hostname. Defaults to /ipfs, /ipns and /version.
+	Paths []string
+	// UseSubdomains serves content from subdomains of the hostname
+	// (e.g. {cid}.ipfs.example.com) to give every website its own origin.
+	UseSubdomains bool
+	// NoDNSLink disables serving DNSLink websites on the hostname.
+	NoDNSLink bool
+	// InlineDNSLink serves DNSLink names from a single DNS label, so that
+	// they are covered by a wildcard TLS certificate.
+	InlineDNSLink bool
+	// DeserializedResponses enables responses other than raw blocks and
+	// CARs. Defaults to true.
+	DeserializedResponses *bool
+	// HTTPHeaders are added to every response.
+	HTTPHeaders map[string][]string
+	// Response size limits, in bytes, overriding the global ones. Use 0 for
+	// no limit.
+	MaxRangeRequestFileSize     *int64
+	MaxDeserializedResponseSize *int64
+	MaxUnixFSDAGResponseSize    *int64
+}
+
+// loadGatewayDomains reads a JSON gateway domains configuration from path.
+func loadGatewayDomains(path string) (*GatewayDomainsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c GatewayDomainsConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing gateway domains %q: %w", path, err)
+	}
+
+	domains := make(map[string]*GatewayDomain, len(c.PublicGateways))
+	for host, d := range c.PublicGateways {
+		if err := d.validate(host); err != nil {
+			return nil, fmt.Errorf("gateway domains %q: %w", path, err)
+		}
+		domains[strings.ToLower(host)] = d
+	}
+	c.PublicGateways = domains
+	return &c, nil
+}
+
+func (d *GatewayDomain) validate(host string) error {
+	if d == nil {
+		return fmt.Errorf("hostname %q has no policy", host)
+	}
+	if host == "" || strings.ContainsAny(host, "/ \t") {
+		return fmt.Errorf("invalid hostname %q", host)
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return fmt.Errorf("hostname %q: only a leading *. wildcard is supported", host)
+	}
+	if d.UseSubdomains && net.ParseIP(stripHostPort(host)) != nil {
+		return fmt.Errorf("hostname %q: subdomains cannot be used on an IP address", host)
+	}
+	for _, p := range d.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("hostname %q: path %q must start with /", host, p)
+		}
+	}
+	for name := range d.HTTPHeaders {
+		if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+			return fmt.Errorf("hostname %q: invalid header name %q", host, name)
+		}
+	}
+	for _, v := range []*int64{d.MaxRangeRequestFileSize, d.MaxDeserializedResponseSize, d.MaxUnixFSDAGResponseSize} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("hostname %q: response size limits must not be negative", host)
+		}
+	}
+	return nil
+}
+
+// publicGateway returns the gateway specification of the hostname.
+func (d *GatewayDomain) publicGateway() *gateway.PublicGateway {
+	paths := d.Paths
+	if len(paths) == 0 {
+		paths = defaultGatewayPaths
+	}
+	deserialized := d.DeserializedResponses == nil || *d.DeserializedResponses
+	return &gateway.PublicGateway{
+		Paths:                 paths,
+		UseSubdomains:         d.UseSubdomains,
+		NoDNSLink:             d.NoDNSLink,
+		InlineDNSLink:         d.InlineDNSLink,
+		DeserializedResponses: deserialized,
+	}
+}
+
+// hasLimits reports whether the hostname overrides the response size limits.
+func (d *GatewayDomain) hasLimits() bool {
+	return d.MaxRangeRequestFileSize != nil || d.MaxDeserializedResponseSize != nil || d.MaxUnixFSDAGResponseSize != nil
+}
+
+// applyLimits overrides the response size limits of c.
+func (d *GatewayDomain) applyLimits(c *gateway.Config) {
+	if d.MaxRangeRequestFileSize != nil {
+		c.MaxRangeRequestFileSize = *d.MaxRangeRequestFileSize
+	}
+	if d.MaxDeserializedResponseSize != nil {
+		c.MaxDeserializedResponseSize = *d.MaxDeserializedResponseSize
+	}
+	if d.MaxUnixFSDAGResponseSize != nil {
+		c.MaxUnixFSDAGResponseSize = *d.MaxUnixFSDAGResponseSize
+	}
+}
+
+func stripHostPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// gatewayDomains finds the policy of the hostname a request was sent to, to
+// apply the settings that boxo only supports globally: headers and response
+// size limits.
+type gatewayDomains struct {
+	domains map[string]*GatewayDomain
+}
+
+func newGatewayDomains(domains map[string]*GatewayDomain) *gatewayDomains {
+	return &gatewayDomains{domains: domains}
+}
+
+// match returns the hostname configured for the request host, and its
+// policy. Subdomains match the hostnames using subdomains, and direct
+// subdomains match wildcards.
+func (gd *gatewayDomains) match(host string) (string, *GatewayDomain) {
+	host = strings.ToLower(stripHostPort(host))
+	if d, ok := gd.domains[host]; ok {
+		return host, d
+	}
+	for h, first := host, true; ; first = false {
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			return "", nil
+		}
+		h = h[i+1:]
+		if first {
+			if d, ok := gd.domains["*."+h]; ok {
+				return "*." + h, d
+			}
+		}
+		if d, ok := gd.domains[h]; ok && d.UseSubdomains {
+			return h, d
+		}
+	}
+}
+
+// withHeaders adds the headers of the hostname to the responses.
+func (gd *gatewayDomains) withHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, d := gd.match(r.Host); d != nil {
+			for name, values := range d.HTTPHeaders {
+				// The next handlers may add values: do not share the slice.
+				w.Header()[http.CanonicalHeaderKey(name)] = slices.Clone(values)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sizeLimits are the response size limits of a gateway handler.
+type sizeLimits struct {
+	maxRangeRequestFileSize     int64
+	maxDeserializedResponseSize int64
+	maxUnixFSDAGResponseSize    int64
+}
+
+func configSizeLimits(c gateway.Config) sizeLimits {
+	return sizeLimits{
+		maxRangeRequestFileSize:     c.MaxRangeRequestFileSize,
+		maxDeserializedResponseSize: c.MaxDeserializedResponseSize,
+		maxUnixFSDAGResponseSize:    c.MaxUnixFSDAGResponseSize,
+	}
+}
+
+// withLimits serves the requests to the hostnames with their own response
+// size limits with a gateway handler returned by newHandler for these limits.
+// Hostnames with the same limits share a handler, and next, built with the
+// limits of c, serves the other requests.
+func (gd *gatewayDomains) withLimits(next http.Handler, c gateway.Config, newHandler func(c gateway.Config) http.Handler) http.Handler {
+	handlers := map[sizeLimits]http.Handler{configSizeLimits(c): next}
+	hosts := make(map[string]http.Handler)
+	for host, d := range gd.domains {
+		if !d.hasLimits() {
+			continue
+		}
+		conf := c
+		d.applyLimits(&conf)
+		limits := configSizeLimits(conf)
+		h, ok := handlers[limits]
+		if !ok {
+			h = newHandler(conf)
+			handlers[limits] = h
+		}
+		hosts[host] = h
+	}
+	if len(handlers) == 1 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _ := gd.match(r.Host); host != "" {
+			if h, ok := hosts[host]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/boxo/gateway"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadGatewayDomains(t *testing.T) {
+	t.Parallel()
+
+	write := func(t *testing.T, content string) string {
+		p := filepath.Join(t.TempDir(), "domains.json")
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+		return p
+	}
+
+	t.Run("Valid file", func(t *testing.T) {
+		c, err := loadGatewayDomains(write(t, `{"PublicGateways": {
+			"Example.com": {"UseSubdomains": true, "DeserializedResponses": false, "MaxDeserializedResponseSize": 1024},
+			"*.example.net": {"Paths": ["/ipfs"], "HTTPHeaders": {"X-Test": ["1"]}}
+		}}`))
+		require.NoError(t, err)
+		require.Len(t, c.PublicGateways, 2)
+
+		gw := c.PublicGateways["example.com"].publicGateway()
+		assert.True(t, gw.UseSubdomains)
+		assert.False(t, gw.DeserializedResponses)
+		assert.Equal(t, defaultGatewayPaths, gw.Paths)
+		assert.True(t, c.PublicGateways["example.com"].hasLimits())
+
+		gw = c.PublicGateways["*.example.net"].publicGateway()
+		assert.True(t, gw.DeserializedResponses)
+		assert.Equal(t, []string{"/ipfs"}, gw.Paths)
+		assert.False(t, c.PublicGateways["*.example.net"].hasLimits())
+	})
+
+	for name, content := range map[string]string{
+		"Invalid JSON":         `{`,
+		"Missing policy":       `{"PublicGateways": {"example.com": null}}`,
+		"Hostname with path":   `{"PublicGateways": {"example.com/ipfs": {}}}`,
+		"Inner wildcard":       `{"PublicGateways": {"ipfs.*.com": {}}}`,
+		"Subdomains on an IP":  `{"PublicGateways": {"127.0.0.1": {"UseSubdomains": true}}}`,
+		"Relative path":        `{"PublicGateways": {"example.com": {"Paths": ["ipfs"]}}}`,
+		"Invalid header":       `{"PublicGateways": {"example.com": {"HTTPHeaders": {"X Test": ["1"]}}}}`,
+		"Negative size limit":  `{"PublicGateways": {"example.com": {"MaxRangeRequestFileSize": -1}}}`,
+		"Wrong field type":     `{"PublicGateways": {"example.com": {"UseSubdomains": "yes"}}}`,
+		"PublicGateways array": `{"PublicGateways": []}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadGatewayDomains(write(t, content))
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := loadGatewayDomains(filepath.Join(t.TempDir(), "missing.json"))
+		assert.Error(t, err)
+	})
+}
+
+func TestGatewayDomainsMatch(t *testing.T) {
+	t.Parallel()
+
+	gd := newGatewayDomains(map[string]*GatewayDomain{
+		"example.com":   {},
+		"dweb.link":     {UseSubdomains: true},
+		"*.example.net": {},
+	})
+
+	for host, want := range map[string]string{
+		"example.com":             "example.com",
+		"EXAMPLE.com:8080":        "example.com",
+		"sub.example.com":         "",
+		"dweb.link":               "dweb.link",
+		"bafkqaaa.ipfs.dweb.link": "dweb.link",
+		"en-wikipedia--on--ipfs-org.ipns.dweb.link:443": "dweb.link",
+		"a.example.net":   "*.example.net",
+		"a.b.example.net": "",
+		"example.net":     "",
+		"localhost":       "",
+	} {
+		got, _ := gd.match(host)
+		assert.Equal(t, want, got, host)
+	}
+}
+
+func TestGatewayDomainPolicies(t *testing.T) {
+	t.Parallel()
+
+	limit := int64(5)
+	ts, gnd := mustTestServer(t, Config{
+		Bitswap:        true,
+		GatewayDomains: []string{"flag.com", "small.com"},
+		GatewayDomainPolicies: map[string]*GatewayDomain{
+			"small.com":   {MaxDeserializedResponseSize: &limit},
+			"headers.com": {HTTPHeaders: map[string][]string{"X-Test": {"hello"}, "Access-Control-Allow-Origin": {"https://example.org"}}},
+		},
+		disableMetrics: true,
+	})
+
+	content := "hello world"
+	cid := mustAddFile(t, gnd, []byte(content))
+	url := ts.URL + "/ipfs/" + cid.String()
+
+	get := func(t *testing.T, host string, query ...string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, url+strings.Join(query, ""), nil)
+		require.NoError(t, err)
+		req.Host = host
+
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("Hostname without policy from the file", func(t *testing.T) {
+		res := get(t, "flag.com")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Empty(t, res.Header.Get("X-Test"))
+		assert.Equal(t, "*", res.Header.Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("Response size limit", func(t *testing.T) {
+		res := get(t, "small.com")
+		assert.Equal(t, http.StatusGone, res.StatusCode)
+
+		// The limit only applies to deserialized responses.
+		res = get(t, "small.com", "?format=raw")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("Custom headers", func(t *testing.T) {
+		res := get(t, "headers.com")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello", res.Header.Get("X-Test"))
+		assert.Equal(t, "https://example.org", res.Header.Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestGatewayDomainsHandlers(t *testing.T) {
+	t.Parallel()
+
+	policy := &GatewayDomain{HTTPHeaders: map[string][]string{"X-Test": {"hello"}}}
+	gd := newGatewayDomains(map[string]*GatewayDomain{"headers.com": policy, "small.com": {}})
+
+	t.Run("Hostnames with the same limits share a handler", func(t *testing.T) {
+		low, global, high := int64(1), int64(5), int64(10)
+		gd := newGatewayDomains(map[string]*GatewayDomain{
+			"low.com":    {MaxDeserializedResponseSize: &low},
+			"low.net":    {MaxDeserializedResponseSize: &low},
+			"high.com":   {MaxRangeRequestFileSize: &high},
+			"global.com": {MaxRangeRequestFileSize: &global},
+			"flag.com":   {},
+		})
+		var limits []int64
+		newHandler := func(c gateway.Config) http.Handler {
+			limits = append(limits, c.MaxDeserializedResponseSize, c.MaxRangeRequestFileSize)
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, c.MaxDeserializedResponseSize, c.MaxRangeRequestFileSize)
+			})
+		}
+		c := gateway.Config{MaxRangeRequestFileSize: 5, MaxDeserializedResponseSize: 5}
+		h := gd.withLimits(newHandler(c), c, newHandler)
+		assert.Len(t, limits, 6)
+
+		for host, want := range map[string]string{
+			"low.com":    "1 5",
+			"low.net":    "1 5",
+			"high.com":   "5 10",
+			"global.com": "5 5",
+			"flag.com":   "5 5",
+			"other.com":  "5 5",
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/ipfs/bafkqaaa", nil))
+			assert.Equal(t, want, rec.Body.String(), host)
+		}
+	})
+
+	t.Run("Headers are not shared with the configuration", func(t *testing.T) {
+		h := gd.withHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Test", "world")
+		}))
+		req := httptest.NewRequest(http.MethodGet, "http://headers.com/ipfs/bafkqaaa", nil)
+		for range 2 {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, []string{"hello", "world"}, rec.Header().Values("X-Test"))
+		}
+		assert.Equal(t, []string{"hello"}, policy.HTTPHeaders["X-Test"])
+	})
+}
@@ -19,6 +19,10 @@ func (nd *Node) GC(ctx context.Context, todelete int64) error {
 	if err != nil {
 		return err
 	}
+	if nd.prefetcher != nil {
+		// Deleted blocks must be prefetched again.
+		defer nd.prefetcher.forget()
+	}
 
 deleteBlocks:
 	for todelete > 0 {
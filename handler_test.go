@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/ipfs/go-metrics-interface"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -190,3 +193,87 @@ func TestNoBlockcacheHeader(t *testing.T) {
 		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
 	})
 }
+
+func TestFindProvidersTrace(t *testing.T) {
+	t.Parallel()
+
+	_, pid1 := mustTestPeer(t)
+	_, pid2 := mustTestPeer(t)
+	rhs := newRoutersHealth(Config{})
+
+	router := setupCompositeRouting([]routing.Routing{
+		rhs.wrap("https://one.example", &providersRouter{providers: []peer.AddrInfo{{ID: pid1}}}, true),
+		rhs.wrap("https://two.example", &providersRouter{providers: []peer.AddrInfo{{ID: pid1}, {ID: pid2}}}, true),
+	}, nil, Config{})
+
+	c := mustTestCid(t, "findprovs")
+	req := httptest.NewRequest(http.MethodGet, "/mgr/routing/findprovs?cid="+c.String(), nil)
+	rec := httptest.NewRecorder()
+	findProvidersHandler(router)(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var events []routingTraceEvent
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var ev routingTraceEvent
+		require.NoError(t, dec.Decode(&ev))
+		events = append(events, ev)
+	}
+
+	// One line per router result, then a summary.
+	require.Len(t, events, 4)
+	byRouter := make(map[string]int)
+	for _, ev := range events[:3] {
+		byRouter[ev.Router]++
+		require.NotEmpty(t, ev.Elapsed)
+	}
+	require.Equal(t, map[string]int{"https://one.example": 1, "https://two.example": 2}, byRouter)
+
+	last := events[3]
+	require.True(t, last.Done)
+	require.Equal(t, 2, last.Providers)
+	require.Empty(t, last.Error)
+
+	// Bad input and missing routing.
+	rec = httptest.NewRecorder()
+	findProvidersHandler(router)(rec, httptest.NewRequest(http.MethodGet, "/mgr/routing/findprovs?cid=foo", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	findPeerHandler(nil)(rec, httptest.NewRequest(http.MethodGet, "/mgr/routing/findpeer?peer="+pid1.String(), nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRequestLimiter(t *testing.T) {
+	t.Parallel()
+
+	limiter := newRequestLimiter()
+	limiter.setLimit(1)
+	started, release := make(chan struct{}), make(chan struct{})
+	previous := limiter.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	current := limiter.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		previous.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ipfs/bafkqaaa", nil))
+	}()
+	<-started
+
+	// The requests served by the handler built before a reload count.
+	rec := httptest.NewRecorder()
+	current.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipfs/bafkqaaa", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+
+	limiter.setLimit(2)
+	rec = httptest.NewRecorder()
+	current.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipfs/bafkqaaa", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	close(release)
+	<-done
+}
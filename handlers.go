@@ -3,19 +3,28 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	nopfs "github.com/ipfs-shipyard/nopfs"
+	nopfsipfs "github.com/ipfs-shipyard/nopfs/ipfs"
 	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
 	leveldb "github.com/ipfs/go-ds-leveldb"
 	"github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	ma "github.com/multiformats/go-multiaddr"
 
 	_ "embed"
 	_ "net/http/pprof"
@@ -208,6 +217,816 @@ func showPeersHandler(p2pHost host.Host) func(w http.ResponseWriter, r *http.Req
 	}
 }
 
+// peeringHandler lists (GET), adds (POST) or removes (DELETE) peered peers.
+// POST takes one or more 'addr' parameters with /p2p multiaddrs, or a 'peer'
+// parameter whose addresses are looked up. DELETE takes a 'peer' parameter.
+func peeringHandler(pm *peeringManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if pm == nil {
+			http.Error(w, "peering is not available", http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		var body any
+		switch r.Method {
+		case http.MethodGet:
+			peers := pm.list()
+			body = struct {
+				Count int
+				Peers []peeredPeer
+			}{len(peers), peers}
+		case http.MethodPost:
+			var (
+				ais []peer.AddrInfo
+				err error
+			)
+			if addrs := q["addr"]; len(addrs) > 0 {
+				mas := make([]ma.Multiaddr, 0, len(addrs))
+				for _, a := range addrs {
+					m, err := ma.NewMultiaddr(a)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					mas = append(mas, m)
+				}
+				ais, err = peer.AddrInfosFromP2pAddrs(mas...)
+			} else {
+				var pid peer.ID
+				pid, err = peer.Decode(q.Get("peer"))
+				ais = []peer.AddrInfo{{ID: pid}}
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			for _, ai := range ais {
+				if err := pm.add(r.Context(), ai); err != nil {
+					switch {
+					case errors.Is(err, errPeeringConfigured):
+						http.Error(w, err.Error(), http.StatusConflict)
+					case errors.Is(err, errPeeringSelf):
+						http.Error(w, err.Error(), http.StatusBadRequest)
+					default:
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+					}
+					return
+				}
+				goLog.Infow("Added peering", "peer", ai.ID, "addrs", ai.Addrs)
+			}
+			body = struct {
+				Added int
+			}{len(ais)}
+		case http.MethodDelete:
+			pid, err := peer.Decode(q.Get("peer"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := pm.remove(r.Context(), pid); err != nil {
+				switch {
+				case errors.Is(err, errPeeringConfigured):
+					http.Error(w, err.Error(), http.StatusConflict)
+				case errors.Is(err, errPeeringNotFound):
+					http.Error(w, err.Error(), http.StatusNotFound)
+				default:
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			goLog.Infow("Removed peering", "peer", pid)
+			body = struct {
+				Removed int
+			}{1}
+		default:
+			http.Error(w, "only GET, POST and DELETE allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// httpRetrievalHandler lists the HTTP providers contacted, with the
+// allowlist and the denylist (GET), and adds (POST) or removes (DELETE) the
+// hosts given with the 'allow' and 'deny' parameters.
+func httpRetrievalHandler(hr *httpRetrieval) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if hr == nil {
+			http.Error(w, "http retrieval is not enabled", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodDelete:
+			q := r.URL.Query()
+			allow, deny := q["allow"], q["deny"]
+			if len(allow)+len(deny) == 0 {
+				http.Error(w, "missing 'allow' or 'deny' parameter", http.StatusBadRequest)
+				return
+			}
+			remove := r.Method == http.MethodDelete
+			if err := hr.update(allow, deny, remove); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			goLog.Infow("Updated HTTP retrieval lists", "allow", allow, "deny", deny, "removed", remove)
+		default:
+			http.Error(w, "only GET, POST and DELETE allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		allowlist, denylist := hr.lists()
+		providers := hr.stats()
+		body := struct {
+			Allowlist []string
+			Denylist  []string
+			Count     int
+			Providers []httpProvider
+		}{allowlist, denylist, len(providers), providers}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// prefetchHandler lists (GET), starts (POST) or cancels (DELETE) cache warming
+// jobs. POST takes one or more 'path' parameters (CIDs, /ipfs/ or /ipns/
+// paths), and optional 'depth' and 'bytes' limits. GET and DELETE take an 'id'
+// parameter to act on a single job.
+func prefetchHandler(cw *cacheWarmer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if cw == nil {
+			http.Error(w, "cache warming is not available", http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		var (
+			id  uint64
+			err error
+		)
+		if s := q.Get("id"); s != "" {
+			id, err = strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var body any
+		switch r.Method {
+		case http.MethodGet:
+			if id != 0 {
+				job, err := cw.get(id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				body = job
+				break
+			}
+			jobs := cw.list()
+			body = struct {
+				Count int
+				Jobs  []warmJob
+			}{len(jobs), jobs}
+		case http.MethodPost:
+			paths := q["path"]
+			if len(paths) == 0 {
+				http.Error(w, "missing 'path' parameter", http.StatusBadRequest)
+				return
+			}
+			for _, p := range paths {
+				if _, err := parseWarmPath(p); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			depth := -1
+			if s := q.Get("depth"); s != "" {
+				depth, err = strconv.Atoi(s)
+				if err == nil && depth < 0 {
+					err = errors.New("depth must not be negative")
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			var maxBytes int64
+			if s := q.Get("bytes"); s != "" {
+				maxBytes, err = strconv.ParseInt(s, 10, 64)
+				if err == nil && maxBytes <= 0 {
+					err = errors.New("bytes must be positive")
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			job, err := cw.start(paths, depth, maxBytes)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			goLog.Infow("Started cache warming", "id", job.ID, "paths", paths, "depth", depth, "bytes", maxBytes)
+			body = job
+		case http.MethodDelete:
+			job, err := cw.stop(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			goLog.Infow("Cancelled cache warming", "id", job.ID)
+			body = job
+		default:
+			http.Error(w, "only GET, POST and DELETE allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// routingCacheHandler inspects (GET) or flushes (DELETE) the provider record
+// cache. Both accept an optional 'cid' parameter to act on a single entry.
+// DELETE also accepts 'expired=true' to only drop expired records.
+func routingCacheHandler(pc *providerCache) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if pc == nil {
+			http.Error(w, "routing cache is disabled", http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		var (
+			c   cid.Cid
+			err error
+		)
+		if cidStr := q.Get("cid"); cidStr != "" {
+			c, err = cid.Decode(cidStr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var body any
+		switch r.Method {
+		case http.MethodGet:
+			if c.Defined() {
+				providers, expires, ok, err := pc.Lookup(r.Context(), c)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if !ok {
+					http.Error(w, "not in cache", http.StatusNotFound)
+					return
+				}
+				body = struct {
+					CID       string
+					Expires   time.Time
+					Providers []peer.AddrInfo
+				}{c.String(), expires, providers}
+				break
+			}
+
+			entries, err := pc.Len(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			body = struct {
+				Entries int
+				TTL     string
+			}{entries, pc.ttl.String()}
+		case http.MethodDelete:
+			removed := 1
+			if c.Defined() {
+				err = pc.Remove(r.Context(), c)
+			} else {
+				removed, err = pc.Flush(r.Context(), q.Get("expired") == "true")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			goLog.Infow("Flushed routing cache", "removed", removed)
+			body = struct {
+				Removed int
+			}{removed}
+		default:
+			http.Error(w, "only GET and DELETE allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// providerReputationHandler lists (GET) or resets (DELETE) the provider
+// reputation scores. Both accept an optional 'peer' parameter to act on a
+// single provider.
+func providerReputationHandler(rep *providerReputation) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if rep == nil {
+			http.Error(w, "provider reputation is disabled", http.StatusNotFound)
+			return
+		}
+
+		var (
+			pid peer.ID
+			err error
+		)
+		if s := r.URL.Query().Get("peer"); s != "" {
+			pid, err = peer.Decode(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var body any
+		switch r.Method {
+		case http.MethodGet:
+			scores := rep.scores()
+			if pid != "" {
+				i := slices.IndexFunc(scores, func(s providerScore) bool { return s.ID == pid })
+				if i < 0 {
+					http.Error(w, "unknown provider", http.StatusNotFound)
+					return
+				}
+				body = scores[i]
+				break
+			}
+			body = struct {
+				MinScore  float64
+				Providers []providerScore
+			}{rep.minScore, scores}
+		case http.MethodDelete:
+			removed := rep.reset(pid)
+			goLog.Infow("Reset provider reputation", "removed", removed)
+			body = struct {
+				Removed int
+			}{removed}
+		default:
+			http.Error(w, "only GET and DELETE allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// bitswapWantlistHandler lists the wants of the Bitswap client, with their
+// age, the sessions waiting for them, the peers asked and the peers that
+// answered DONT_HAVE.
+func bitswapWantlistHandler(bi *bitswapInspector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if bi == nil {
+			http.Error(w, "bitswap inspection is disabled", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		wants := bi.wantlist()
+		body := struct {
+			Count int
+			Wants []bitswapWant
+		}{len(wants), wants}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// bitswapStatsHandler returns the stats of the Bitswap client and server, and
+// of the peers we recently exchanged messages with, including their ledger
+// when the server is enabled.
+func bitswapStatsHandler(bi *bitswapInspector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if bi == nil {
+			http.Error(w, "bitswap inspection is disabled", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := bi.stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// bitswapTuningHandler returns the Bitswap session delays and the provider
+// query limits. A POST with the 'bitswap-provider-search-delay',
+// 'bitswap-rebroadcast-delay', 'routing-max-requests', 'routing-max-providers'
+// and 'routing-max-timeout' parameters checks them and reports the ones that
+// differ as requiring a restart.
+func bitswapTuningHandler(t *bitswapTuning) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if t == nil {
+			http.Error(w, "bitswap is disabled", http.StatusNotFound)
+			return
+		}
+
+		res := bitswapTuningResult{bitswapTunables: t.get(), RestartRequired: []string{}}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var u bitswapTuningUpdate
+			for k, v := range r.URL.Query() {
+				var err error
+				switch k {
+				case "bitswap-provider-search-delay":
+					var d time.Duration
+					d, err = time.ParseDuration(v[0])
+					u.providerSearchDelay = &d
+				case "bitswap-rebroadcast-delay":
+					var d time.Duration
+					d, err = time.ParseDuration(v[0])
+					u.rebroadcastDelay = &d
+				case "routing-max-requests":
+					var n int
+					n, err = strconv.Atoi(v[0])
+					u.maxRequests = &n
+				case "routing-max-providers":
+					var n int
+					n, err = strconv.Atoi(v[0])
+					u.maxProviders = &n
+				case "routing-max-timeout":
+					var d time.Duration
+					d, err = time.ParseDuration(v[0])
+					u.maxTimeout = &d
+				default:
+					err = errors.New("unknown setting")
+				}
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%s: %s", k, err), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := t.check(u); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if changed := t.changed(u); len(changed) > 0 {
+				res.RestartRequired = changed
+			}
+		default:
+			http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// reloadHandler reloads the settings that can change at runtime, like SIGHUP,
+// and lists the ones that changed.
+func reloadHandler(rl *reloader) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		res, err := rl.reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		goLog.Infow("Reloaded configuration", "applied", res.Applied, "restartRequired", res.RestartRequired)
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// drainStatus is returned by /mgr/drain.
+type drainStatus struct {
+	Draining bool
+	Timeout  string
+}
+
+// drainHandler starts the graceful shutdown of Rainbow on POST, for rolling
+// deploys, and returns whether it started.
+func drainHandler(d *drainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		status := http.StatusOK
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if d.trigger() {
+				goLog.Info("Drain requested")
+			}
+			status = http.StatusAccepted
+		default:
+			http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(drainStatus{
+			Draining: !d.ready(),
+			Timeout:  d.timeout.String(),
+		})
+		if err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// healthHandler runs the checks and returns their results, with a 503 status
+// when any of them failed.
+func healthHandler(hc *healthChecks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "only GET and HEAD allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		res := hc.run(r.Context())
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if !res.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+		}
+	}
+}
+
+// healthStatusHandler runs the checks and only returns their overall status,
+// for listeners reachable by anyone: the results of the checks name the
+// routers and remote backends of the node.
+func healthStatusHandler(hc *healthChecks) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "only GET and HEAD allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := http.StatusOK
+		if !hc.run(r.Context()).OK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, http.StatusText(status))
+	}
+}
+
+// routersStatusHandler lists the health of every router used by the node.
+func routersStatusHandler(rhs *routersHealth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		body := struct {
+			Routers []routerStatus
+		}{
+			Routers: rhs.status(),
+		}
+
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(body); err != nil {
+			goLog.Errorw("cannot write response", "err", err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+	}
+}
+
+// routingTraceEvent is a line of the /mgr/routing/findprovs and
+// /mgr/routing/findpeer responses: either a result from an individual router,
+// or the final line summarizing the lookup.
+type routingTraceEvent struct {
+	Router  string   `json:",omitempty"`
+	ID      peer.ID  `json:",omitempty"`
+	Addrs   []string `json:",omitempty"`
+	Elapsed string
+
+	Done      bool   `json:",omitempty"`
+	Providers int    `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// routingTraceWriter streams routingTraceEvents as newline-delimited JSON.
+// Events reported by routers after the lookup is over are dropped.
+type routingTraceWriter struct {
+	mu    sync.Mutex
+	w     http.ResponseWriter
+	enc   *json.Encoder
+	start time.Time
+	done  bool
+}
+
+func newRoutingTraceWriter(w http.ResponseWriter) *routingTraceWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return &routingTraceWriter{w: w, enc: json.NewEncoder(w), start: time.Now()}
+}
+
+func (tw *routingTraceWriter) found(router string, ai peer.AddrInfo) {
+	addrs := make([]string, 0, len(ai.Addrs))
+	for _, a := range ai.Addrs {
+		addrs = append(addrs, a.String())
+	}
+	tw.write(routingTraceEvent{Router: router, ID: ai.ID, Addrs: addrs}, false)
+}
+
+func (tw *routingTraceWriter) write(ev routingTraceEvent, last bool) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.done {
+		return
+	}
+	tw.done = last
+
+	ev.Elapsed = time.Since(tw.start).String()
+	if err := tw.enc.Encode(ev); err != nil {
+		goLog.Errorw("cannot write response", "err", err)
+		return
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// routingTraceContext returns the request context limited by the "timeout"
+// query parameter (default 1m).
+func routingTraceContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := time.Minute
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		var err error
+		timeout, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// findProvidersHandler looks up the providers of the 'cid' parameter, up to
+// 'count' of them (default 20, 0 for no limit), and streams the providers
+// found by every router, followed by the number of distinct providers.
+func findProvidersHandler(cr routing.ContentRouting) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if cr == nil {
+			http.Error(w, "content routing is not available", http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		c, err := cid.Decode(q.Get("cid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		count := 20
+		if s := q.Get("count"); s != "" {
+			count, err = strconv.Atoi(s)
+			if err != nil || count < 0 {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx, cancel, err := routingTraceContext(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer cancel()
+
+		tw := newRoutingTraceWriter(w)
+		ctx = withRoutingTrace(ctx, tw.found)
+
+		providers := make(map[peer.ID]struct{})
+		for ai := range cr.FindProvidersAsync(ctx, c, count) {
+			providers[ai.ID] = struct{}{}
+		}
+
+		ev := routingTraceEvent{Done: true, Providers: len(providers)}
+		if err := ctx.Err(); err != nil {
+			ev.Error = err.Error()
+		}
+		tw.write(ev, true)
+	}
+}
+
+// findPeerHandler looks up the addresses of the 'peer' parameter, and streams
+// the addresses found by every router, followed by the result of the lookup.
+func findPeerHandler(pr routing.PeerRouting) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if pr == nil {
+			http.Error(w, "peer routing is not available", http.StatusNotFound)
+			return
+		}
+
+		pid, err := peer.Decode(r.URL.Query().Get("peer"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel, err := routingTraceContext(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer cancel()
+
+		tw := newRoutingTraceWriter(w)
+		ctx = withRoutingTrace(ctx, tw.found)
+
+		ev := routingTraceEvent{Done: true}
+		ai, err := pr.FindPeer(ctx, pid)
+		if err != nil {
+			ev.Error = err.Error()
+		} else {
+			ev.ID = ai.ID
+			for _, a := range ai.Addrs {
+				ev.Addrs = append(ev.Addrs, a.String())
+			}
+		}
+		tw.write(ev, true)
+	}
+}
+
 func withConnect(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// ServeMux does not support requests with CONNECT method,
@@ -229,16 +1048,91 @@ func withRequestLogger(next http.Handler) http.Handler {
 	})
 }
 
+// requestRetryAfter is the Retry-After of the responses to the requests over
+// the limit of concurrent requests, in seconds.
+const requestRetryAfter = 60
+
+// requestLimiter answers 429 Too Many Requests once the limit of concurrent
+// gateway requests is reached, or does nothing when it is 0. The gateway
+// handlers built on reload share it, so the requests still served by the
+// previous handler count towards the limit of the new one.
+type requestLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+}
+
+func newRequestLimiter() *requestLimiter {
+	return &requestLimiter{}
+}
+
+func (l *requestLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
+func (l *requestLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > 0 && l.running >= l.limit {
+		return false
+	}
+	l.running++
+	return true
+}
+
+func (l *requestLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+}
+
+func (l *requestLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire() {
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Retry-After", strconv.Itoa(requestRetryAfter))
+			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		defer l.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
 func setupGatewayHandler(cfg Config, nd *Node) (http.Handler, error) {
+	backend, err := setupGatewayBackend(cfg, nd, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newGatewayHandler(cfg, backend, newRequestLimiter()), nil
+}
+
+// setupGatewayBackend returns the backend of the gateway. Content blocked by
+// the denylists of blocker, when set, is blocked on top of the denylists
+// loaded at startup.
+func setupGatewayBackend(cfg Config, nd *Node, blocker *nopfs.Blocker) (gateway.IPFSBackend, error) {
 	var (
 		backend gateway.IPFSBackend
 		err     error
 	)
 
+	bsrv, ns, r := nd.bsrv, nd.ns, nd.resolver
+	if blocker != nil {
+		bsrv = nopfsipfs.WrapBlockService(bsrv, blocker)
+		if ns != nil {
+			ns = nopfsipfs.WrapNameSystem(ns, blocker)
+		}
+		if r != nil {
+			r = nopfsipfs.WrapResolver(r, blocker)
+		}
+	}
+
 	options := []gateway.BackendOption{
 		gateway.WithValueStore(nd.vs),
-		gateway.WithNameSystem(nd.ns),
-		gateway.WithResolver(nd.resolver), // May be nil, but that is fine.
+		gateway.WithNameSystem(ns),
+		gateway.WithResolver(r), // May be nil, but that is fine.
 	}
 
 	if len(cfg.RemoteBackends) > 0 && cfg.RemoteBackendMode == RemoteBackendCAR {
@@ -249,11 +1143,21 @@ func setupGatewayHandler(cfg Config, nd *Node) (http.Handler, error) {
 		}
 		backend, err = gateway.NewCarBackend(fetcher, options...)
 	} else {
-		backend, err = gateway.NewBlocksBackend(nd.bsrv, options...)
+		backend, err = gateway.NewBlocksBackend(bsrv, options...)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if nd.rootProvider != nil {
+		backend = &providingBackend{IPFSBackend: backend, rp: nd.rootProvider}
+	}
+	return backend, nil
+}
+
+// newGatewayHandler returns the gateway handler for the domains and limits of
+// cfg. It is called again with the same backend and limiter when they are
+// reloaded, and sets the limit of concurrent requests of limiter.
+func newGatewayHandler(cfg Config, backend gateway.IPFSBackend, limiter *requestLimiter) http.Handler {
 
 	headers := map[string][]string{}
 
@@ -282,79 +1186,72 @@ func setupGatewayHandler(cfg Config, nd *Node) (http.Handler, error) {
 		return false
 	}
 
-	// TODO: allow appending hostnames to this list via ENV variable (separate PATH_GATEWAY_HOSTS & SUBDOMAIN_GATEWAY_HOSTS)
-	publicGateways := map[string]*gateway.PublicGateway{
+	domains := map[string]*GatewayDomain{
 		"localhost": {
-			Paths:                 []string{"/ipfs", "/ipns", "/version"},
-			NoDNSLink:             len(cfg.DNSLinkGatewayDomains) > 0,
-			InlineDNSLink:         false,
-			DeserializedResponses: true,
-			UseSubdomains:         true,
+			NoDNSLink:     len(cfg.DNSLinkGatewayDomains) > 0,
+			UseSubdomains: true,
 		},
 	}
 	for _, domain := range cfg.GatewayDomains {
-		publicGateways[domain] = &gateway.PublicGateway{
-			Paths:                 []string{"/ipfs", "/ipns", "/version"},
-			NoDNSLink:             !isDNSLinkAllowedForDomain(domain),
-			InlineDNSLink:         true,
-			DeserializedResponses: true,
-			UseSubdomains:         false,
+		domains[domain] = &GatewayDomain{
+			NoDNSLink:     !isDNSLinkAllowedForDomain(domain),
+			InlineDNSLink: true,
 		}
 	}
 
 	for _, domain := range cfg.SubdomainGatewayDomains {
-		publicGateways[domain] = &gateway.PublicGateway{
-			Paths:                 []string{"/ipfs", "/ipns", "/version"},
-			NoDNSLink:             !isDNSLinkAllowedForDomain(domain),
-			InlineDNSLink:         true,
-			DeserializedResponses: true,
-			UseSubdomains:         true,
+		domains[domain] = &GatewayDomain{
+			NoDNSLink:     !isDNSLinkAllowedForDomain(domain),
+			InlineDNSLink: true,
+			UseSubdomains: true,
 		}
 	}
 
+	noDeserializedResponses := false
 	for _, domain := range cfg.TrustlessGatewayDomains {
-		publicGateways[domain] = &gateway.PublicGateway{
-			Paths:                 []string{"/ipfs", "/ipns", "/version"},
+		domains[domain] = &GatewayDomain{
 			NoDNSLink:             true,
 			InlineDNSLink:         true,
-			DeserializedResponses: false,
+			DeserializedResponses: &noDeserializedResponses,
 			UseSubdomains:         slices.Contains(cfg.SubdomainGatewayDomains, domain),
 		}
 	}
 
 	// If we're doing tests, ensure the right public gateways are enabled.
 	if os.Getenv("GATEWAY_CONFORMANCE_TEST") == "true" {
-		publicGateways["example.com"] = &gateway.PublicGateway{
-			Paths:                 []string{"/ipfs", "/ipns"},
-			NoDNSLink:             !isDNSLinkAllowedForDomain("example.com"),
-			InlineDNSLink:         true,
-			DeserializedResponses: true,
-			UseSubdomains:         true,
+		domains["example.com"] = &GatewayDomain{
+			Paths:         []string{"/ipfs", "/ipns"},
+			NoDNSLink:     !isDNSLinkAllowedForDomain("example.com"),
+			InlineDNSLink: true,
+			UseSubdomains: true,
 		}
 
 		// TODO: revisit the below once we clarify desired behavior in https://specs.ipfs.tech/http-gateways/subdomain-gateway/
-		publicGateways["localhost"].InlineDNSLink = true
+		domains["localhost"].InlineDNSLink = true
 	}
 
 	// After configuring all the standard domains, add DNSLink-only domains
 	for _, domain := range cfg.DNSLinkGatewayDomains {
 		// Only add if not already configured
-		if _, exists := publicGateways[domain]; !exists {
-			publicGateways[domain] = &gateway.PublicGateway{
-				Paths:                 []string{"/ipfs", "/ipns", "/version"},
-				NoDNSLink:             false,
-				InlineDNSLink:         true,
-				DeserializedResponses: true,
-				UseSubdomains:         false,
+		if _, exists := domains[domain]; !exists {
+			domains[domain] = &GatewayDomain{
+				InlineDNSLink: true,
 			}
 		}
 	}
 
+	// Hostnames from the gateway domains file replace the ones above.
+	maps.Copy(domains, cfg.GatewayDomainPolicies)
+
+	publicGateways := make(map[string]*gateway.PublicGateway, len(domains))
+	for host, d := range domains {
+		publicGateways[host] = d.publicGateway()
+	}
+
 	gwConf := gateway.Config{
 		DeserializedResponses:       true,
 		PublicGateways:              publicGateways,
 		NoDNSLink:                   len(cfg.DNSLinkGatewayDomains) > 0,
-		MaxConcurrentRequests:       cfg.MaxConcurrentRequests, // When exceeded, returns 429 with Retry-After: 60 (hardcoded in boxo)
 		RetrievalTimeout:            cfg.RetrievalTimeout,
 		MaxRequestDuration:          cfg.MaxRequestDuration,
 		MaxRangeRequestFileSize:     cfg.MaxRangeRequestFileSize,
@@ -362,7 +1259,14 @@ func setupGatewayHandler(cfg Config, nd *Node) (http.Handler, error) {
 		MaxUnixFSDAGResponseSize:    cfg.MaxUnixFSDAGResponseSize,
 		DiagnosticServiceURL:        cfg.DiagnosticServiceURL,
 	}
-	gwHandler := gateway.NewHandler(gwConf, backend)
+	gd := newGatewayDomains(domains)
+	newHandler := func(c gateway.Config) http.Handler {
+		return gateway.NewHandler(c, backend)
+	}
+	// The limit of concurrent requests is applied by limiter rather than by
+	// the boxo handlers, which would each have their own.
+	limiter.setLimit(cfg.MaxConcurrentRequests)
+	gwHandler := limiter.wrap(gd.withLimits(newHandler(gwConf), gwConf, newHandler))
 
 	ipfsHandler := withHTTPMetrics(gwHandler, "ipfs", cfg.disableMetrics)
 	ipnsHandler := withHTTPMetrics(gwHandler, "ipns", cfg.disableMetrics)
@@ -386,7 +1290,9 @@ func setupGatewayHandler(cfg Config, nd *Node) (http.Handler, error) {
 	handler := withConnect(topMux)
 	handler = http.Handler(gateway.NewHostnameHandler(gwConf, backend, handler))
 
-	// Add custom headers and liberal CORS.
+	// Add custom headers and liberal CORS. Headers of the gateway domains
+	// file override both.
+	handler = gd.withHeaders(handler)
 	handler = gateway.NewHeaders(headers).ApplyCors().Wrap(handler)
 
 	handler = servertiming.Middleware(handler, nil)
@@ -397,7 +1303,7 @@ func setupGatewayHandler(cfg Config, nd *Node) (http.Handler, error) {
 	// Add tracing.
 	handler = withTracingAndDebug(handler, cfg.TracingAuthToken)
 
-	return handler, nil
+	return handler
 }
 
 func withTracingAndDebug(next http.Handler, authToken string) http.Handler {
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+const (
+	// healthCheckTimeout bounds the time taken by all the checks.
+	healthCheckTimeout = 5 * time.Second
+	// healthProbeInterval is how long the reachability of remote endpoints
+	// and the result of the metadata writes are cached, so that frequent
+	// probes do not hit them every time.
+	healthProbeInterval = 30 * time.Second
+)
+
+// healthCheckKey is looked up to check that the datastore answers, and
+// written to check that the metadata datastore accepts writes.
+var healthCheckKey = datastore.NewKey("/RAINBOWHEALTHCHECK")
+
+// healthCheck is a named check of the health of the node.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthChecks are the checks of /healthz or /readyz.
+type healthChecks struct {
+	checks []healthCheck
+}
+
+// healthCheckResult is the outcome of a health check.
+type healthCheckResult struct {
+	Name     string
+	OK       bool
+	Error    string `json:",omitempty"`
+	Duration string
+}
+
+// healthResult is returned by /healthz and /readyz.
+type healthResult struct {
+	OK     bool
+	Checks []healthCheckResult
+}
+
+// run runs the checks concurrently.
+func (hc *healthChecks) run(ctx context.Context) healthResult {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	res := healthResult{OK: true, Checks: make([]healthCheckResult, len(hc.checks))}
+	var wg sync.WaitGroup
+	for i, c := range hc.checks {
+		wg.Go(func() {
+			start := time.Now()
+			err := c.check(ctx)
+			res.Checks[i] = healthCheckResult{
+				Name:     c.name,
+				OK:       err == nil,
+				Duration: time.Since(start).String(),
+			}
+			if err != nil {
+				res.Checks[i].Error = err.Error()
+			}
+		})
+	}
+	wg.Wait()
+
+	for _, c := range res.Checks {
+		res.OK = res.OK && c.OK
+	}
+	return res
+}
+
+// newLiveness returns the checks of /healthz. The node is alive as long as it
+// answers: restarting it would not fix a missing peer or remote endpoint.
+func newLiveness() *healthChecks {
+	return &healthChecks{checks: []healthCheck{}}
+}
+
+// newReadiness returns the checks of /readyz, which tell whether the node
+// can serve requests.
+func newReadiness(cfg Config, nd *Node, d *drainer) *healthChecks {
+	hc := &healthChecks{}
+	add := func(name string, check func(ctx context.Context) error) {
+		hc.checks = append(hc.checks, healthCheck{name: name, check: check})
+	}
+
+	if d != nil {
+		add("drain", func(ctx context.Context) error {
+			if !d.ready() {
+				return errors.New("draining")
+			}
+			return nil
+		})
+	}
+	if nd.datastore != nil {
+		// Probes do not write to the block datastore.
+		add("datastore", func(ctx context.Context) error {
+			if _, err := nd.datastore.Has(ctx, healthCheckKey); err != nil {
+				return fmt.Errorf("read: %w", err)
+			}
+			return nil
+		})
+	}
+	if nd.metadata != nil {
+		add("metadata", cachedCheck(healthProbeInterval, func(ctx context.Context) error {
+			// The metadata datastore is not created on disk until a
+			// feature persists state: there is nothing to check until then.
+			if lds, ok := nd.metadata.(*lazyDatastore); ok {
+				if ds, err := lds.open(false); err != nil || ds == nil {
+					return err
+				}
+			}
+			return checkDatastore(ctx, nd.metadata)
+		}))
+	}
+	if nd.host != nil && cfg.ReadyMinPeers > 0 {
+		add("peers", func(ctx context.Context) error {
+			if n := len(nd.host.Network().Peers()); n < cfg.ReadyMinPeers {
+				return fmt.Errorf("%d connected peers, %d required", n, cfg.ReadyMinPeers)
+			}
+			return nil
+		})
+	}
+	if nd.dht != nil {
+		add("dht", func(ctx context.Context) error {
+			return checkDHT(nd.dht)
+		})
+	}
+	client := &http.Client{
+		Transport: &customTransport{RoundTripper: http.DefaultTransport},
+	}
+	// Empty endpoints are left by flags set to an empty value.
+	isEmpty := func(s string) bool { return s == "" }
+	if routers := slices.DeleteFunc(slices.Clone(cfg.RoutingV1Endpoints), isEmpty); len(routers) > 0 {
+		add("routers", cachedCheck(healthProbeInterval, func(ctx context.Context) error {
+			return probeEndpoints(ctx, client, routers)
+		}))
+	}
+	if backends := slices.DeleteFunc(slices.Clone(cfg.RemoteBackends), isEmpty); len(backends) > 0 {
+		add("remote-backends", cachedCheck(healthProbeInterval, func(ctx context.Context) error {
+			return probeEndpoints(ctx, client, backends)
+		}))
+	}
+	return hc
+}
+
+// checkDatastore writes a probe key to ds, reads it back and deletes it.
+func checkDatastore(ctx context.Context, ds datastore.Datastore) error {
+	value := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := ds.Put(ctx, healthCheckKey, value); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	got, err := ds.Get(ctx, healthCheckKey)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if !bytes.Equal(got, value) {
+		return errors.New("read: probe value does not match the one written")
+	}
+	if err := ds.Delete(ctx, healthCheckKey); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
+
+// checkDHT returns an error until the standard DHT client has peers in its
+// routing table, or the accelerated client finished its first crawl.
+func checkDHT(r routing.Routing) error {
+	switch r := r.(type) {
+	case *monitoredRouter:
+		return checkDHT(r.Routing)
+	case *bundledDHT:
+		if !r.fullRT.Ready() {
+			return errors.New("accelerated DHT client is not ready")
+		}
+	case *dht.IpfsDHT:
+		if r.RoutingTable().Size() == 0 {
+			return errors.New("DHT routing table is empty")
+		}
+	}
+	return nil
+}
+
+// probeEndpoints returns an error when none of the urls answers. Any answer
+// but a server error counts.
+func probeEndpoints(ctx context.Context, client *http.Client, urls []string) error {
+	errs := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Go(func() {
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode >= http.StatusInternalServerError {
+				errs[i] = fmt.Errorf("%s: %s", u, res.Status)
+			}
+		})
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+		failed = append(failed, err.Error())
+	}
+	return fmt.Errorf("no endpoint reachable: %s", strings.Join(failed, "; "))
+}
+
+// cachedCheck returns check, running it at most once per interval.
+func cachedCheck(interval time.Duration, check func(ctx context.Context) error) func(ctx context.Context) error {
+	var (
+		mu   sync.Mutex
+		last time.Time
+		err  error
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(last) >= interval {
+			err = check(ctx)
+			last = time.Now()
+		}
+		return err
+	}
+}
+
+// withHealth serves /healthz and /readyz in front of next, on the hosts
+// returned by healthHosts. Other hosts may serve websites (DNSLink names,
+// subdomain gateways), whose own /healthz and /readyz go to next. Only the
+// overall status is returned: the results of every check are served on the
+// ctl listener.
+func withHealth(next http.Handler, cfg Config, liveness, readiness *healthChecks) http.Handler {
+	live, ready := healthStatusHandler(liveness), healthStatusHandler(readiness)
+	isHealthHost := healthHosts(cfg)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isHealthHost(r.Host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/healthz":
+			live(w, r)
+		case "/readyz":
+			ready(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// healthHosts returns a function telling whether the health checks are
+// served for a Host header: IP addresses, localhost and the configured path,
+// subdomain and trustless gateway hostnames. These only serve content under
+// /ipfs and /ipns.
+func healthHosts(cfg Config) func(host string) bool {
+	hosts := map[string]struct{}{"localhost": {}}
+	for _, domains := range [][]string{cfg.GatewayDomains, cfg.SubdomainGatewayDomains, cfg.TrustlessGatewayDomains} {
+		for _, d := range domains {
+			hosts[d] = struct{}{}
+		}
+	}
+	for d := range cfg.GatewayDomainPolicies {
+		hosts[d] = struct{}{}
+	}
+	// DNSLink gateway domains serve a website at their root.
+	for _, d := range cfg.DNSLinkGatewayDomains {
+		delete(hosts, d)
+	}
+
+	return func(host string) bool {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if _, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+			return true
+		}
+		_, ok := hosts[host]
+		return ok
+	}
+}
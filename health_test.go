@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	router := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(router.Close)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cfg := Config{
+		Bitswap:            true,
+		ReadyMinPeers:      1,
+		RoutingV1Endpoints: []string{"", down.URL, router.URL},
+		RemoteBackends:     []string{down.URL},
+	}
+	nd := mustTestNode(t, cfg)
+	d := newDrainer(0, time.Second)
+	readiness := newReadiness(cfg, nd, d)
+
+	failed := func(res healthResult) map[string]string {
+		m := make(map[string]string)
+		for _, c := range res.Checks {
+			if !c.OK {
+				m[c.Name] = c.Error
+			}
+		}
+		return m
+	}
+
+	res := readiness.run(ctx)
+	assert.False(t, res.OK)
+	assert.Len(t, res.Checks, 6)
+	assert.Equal(t, []string{"peers", "remote-backends"}, slices.Sorted(maps.Keys(failed(res))))
+	assert.Equal(t, "0 connected peers, 1 required", failed(res)["peers"])
+
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: nd.host.ID(), Addrs: nd.host.Addrs()}))
+
+	// Without remote backends, the node is ready once it has peers.
+	cfg.RemoteBackends = nil
+	readiness = newReadiness(cfg, nd, d)
+	res = readiness.run(ctx)
+	assert.True(t, res.OK, failed(res))
+
+	d.trigger()
+	res = readiness.run(ctx)
+	assert.False(t, res.OK)
+	assert.Equal(t, map[string]string{"drain": "draining"}, failed(res))
+}
+
+func TestHealthHandlers(t *testing.T) {
+	t.Parallel()
+
+	readiness := &healthChecks{checks: []healthCheck{
+		{name: "ok", check: func(ctx context.Context) error { return nil }},
+	}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	ts := httptest.NewServer(withHealth(next, Config{}, newLiveness(), readiness))
+	t.Cleanup(ts.Close)
+
+	get := func(t *testing.T, path string) (int, string) {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	code, body := get(t, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "OK\n", body)
+
+	code, body = get(t, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "OK\n", body)
+
+	// The gateway listener does not tell which checks failed.
+	readiness.checks = append(readiness.checks, healthCheck{name: "broken", check: func(ctx context.Context) error {
+		return errors.New("no endpoint reachable: https://router.internal")
+	}})
+	code, body = get(t, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "Service Unavailable\n", body)
+
+	// The ctl listener does.
+	rec := httptest.NewRecorder()
+	healthHandler(readiness)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	var hr healthResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&hr))
+	assert.False(t, hr.OK)
+	require.Len(t, hr.Checks, 2)
+	assert.Equal(t, "ok", hr.Checks[0].Name)
+	assert.Equal(t, healthCheckResult{Name: "broken", Error: "no endpoint reachable: https://router.internal", Duration: hr.Checks[1].Duration}, hr.Checks[1])
+
+	// Other requests go to the gateway.
+	code, _ = get(t, "/ipfs/bafkqaaa")
+	assert.Equal(t, http.StatusTeapot, code)
+
+	// Websites keep their own /healthz.
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/healthz", nil)
+	require.NoError(t, err)
+	req.Host = "bafkqaaa.ipfs.localhost"
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusTeapot, res.StatusCode)
+
+	res, err = http.Post(ts.URL+"/readyz", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestHealthHosts(t *testing.T) {
+	t.Parallel()
+
+	isHealthHost := healthHosts(Config{
+		GatewayDomains:          []string{"gw.example.net"},
+		SubdomainGatewayDomains: []string{"dweb.example.net"},
+		DNSLinkGatewayDomains:   []string{"gw.example.net", "site.example.org"},
+		GatewayDomainPolicies:   map[string]*GatewayDomain{"trustless.example.net": {}},
+	})
+
+	for host, want := range map[string]bool{
+		"127.0.0.1:8090":                 true,
+		"[::1]:8090":                     true,
+		"localhost:8090":                 true,
+		"dweb.example.net":               true,
+		"DWEB.example.net.":              true,
+		"trustless.example.net":          true,
+		"gw.example.net":                 false, // DNSLink website
+		"site.example.org":               false,
+		"bafkqaaa.ipfs.dweb.example.net": false,
+		"bafkqaaa.ipfs.localhost:8090":   false,
+		"unknown.example.com":            false,
+	} {
+		assert.Equal(t, want, isHealthHost(host), host)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	check := cachedCheck(time.Hour, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+	require.NoError(t, check(t.Context()))
+	require.NoError(t, check(t.Context()))
+	assert.Equal(t, 1, calls)
+}
+
+func TestCheckDatastore(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	ds := newLazyDatastore(filepath.Join(t.TempDir(), "metadata"))
+	require.NoError(t, checkDatastore(ctx, ds))
+
+	// The probe key is removed.
+	ok, err := ds.Has(ctx, healthCheckKey)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, ds.Close())
+	assert.ErrorIs(t, checkDatastore(ctx, ds), errMetadataClosed)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	"github.com/ipfs/boxo/bitswap/network"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// httpRetrievalIdle is how long the stats of an HTTP provider we stopped
+	// talking to are kept.
+	httpRetrievalIdle = time.Hour
+	// httpRetrievalWantTimeout is how long a want sent to an HTTP provider
+	// can stay unanswered before it is counted as an error.
+	httpRetrievalWantTimeout = time.Minute
+)
+
+var errHTTPRetrievalDenied = errors.New("http provider not allowed per allow/denylist")
+
+// httpProviderStats are the requests made to an HTTP provider.
+type httpProviderStats struct {
+	hosts     []string
+	requests  uint64
+	blocks    uint64
+	haves     uint64
+	dontHaves uint64
+	errors    uint64
+	bytes     uint64
+	lastSeen  time.Time
+
+	latency  time.Duration
+	answered uint64
+}
+
+// httpProvider is the status of an HTTP provider, as returned by
+// /mgr/http-retrieval.
+type httpProvider struct {
+	Peer      peer.ID
+	Hosts     []string
+	Connected bool
+	Requests  uint64
+	Blocks    uint64
+	Haves     uint64
+	DontHaves uint64
+	Errors    uint64
+	Bytes     uint64
+	Latency   string `json:",omitempty"` // mean time to answer a want
+	LastSeen  time.Time
+}
+
+type httpWant struct {
+	p peer.ID
+	c cid.Cid
+}
+
+// httpRetrieval filters the HTTP providers we talk to with an allowlist and a
+// denylist that can be changed at runtime, and tracks the outcome of the
+// requests made to every HTTP provider. Wants that get neither a block, a
+// HAVE nor a DONT_HAVE back, and failed connection attempts, are counted as
+// errors.
+type httpRetrieval struct {
+	// net is the HTTP network, to disconnect from the providers that are no
+	// longer allowed, and addrs the address book it reads their URLs from.
+	net   network.BitSwapNetwork
+	addrs peerstore.AddrBook
+
+	mu        sync.Mutex
+	allowlist map[string]struct{}
+	denylist  map[string]struct{}
+	providers map[peer.ID]*httpProviderStats
+	pending   map[httpWant]time.Time
+}
+
+func newHTTPRetrieval(allowlist, denylist []string) *httpRetrieval {
+	hr := &httpRetrieval{
+		allowlist: make(map[string]struct{}),
+		denylist:  make(map[string]struct{}),
+		providers: make(map[peer.ID]*httpProviderStats),
+		pending:   make(map[httpWant]time.Time),
+	}
+	for _, h := range allowlist {
+		hr.allowlist[h] = struct{}{}
+	}
+	for _, h := range denylist {
+		hr.denylist[h] = struct{}{}
+	}
+	return hr
+}
+
+// allowedLocked reports whether host can be used for retrieval.
+func (hr *httpRetrieval) allowedLocked(host string) bool {
+	if _, ok := hr.denylist[host]; ok {
+		return false
+	}
+	_, ok := hr.allowlist[host]
+	return ok || len(hr.allowlist) == 0
+}
+
+// lists returns the allowlist and the denylist.
+func (hr *httpRetrieval) lists() (allowlist, denylist []string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	return slices.Sorted(maps.Keys(hr.allowlist)), slices.Sorted(maps.Keys(hr.denylist))
+}
+
+// update adds (or removes when remove is set) hosts to the allowlist and the
+// denylist. The addresses of the hosts no longer allowed are removed from the
+// address book, and the providers using them are disconnected from, so that
+// they are only reconnected to through the allowed hosts.
+func (hr *httpRetrieval) update(allow, deny []string, remove bool) error {
+	for _, h := range slices.Concat(allow, deny) {
+		if h == "" || strings.ContainsFunc(h, func(r rune) bool { return r == ' ' || r == '\t' || r == '/' }) {
+			return fmt.Errorf("invalid host %q", h)
+		}
+	}
+
+	hr.mu.Lock()
+	for _, h := range allow {
+		if remove {
+			delete(hr.allowlist, h)
+		} else {
+			hr.allowlist[h] = struct{}{}
+		}
+	}
+	for _, h := range deny {
+		if remove {
+			delete(hr.denylist, h)
+		} else {
+			hr.denylist[h] = struct{}{}
+		}
+	}
+	var denied []peer.ID
+	for p, st := range hr.providers {
+		if slices.ContainsFunc(st.hosts, func(h string) bool { return !hr.allowedLocked(h) }) {
+			denied = append(denied, p)
+		}
+	}
+	hr.mu.Unlock()
+
+	for _, p := range denied {
+		if hr.addrs != nil {
+			hr.removeDeniedAddrs(p)
+		}
+		if hr.net != nil && hr.net.IsConnectedToPeer(context.Background(), p) {
+			goLog.Infow("Disconnecting from HTTP provider with hosts no longer allowed", "peer", p)
+			_ = hr.net.DisconnectFrom(context.Background(), p)
+		}
+	}
+	return nil
+}
+
+// removeDeniedAddrs removes the HTTP addresses of p whose host is no longer
+// allowed from the address book.
+func (hr *httpRetrieval) removeDeniedAddrs(p peer.ID) {
+	pi := peer.AddrInfo{ID: p, Addrs: hr.addrs.Addrs(p)}
+	allowed, _ := hr.filter(pi)
+	var denied []ma.Multiaddr
+	for _, u := range network.ExtractURLsFromPeer(pi) {
+		if !slices.ContainsFunc(allowed.Addrs, u.Multiaddress.Equal) {
+			denied = append(denied, u.Multiaddress)
+		}
+	}
+	if len(denied) > 0 {
+		hr.addrs.SetAddrs(p, denied, 0)
+	}
+}
+
+// filter returns the HTTP addresses of pi that can be used for retrieval,
+// and their hosts.
+func (hr *httpRetrieval) filter(pi peer.AddrInfo) (peer.AddrInfo, []string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	out := peer.AddrInfo{ID: pi.ID}
+	var hosts []string
+	for _, u := range network.ExtractURLsFromPeer(pi) {
+		host := u.URL.Hostname()
+		if !hr.allowedLocked(host) {
+			continue
+		}
+		out.Addrs = append(out.Addrs, u.Multiaddress)
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return out, hosts
+}
+
+func (hr *httpRetrieval) providerLocked(p peer.ID, now time.Time) *httpProviderStats {
+	st, ok := hr.providers[p]
+	if !ok {
+		st = &httpProviderStats{}
+		hr.providers[p] = st
+	}
+	st.lastSeen = now
+	return st
+}
+
+// connected records the outcome of a connection attempt to p over hosts.
+func (hr *httpRetrieval) connected(p peer.ID, hosts []string, err error) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	st := hr.providerLocked(p, time.Now())
+	if len(hosts) > 0 {
+		st.hosts = hosts
+	}
+	if err != nil {
+		st.errors++
+	}
+}
+
+// allowedPeer reports whether p is not known to only use hosts that are no
+// longer allowed.
+func (hr *httpRetrieval) allowedPeer(p peer.ID) bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	st, ok := hr.providers[p]
+	return !ok || len(st.hosts) == 0 || slices.ContainsFunc(st.hosts, hr.allowedLocked)
+}
+
+// sent records the wants of a message sent to p.
+func (hr *httpRetrieval) sent(p peer.ID, msg bsmsg.BitSwapMessage) {
+	entries := msg.Wantlist()
+	if len(entries) == 0 {
+		return
+	}
+
+	now := time.Now()
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	st := hr.providerLocked(p, now)
+	for _, e := range entries {
+		w := httpWant{p, e.Cid}
+		if e.Cancel {
+			delete(hr.pending, w)
+			continue
+		}
+		st.requests++
+		if _, ok := hr.pending[w]; !ok {
+			hr.pending[w] = now
+		}
+	}
+}
+
+// received records the blocks, HAVEs and DONT_HAVEs of a message received
+// from p.
+func (hr *httpRetrieval) received(p peer.ID, msg bsmsg.BitSwapMessage) {
+	now := time.Now()
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	st := hr.providerLocked(p, now)
+	answered := func(c cid.Cid) {
+		w := httpWant{p, c}
+		if since, ok := hr.pending[w]; ok {
+			st.latency += now.Sub(since)
+			st.answered++
+			delete(hr.pending, w)
+		}
+	}
+	for _, b := range msg.Blocks() {
+		st.blocks++
+		st.bytes += uint64(len(b.RawData()))
+		answered(b.Cid())
+	}
+	for _, c := range msg.Haves() {
+		st.haves++
+		answered(c)
+	}
+	for _, c := range msg.DontHaves() {
+		st.dontHaves++
+		answered(c)
+	}
+}
+
+// stats returns the status of the HTTP providers, most requested first.
+func (hr *httpRetrieval) stats() []httpProvider {
+	hr.mu.Lock()
+	out := make([]httpProvider, 0, len(hr.providers))
+	for p, st := range hr.providers {
+		hp := httpProvider{
+			Peer:      p,
+			Hosts:     slices.Clone(st.hosts),
+			Requests:  st.requests,
+			Blocks:    st.blocks,
+			Haves:     st.haves,
+			DontHaves: st.dontHaves,
+			Errors:    st.errors,
+			Bytes:     st.bytes,
+			LastSeen:  st.lastSeen,
+		}
+		if st.answered > 0 {
+			hp.Latency = (st.latency / time.Duration(st.answered)).Round(time.Millisecond).String()
+		}
+		out = append(out, hp)
+	}
+	hr.mu.Unlock()
+
+	if hr.net != nil {
+		for i := range out {
+			out[i].Connected = hr.net.IsConnectedToPeer(context.Background(), out[i].Peer)
+		}
+	}
+	slices.SortFunc(out, func(a, b httpProvider) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(string(a.Peer), string(b.Peer)))
+	})
+	return out
+}
+
+// prune counts the wants left unanswered as errors, and forgets the idle
+// providers.
+func (hr *httpRetrieval) prune(now time.Time) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	for w, since := range hr.pending {
+		if now.Sub(since) > httpRetrievalWantTimeout {
+			if st, ok := hr.providers[w.p]; ok {
+				st.errors++
+			}
+			delete(hr.pending, w)
+		}
+	}
+	for p, st := range hr.providers {
+		if now.Sub(st.lastSeen) > httpRetrievalIdle {
+			delete(hr.providers, p)
+		}
+	}
+}
+
+// start prunes the unanswered wants and the idle providers until ctx is
+// cancelled. The pruning goroutine is added to wg.
+func (hr *httpRetrieval) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		ticker := time.NewTicker(httpRetrievalWantTimeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				hr.prune(now)
+			}
+		}
+	})
+}
+
+// httpRetrievalNetwork wraps the HTTP network to enforce the allowlist and
+// the denylist of hr. The requests made to HTTP providers are recorded by
+// the sent and received hooks of hr.
+type httpRetrievalNetwork struct {
+	network.BitSwapNetwork
+	hr *httpRetrieval
+}
+
+func (n *httpRetrievalNetwork) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	pi, hosts := n.hr.filter(pi)
+	if len(pi.Addrs) == 0 {
+		return errHTTPRetrievalDenied
+	}
+	err := n.BitSwapNetwork.Connect(ctx, pi)
+	if ctx.Err() == nil {
+		n.hr.connected(pi.ID, hosts, err)
+	}
+	return err
+}
+
+func (n *httpRetrievalNetwork) SendMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+	if !n.hr.allowedPeer(p) {
+		return errHTTPRetrievalDenied
+	}
+	return n.BitSwapNetwork.SendMessage(ctx, p, msg)
+}
+
+func (n *httpRetrievalNetwork) NewMessageSender(ctx context.Context, p peer.ID, opts *network.MessageSenderOpts) (network.MessageSender, error) {
+	if !n.hr.allowedPeer(p) {
+		return nil, errHTTPRetrievalDenied
+	}
+	return n.BitSwapNetwork.NewMessageSender(ctx, p, opts)
+}
+
+var _ network.BitSwapNetwork = (*httpRetrievalNetwork)(nil)
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	pb "github.com/ipfs/boxo/bitswap/message/pb"
+	"github.com/ipfs/boxo/bitswap/network"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHTTPNetwork records the peers connected to.
+type fakeHTTPNetwork struct {
+	network.BitSwapNetwork
+	connected map[peer.ID][]ma.Multiaddr
+}
+
+func (n *fakeHTTPNetwork) Connect(_ context.Context, pi peer.AddrInfo) error {
+	if len(pi.Addrs) == 0 {
+		return errors.New("no addresses")
+	}
+	n.connected[pi.ID] = pi.Addrs
+	return nil
+}
+
+func (n *fakeHTTPNetwork) IsConnectedToPeer(_ context.Context, p peer.ID) bool {
+	_, ok := n.connected[p]
+	return ok
+}
+
+func (n *fakeHTTPNetwork) DisconnectFrom(_ context.Context, p peer.ID) error {
+	delete(n.connected, p)
+	return nil
+}
+
+func TestHTTPRetrieval(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	p1, p2 := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	addr := func(s string) ma.Multiaddr {
+		m, err := ma.NewMultiaddr(s)
+		require.NoError(t, err)
+		return m
+	}
+	a1 := addr("/dns4/one.example.com/tcp/443/https")
+	a2 := addr("/dns4/two.example.com/tcp/443/https")
+	denied := addr("/dns4/denied.example.com/tcp/443/https")
+
+	hr := newHTTPRetrieval(nil, []string{"denied.example.com"})
+	fake := &fakeHTTPNetwork{connected: make(map[peer.ID][]ma.Multiaddr)}
+	hr.net = fake
+	n := &httpRetrievalNetwork{BitSwapNetwork: fake, hr: hr}
+
+	// Denied hosts are filtered out before connecting.
+	require.NoError(t, n.Connect(ctx, peer.AddrInfo{ID: p1, Addrs: []ma.Multiaddr{a1, denied}}))
+	require.Equal(t, []ma.Multiaddr{a1}, fake.connected[p1])
+	require.ErrorIs(t, n.Connect(ctx, peer.AddrInfo{ID: p2, Addrs: []ma.Multiaddr{denied}}), errHTTPRetrievalDenied)
+	require.NoError(t, n.Connect(ctx, peer.AddrInfo{ID: p2, Addrs: []ma.Multiaddr{a2}}))
+
+	// Wants are matched with the blocks, HAVEs and DONT_HAVEs received.
+	b1, b2, b3 := blocks.NewBlock([]byte("one")), blocks.NewBlock([]byte("two")), blocks.NewBlock([]byte("three"))
+	wants := bsmsg.New(false)
+	wants.AddEntry(b1.Cid(), 1, pb.Message_Wantlist_Block, true)
+	wants.AddEntry(b2.Cid(), 1, pb.Message_Wantlist_Have, true)
+	wants.AddEntry(b3.Cid(), 1, pb.Message_Wantlist_Block, true)
+	hr.sent(p1, wants)
+	resp := bsmsg.New(false)
+	resp.AddBlock(b1)
+	resp.AddHave(b2.Cid())
+	resp.AddDontHave(b3.Cid())
+	hr.received(p1, resp)
+
+	// Wants left unanswered are errors.
+	hr.sent(p2, wants)
+	cancel := bsmsg.New(false)
+	cancel.Cancel(b2.Cid())
+	hr.sent(p2, cancel)
+	hr.prune(time.Now().Add(httpRetrievalWantTimeout + time.Second))
+
+	stats := hr.stats()
+	require.Len(t, stats, 2)
+	// Both providers got 3 requests, so their order depends on the peer IDs.
+	if stats[0].Peer != p1 {
+		stats[0], stats[1] = stats[1], stats[0]
+	}
+	require.Equal(t, httpProvider{
+		Peer:      p1,
+		Hosts:     []string{"one.example.com"},
+		Connected: true,
+		Requests:  3,
+		Blocks:    1,
+		Haves:     1,
+		DontHaves: 1,
+		Bytes:     uint64(len(b1.RawData())),
+		Latency:   stats[0].Latency,
+		LastSeen:  stats[0].LastSeen,
+	}, stats[0])
+	require.NotEmpty(t, stats[0].Latency)
+	require.EqualValues(t, 2, stats[1].Errors)
+	require.Empty(t, hr.pending)
+
+	// Denying a host disconnects from its providers, and stops new messages
+	// to them.
+	handler := httpRetrievalHandler(hr)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/mgr/http-retrieval?deny=one.example.com", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.False(t, fake.IsConnectedToPeer(ctx, p1))
+	require.True(t, fake.IsConnectedToPeer(ctx, p2))
+	_, err := n.NewMessageSender(ctx, p1, nil)
+	require.ErrorIs(t, err, errHTTPRetrievalDenied)
+
+	// An allowlist only keeps the providers on it.
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/mgr/http-retrieval?allow=other.example.com", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.False(t, fake.IsConnectedToPeer(ctx, p2))
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodDelete, "/mgr/http-retrieval?allow=other.example.com&deny=one.example.com", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body struct {
+		Allowlist []string
+		Denylist  []string
+		Count     int
+		Providers []httpProvider
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	require.Empty(t, body.Allowlist)
+	require.Equal(t, []string{"denied.example.com"}, body.Denylist)
+	require.Equal(t, 2, body.Count)
+	require.True(t, hr.allowedPeer(p1))
+
+	for _, target := range []string{"/mgr/http-retrieval", "/mgr/http-retrieval?deny=bad%20host"} {
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		require.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPut, "/mgr/http-retrieval", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	httpRetrievalHandler(nil)(rec, httptest.NewRequest(http.MethodGet, "/mgr/http-retrieval", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHTTPRetrievalDenyOneHost(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	p := test.RandPeerIDFatal(t)
+	addr := func(s string) ma.Multiaddr {
+		m, err := ma.NewMultiaddr(s)
+		require.NoError(t, err)
+		return m
+	}
+	a1 := addr("/dns4/one.example.com/tcp/443/https")
+	a2 := addr("/dns4/two.example.com/tcp/443/https")
+	libp2p := addr("/ip4/1.2.3.4/tcp/4001")
+
+	ps, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	t.Cleanup(func() { ps.Close() })
+	hr := newHTTPRetrieval(nil, nil)
+	fake := &fakeHTTPNetwork{connected: make(map[peer.ID][]ma.Multiaddr)}
+	hr.net = fake
+	hr.addrs = ps
+	n := &httpRetrievalNetwork{BitSwapNetwork: fake, hr: hr}
+
+	ps.AddAddrs(p, []ma.Multiaddr{a1, a2, libp2p}, peerstore.PermanentAddrTTL)
+	require.NoError(t, n.Connect(ctx, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{a1, a2}}))
+
+	// Denying one of the hosts of a provider removes its addresses, and
+	// disconnects from the provider so that it is reconnected to through
+	// the other host only.
+	require.NoError(t, hr.update(nil, []string{"two.example.com"}, false))
+	require.False(t, fake.IsConnectedToPeer(ctx, p))
+	require.ElementsMatch(t, []ma.Multiaddr{a1, libp2p}, ps.Addrs(p))
+	require.True(t, hr.allowedPeer(p))
+
+	require.NoError(t, n.Connect(ctx, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{a1, a2}}))
+	require.Equal(t, []ma.Multiaddr{a1}, fake.connected[p])
+	require.Equal(t, []string{"one.example.com"}, hr.stats()[0].Hosts)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -23,8 +24,12 @@ import (
 	autoconf "github.com/ipfs/boxo/autoconf"
 	"github.com/ipfs/boxo/gateway"
 	logging "github.com/ipfs/go-log/v2"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
 	"github.com/urfave/cli/v2"
 	"go.opentelemetry.io/contrib/propagators/autoprop"
@@ -77,6 +82,12 @@ Generate an identity seed and launch a gateway:
 `
 
 	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "env-file",
+			Value:   "",
+			EnvVars: []string{"RAINBOW_ENV_FILE"},
+			Usage:   "Path to a file of KEY=value lines setting environment variables. It is read again on SIGHUP and /mgr/reload to apply the settings that can change at runtime",
+		},
 		&cli.StringFlag{
 			Name:    "datadir",
 			Value:   "",
@@ -136,6 +147,18 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"RAINBOW_SEED_PEERING_MAX_INDEX"},
 			Usage:   "Largest index to derive automatic peering peer IDs for",
 		},
+		&cli.BoolFlag{
+			Name:    "seed-peering-sharding",
+			Value:   false,
+			EnvVars: []string{"RAINBOW_SEED_PEERING_SHARDING"},
+			Usage:   "(EXPERIMENTAL) Shard the cache across the seed-peered instances: every CID is owned by one instance, the others ask it first and only keep the blocks they don't own in memory (requires --seed-peering, --peering-shared-cache and --peering-shared-cache-all)",
+		},
+		&cli.IntFlag{
+			Name:    "seed-peering-sharding-memory",
+			Value:   256 << 20,
+			EnvVars: []string{"RAINBOW_SEED_PEERING_SHARDING_MEMORY"},
+			Usage:   "Size in bytes of the in-memory cache of the blocks owned by other instances with --seed-peering-sharding",
+		},
 		&cli.StringSliceFlag{
 			Name:    "gateway-domains",
 			Value:   cli.NewStringSlice(),
@@ -154,6 +177,12 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"RAINBOW_TRUSTLESS_GATEWAY_DOMAINS"},
 			Usage:   "Domains limited to trustless, verifiable response types (comma-separated)",
 		},
+		&cli.StringFlag{
+			Name:    "gateway-domains-file",
+			Value:   "",
+			EnvVars: []string{"RAINBOW_GATEWAY_DOMAINS_FILE"},
+			Usage:   "Path to a JSON file setting the paths, subdomains, DNSLink, response types, headers and size limits of gateway hostnames",
+		},
 		&cli.StringFlag{
 			Name:    "gateway-listen-address",
 			Value:   "127.0.0.1:8090",
@@ -166,6 +195,48 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"RAINBOW_CTL_LISTEN_ADDRESS"},
 			Usage:   "Listen address for the management api and metrics",
 		},
+		&cli.IntFlag{
+			Name:    "ready-min-peers",
+			Value:   1,
+			EnvVars: []string{"RAINBOW_READY_MIN_PEERS"},
+			Usage:   "Minimum number of connected peers for /readyz to report the node as ready, 0 to disable the check",
+			Action: func(ctx *cli.Context, n int) error {
+				if n < 0 {
+					return errors.New("invalid value for --ready-min-peers: must not be negative")
+				}
+				return nil
+			},
+		},
+		&cli.DurationFlag{
+			Name:    "drain-grace",
+			Value:   5 * time.Second,
+			EnvVars: []string{"RAINBOW_DRAIN_GRACE"},
+			Usage:   "How long /readyz fails on shutdown before new requests are refused, so that load balancers stop sending them",
+			Action: func(ctx *cli.Context, d time.Duration) error {
+				if d < 0 {
+					return errors.New("invalid value for --drain-grace: must not be negative")
+				}
+				return nil
+			},
+		},
+		&cli.DurationFlag{
+			Name:    "drain-timeout",
+			Value:   30 * time.Second,
+			EnvVars: []string{"RAINBOW_DRAIN_TIMEOUT"},
+			Usage:   "Maximum time given to requests in flight to finish on shutdown, before their connections are closed",
+			Action: func(ctx *cli.Context, d time.Duration) error {
+				if d < 0 {
+					return errors.New("invalid value for --drain-timeout: must not be negative")
+				}
+				return nil
+			},
+		},
+		&cli.StringFlag{
+			Name:    "routing-listen-address",
+			Value:   "",
+			EnvVars: []string{"RAINBOW_ROUTING_LISTEN_ADDRESS"},
+			Usage:   "Listen address for the Delegated Routing V1 HTTP API (/routing/v1). Disabled when empty",
+		},
 		&cli.DurationFlag{
 			Name:    "gc-interval",
 			Value:   time.Minute * 60,
@@ -202,6 +273,18 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"RAINBOW_LIBP2P_CONNMGR_GRACE_PERIOD"},
 			Usage:   "How long new libp2p connections are immune from being closed by the connection manager",
 		},
+		&cli.BoolFlag{
+			Name:    "libp2p-persist-peerstore",
+			Value:   false,
+			EnvVars: []string{"RAINBOW_LIBP2P_PERSIST_PEERSTORE"},
+			Usage:   "Save the addresses of the warm peers in the datadir, so that they survive a restart",
+		},
+		&cli.IntFlag{
+			Name:    "libp2p-warm-peers",
+			Value:   0,
+			EnvVars: []string{"RAINBOW_LIBP2P_WARM_PEERS"},
+			Usage:   "Number of most useful Bitswap peers reconnected to at startup. Requires --libp2p-persist-peerstore. Use 0 to disable",
+		},
 		&cli.IntFlag{
 			Name:    "inmem-block-cache",
 			Value:   1 << 30,
@@ -252,6 +335,62 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"RAINBOW_DHT_SHARED_HOST"},
 			Usage:   "If false, DHT operations are run using an ephemeral peer, separate from the main one",
 		},
+		&cli.BoolFlag{
+			Name:    "dht-server",
+			Value:   false,
+			EnvVars: []string{"RAINBOW_DHT_SERVER"},
+			Usage:   "Run the DHT in server mode and announce cached roots, serving them back over Bitswap. Requires --dht-shared-host",
+		},
+		&cli.StringFlag{
+			Name:    "dht-provide-strategy",
+			Value:   string(DHTProvidePopular),
+			EnvVars: []string{"RAINBOW_DHT_PROVIDE_STRATEGY"},
+			Usage:   "Cached roots announced in DHT server mode: 'popular' (most requested) or 'recent' (most recently requested)",
+			Action: func(ctx *cli.Context, s string) error {
+				switch DHTProvideStrategy(s) {
+				case DHTProvidePopular, DHTProvideRecent:
+					return nil
+				default:
+					return errors.New("invalid value for --dht-provide-strategy: use 'popular' or 'recent'")
+				}
+			},
+		},
+		&cli.IntFlag{
+			Name:    "dht-provide-max-roots",
+			Value:   1000,
+			EnvVars: []string{"RAINBOW_DHT_PROVIDE_MAX_ROOTS"},
+			Usage:   "Maximum number of cached roots announced in DHT server mode. Use 0 to not announce anything",
+		},
+		&cli.DurationFlag{
+			Name:    "dht-provide-interval",
+			Value:   22 * time.Hour,
+			EnvVars: []string{"RAINBOW_DHT_PROVIDE_INTERVAL"},
+			Usage:   "How often cached roots are announced in DHT server mode",
+			Action: func(ctx *cli.Context, d time.Duration) error {
+				if d <= 0 {
+					return errors.New("invalid value for --dht-provide-interval: must be positive")
+				}
+				return nil
+			},
+		},
+		&cli.StringFlag{
+			Name:    "dht-protocol-prefix",
+			Value:   string(dht.DefaultPrefix),
+			EnvVars: []string{"RAINBOW_DHT_PROTOCOL_PREFIX"},
+			Usage:   "Protocol prefix of the DHT. Use a custom prefix to join a private DHT",
+			Action: func(ctx *cli.Context, s string) error {
+				if !strings.HasPrefix(s, "/") {
+					return errors.New("invalid value for --dht-protocol-prefix: must start with '/'")
+				}
+				return nil
+			},
+		},
+		&cli.StringFlag{
+			Name:    "swarm-key-file",
+			Value:   "",
+			EnvVars: []string{"RAINBOW_SWARM_KEY_FILE"},
+			Usage:   "Path to a libp2p swarm.key file. When set, only peers with the same key can connect",
+		},
 		&cli.StringFlag{
 			Name:    "bootstrap",
 			Value:   "auto",
@@ -268,7 +407,19 @@ Generate an identity seed and launch a gateway:
 			Name:    "peering",
 			Value:   cli.NewStringSlice(),
 			EnvVars: []string{"RAINBOW_PEERING"},
-			Usage:   "(EXPERIMENTAL) Multiaddresses of peers to stay connected to and ask for missing blocks over Bitswap (comma-separated)",
+			Usage:   "(EXPERIMENTAL) Multiaddresses of peers to stay connected to and ask for missing blocks over Bitswap (comma-separated). Addresses with DNS names are re-resolved every --peering-dns-interval",
+		},
+		&cli.DurationFlag{
+			Name:    "peering-dns-interval",
+			Value:   time.Minute,
+			EnvVars: []string{"RAINBOW_PEERING_DNS_INTERVAL"},
+			Usage:   "How often --peering addresses with DNS names are resolved again to add and drop peers. Use 0 to only resolve them at startup",
+			Action: func(ctx *cli.Context, d time.Duration) error {
+				if d < 0 {
+					return errors.New("invalid value for --peering-dns-interval: must not be negative")
+				}
+				return nil
+			},
 		},
 		&cli.BoolFlag{
 			Name:    "peering-shared-cache",
@@ -276,6 +427,24 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"RAINBOW_PEERING_SHARED_CACHE"},
 			Usage:   "(EXPERIMENTAL: increased network I/O) Enable sharing of local cache to peers safe-listed with --peering. Rainbow will respond to Bitswap queries from these peers, serving locally cached data as needed (requires --bitswap=true).",
 		},
+		&cli.BoolFlag{
+			Name:    "peering-shared-cache-all",
+			Value:   false,
+			EnvVars: []string{"RAINBOW_PEERING_SHARED_CACHE_ALL"},
+			Usage:   "Also share the local cache with the --seed-peering peers, not only the --peering ones and the ones added at runtime with /mgr/peering (requires --peering-shared-cache)",
+		},
+		&cli.DurationFlag{
+			Name:    "peering-cache-summary-interval",
+			Value:   10 * time.Minute,
+			EnvVars: []string{"RAINBOW_PEERING_CACHE_SUMMARY_INTERVAL"},
+			Usage:   "How often summaries of the cache contents are exchanged with peered peers when --peering-shared-cache is enabled. Use 0 to disable",
+			Action: func(ctx *cli.Context, d time.Duration) error {
+				if d < 0 {
+					return errors.New("invalid value for --peering-cache-summary-interval: must not be negative")
+				}
+				return nil
+			},
+		},
 		&cli.StringFlag{
 			Name:    "blockstore",
 			Value:   "flatfs",
@@ -306,6 +475,102 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"BITSWAP_ENABLE_DUPLICATE_BLOCK_STATS"},
 			Usage:   "Enable bitswap duplicate block statistics collection",
 		},
+		&cli.BoolFlag{
+			Name:    "bitswap-inspect",
+			Value:   false,
+			EnvVars: []string{"RAINBOW_BITSWAP_INSPECT"},
+			Usage:   "Track the wants and messages of the Bitswap client for /mgr/bitswap/wantlist and /mgr/bitswap/stats",
+		},
+		&cli.DurationFlag{
+			Name:    "bitswap-provider-search-delay",
+			Value:   time.Second,
+			EnvVars: []string{"RAINBOW_BITSWAP_PROVIDER_SEARCH_DELAY"},
+			Usage:   "How long a Bitswap session waits for blocks from the peers it knows before searching for providers",
+			Action: func(ctx *cli.Context, v time.Duration) error {
+				if v <= 0 {
+					return errors.New("invalid value for --bitswap-provider-search-delay: must be positive")
+				}
+				return nil
+			},
+		},
+		&cli.DurationFlag{
+			Name:    "bitswap-rebroadcast-delay",
+			Value:   10 * time.Second,
+			EnvVars: []string{"RAINBOW_BITSWAP_REBROADCAST_DELAY"},
+			Usage:   "How often a Bitswap session searches for providers of a random pending want",
+			Action: func(ctx *cli.Context, v time.Duration) error {
+				if v <= 0 {
+					return errors.New("invalid value for --bitswap-rebroadcast-delay: must be positive")
+				}
+				return nil
+			},
+		},
+		&cli.BoolFlag{
+			Name:    "bitswap-server-public",
+			Value:   false,
+			EnvVars: []string{"RAINBOW_BITSWAP_SERVER_PUBLIC"},
+			Usage:   "Serve cached blocks over Bitswap to any peer, within the --bitswap-server-* budgets",
+		},
+		&cli.IntFlag{
+			Name:    "bitswap-server-peer-requests",
+			Value:   100,
+			EnvVars: []string{"RAINBOW_BITSWAP_SERVER_PEER_REQUESTS"},
+			Usage:   "Maximum number of wants per second answered for a single peer when serving publicly. Use 0 for no limit",
+			Action: func(ctx *cli.Context, v int) error {
+				if v < 0 {
+					return errors.New("invalid value for --bitswap-server-peer-requests: must not be negative")
+				}
+				return nil
+			},
+		},
+		&cli.Int64Flag{
+			Name:    "bitswap-server-peer-bandwidth",
+			Value:   1 << 20,
+			EnvVars: []string{"RAINBOW_BITSWAP_SERVER_PEER_BANDWIDTH"},
+			Usage:   "Maximum number of block bytes per second sent to a single peer when serving publicly. Use 0 for no limit",
+			Action: func(ctx *cli.Context, v int64) error {
+				if v < 0 {
+					return errors.New("invalid value for --bitswap-server-peer-bandwidth: must not be negative")
+				}
+				return nil
+			},
+		},
+		&cli.Int64Flag{
+			Name:    "bitswap-server-max-bandwidth",
+			Value:   32 << 20,
+			EnvVars: []string{"RAINBOW_BITSWAP_SERVER_MAX_BANDWIDTH"},
+			Usage:   "Maximum number of block bytes per second sent by the Bitswap server to all peers when serving publicly. Use 0 for no limit",
+			Action: func(ctx *cli.Context, v int64) error {
+				if v < 0 {
+					return errors.New("invalid value for --bitswap-server-max-bandwidth: must not be negative")
+				}
+				return nil
+			},
+		},
+		&cli.IntFlag{
+			Name:    "prefetch-depth",
+			Value:   0,
+			EnvVars: []string{"RAINBOW_PREFETCH_DEPTH"},
+			Usage:   "Number of DAG levels fetched in the background ahead of UnixFS reads. Use 0 to disable prefetching",
+			Action: func(ctx *cli.Context, v int) error {
+				if v < 0 {
+					return errors.New("invalid value for --prefetch-depth: must not be negative")
+				}
+				return nil
+			},
+		},
+		&cli.IntFlag{
+			Name:    "prefetch-concurrency",
+			Value:   32,
+			EnvVars: []string{"RAINBOW_PREFETCH_CONCURRENCY"},
+			Usage:   "Maximum number of concurrent prefetch walks",
+			Action: func(ctx *cli.Context, v int) error {
+				if v < 1 {
+					return errors.New("invalid value for --prefetch-concurrency: must be at least 1")
+				}
+				return nil
+			},
+		},
 		&cli.StringSliceFlag{
 			Name:    "remote-backends",
 			Value:   cli.NewStringSlice(),
@@ -420,18 +685,36 @@ Generate an identity seed and launch a gateway:
 			Value:   16,
 			EnvVars: []string{"ROUTING_MAX_REQUESTS"},
 			Usage:   "Maximum number of concurrent provider find requests, 0 for unlimited",
+			Action: func(ctx *cli.Context, v int) error {
+				if v < 0 {
+					return errors.New("invalid value for --routing-max-requests: must not be negative")
+				}
+				return nil
+			},
 		},
 		&cli.IntFlag{
 			Name:    "routing-max-providers",
 			EnvVars: []string{"ROUTING_MAX_PROVIDERS"},
 			Value:   0,
 			Usage:   "Maximum number of providers to return for each provider find request, 0 for unlimited",
+			Action: func(ctx *cli.Context, v int) error {
+				if v < 0 {
+					return errors.New("invalid value for --routing-max-providers: must not be negative")
+				}
+				return nil
+			},
 		},
 		&cli.DurationFlag{
 			Name:    "routing-max-timeout",
 			Value:   10 * time.Second,
 			EnvVars: []string{"ROUTING_MAX_TIMEOUT"},
 			Usage:   "Maximum time for routing to find the maximum number of providers",
+			Action: func(ctx *cli.Context, v time.Duration) error {
+				if v <= 0 {
+					return errors.New("invalid value for --routing-max-timeout: must be positive")
+				}
+				return nil
+			},
 		},
 		&cli.DurationFlag{
 			Name:    "http-routers-timeout",
@@ -450,6 +733,60 @@ Generate an identity seed and launch a gateway:
 			EnvVars: []string{"ROUTING_IGNORE_PROVIDERS"},
 			Usage:   "Ignore provider records from the given peer IDs",
 		},
+		&cli.DurationFlag{
+			Name:    "routing-cache-ttl",
+			Value:   0,
+			EnvVars: []string{"RAINBOW_ROUTING_CACHE_TTL"},
+			Usage:   "How long provider records found by routing are cached and reused before querying the routers again. Set 0 to disable",
+		},
+		&cli.Float64Flag{
+			Name:    "routing-bench-error-rate",
+			Value:   0,
+			EnvVars: []string{"RAINBOW_ROUTING_BENCH_ERROR_RATE"},
+			Usage:   "Error rate (between 0 and 1) over recent requests above which an HTTP router is benched for --routing-bench-cooldown. Set 0 to disable",
+			Action: func(ctx *cli.Context, f float64) error {
+				if f < 0 || f > 1 {
+					return errors.New("invalid value for --routing-bench-error-rate: must be between 0 and 1")
+				}
+				return nil
+			},
+		},
+		&cli.DurationFlag{
+			Name:    "routing-bench-cooldown",
+			Value:   5 * time.Minute,
+			EnvVars: []string{"RAINBOW_ROUTING_BENCH_COOLDOWN"},
+			Usage:   "How long a benched HTTP router is skipped before being tried again",
+		},
+		&cli.StringFlag{
+			Name:    "routing-policy-file",
+			Value:   "",
+			EnvVars: []string{"RAINBOW_ROUTING_POLICY_FILE"},
+			Usage:   "Path to a JSON file setting the order, delays, timeouts and operations of the DHT and HTTP routers",
+		},
+		&cli.StringFlag{
+			Name:    "routing-static-file",
+			Value:   "",
+			EnvVars: []string{"RAINBOW_ROUTING_STATIC_FILE"},
+			Usage:   "Path to a JSON file mapping CIDs, CID prefixes or '*' to provider multiaddrs or HTTP gateway URLs. Reloaded when it changes",
+		},
+		&cli.BoolFlag{
+			Name:    "provider-reputation",
+			Value:   false,
+			EnvVars: []string{"RAINBOW_PROVIDER_REPUTATION"},
+			Usage:   "Track how well providers deliver blocks over Bitswap and HTTP retrieval, and persist their scores",
+		},
+		&cli.Float64Flag{
+			Name:    "provider-reputation-min-score",
+			Value:   0.1,
+			EnvVars: []string{"RAINBOW_PROVIDER_REPUTATION_MIN_SCORE"},
+			Usage:   "Skip providers whose share of requested blocks delivered is below this value (between 0 and 1). Set 0 to only track scores",
+			Action: func(ctx *cli.Context, f float64) error {
+				if f < 0 || f > 1 {
+					return errors.New("invalid value for --provider-reputation-min-score: must be between 0 and 1")
+				}
+				return nil
+			},
+		},
 		&cli.BoolFlag{
 			Name:    "http-retrieval-enable",
 			Value:   true,
@@ -575,6 +912,21 @@ share the same seed as long as the indexes are different.
 	app.Action = func(cctx *cli.Context) error {
 		fmt.Printf("Starting %s %s\n", name, version)
 
+		var env *envFile
+		if path := cctx.String("env-file"); path != "" {
+			env = newEnvFile(path)
+			if err := env.load(); err != nil {
+				return err
+			}
+			var err error
+			if cctx, err = parseFlags(cctx.Context, cctx.App, os.Args[1:]); err != nil {
+				return err
+			}
+			if err := setLogLevels(os.Getenv(envLogLevel)); err != nil {
+				return err
+			}
+		}
+
 		ddir := cctx.String("datadir")
 		cdns := newCachedDNS(dnsCacheRefreshInterval)
 		defer cdns.Close()
@@ -582,6 +934,7 @@ share the same seed as long as the indexes are different.
 		var seed string
 		var priv crypto.PrivKey
 		var peeringAddrs []peer.AddrInfo
+		var peeringDNSAddrs []multiaddr.Multiaddr
 		var index int
 		var err error
 
@@ -636,21 +989,9 @@ share the same seed as long as the indexes are different.
 				return err
 			}
 
-			for _, maStr := range cctx.StringSlice("peering") {
-				if len(seed) > 0 && index >= 0 {
-					maStr, err = replaceRainbowSeedWithPeer(maStr, seed)
-					if err != nil {
-						return err
-					}
-				} else if rainbowSeedRegex.MatchString(maStr) {
-					return fmt.Errorf("unable to peer with %q without defining --seed-index of this instance first", maStr)
-				}
-
-				ai, err := peer.AddrInfoFromString(maStr)
-				if err != nil {
-					return err
-				}
-				peeringAddrs = append(peeringAddrs, *ai)
+			peeringAddrs, peeringDNSAddrs, err = parsePeerings(cctx.StringSlice("peering"), seed, index)
+			if err != nil {
+				return err
 			}
 		}
 
@@ -697,21 +1038,30 @@ share the same seed as long as the indexes are different.
 			)
 		}
 
-		dnslinkGatewayDomains := cctx.StringSlice("dnslink-gateway-domains")
-		dnslinkGatewayDomains = slices.DeleteFunc(dnslinkGatewayDomains, func(s string) bool {
-			return s == ""
-		})
+		var routingPolicy *RoutingPolicy
+		if path := cctx.String("routing-policy-file"); path != "" {
+			routingPolicy, err = loadRoutingPolicy(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		var swarmKey pnet.PSK
+		if path := cctx.String("swarm-key-file"); path != "" {
+			swarmKey, err = loadSwarmKey(path)
+			if err != nil {
+				return err
+			}
+		}
 
 		cfg := Config{
 			DataDir:                          ddir,
 			BlockstoreType:                   cctx.String("blockstore"),
-			GatewayDomains:                   cctx.StringSlice("gateway-domains"),
-			SubdomainGatewayDomains:          cctx.StringSlice("subdomain-gateway-domains"),
-			TrustlessGatewayDomains:          cctx.StringSlice("trustless-gateway-domains"),
-			DNSLinkGatewayDomains:            dnslinkGatewayDomains,
 			ConnMgrLow:                       cctx.Int("libp2p-connmgr-low"),
 			ConnMgrHi:                        cctx.Int("libp2p-connmgr-high"),
 			ConnMgrGrace:                     cctx.Duration("libp2p-connmgr-grace"),
+			PersistPeerstore:                 cctx.Bool("libp2p-persist-peerstore"),
+			WarmPeers:                        cctx.Int("libp2p-warm-peers"),
 			MaxMemory:                        cctx.Uint64("libp2p-max-memory"),
 			MaxFD:                            cctx.Int("libp2p-max-fd"),
 			InMemBlockCache:                  cctx.Int64("inmem-block-cache"),
@@ -721,24 +1071,38 @@ share the same seed as long as the indexes are different.
 			RoutingTimeout:                   cctx.Duration("routing-timeout"),
 			DHTRouting:                       dhtRouting,
 			DHTSharedHost:                    cctx.Bool("dht-shared-host"),
+			DHTProtocolPrefix:                protocol.ID(cctx.String("dht-protocol-prefix")),
+			DHTServer:                        cctx.Bool("dht-server"),
+			DHTProvideStrategy:               DHTProvideStrategy(cctx.String("dht-provide-strategy")),
+			DHTProvideMaxRoots:               cctx.Int("dht-provide-max-roots"),
+			DHTProvideInterval:               cctx.Duration("dht-provide-interval"),
+			SwarmKey:                         swarmKey,
 			Bitswap:                          bitswap,
 			BitswapWantHaveReplaceSize:       cctx.Int("bitswap-wanthave-replace-size"),
 			BitswapEnableDuplicateBlockStats: cctx.Bool("bitswap-enable-duplicate-block-stats"),
+			BitswapInspect:                   cctx.Bool("bitswap-inspect"),
+			BitswapServerPublic:              cctx.Bool("bitswap-server-public"),
+			PrefetchDepth:                    cctx.Int("prefetch-depth"),
+			PrefetchConcurrency:              cctx.Int("prefetch-concurrency"),
 			IpnsMaxCacheTTL:                  cctx.Duration("ipns-max-cache-ttl"),
-			DenylistSubs:                     cctx.StringSlice("denylists"),
 			Peering:                          peeringAddrs,
+			PeeringDNS:                       peeringDNSAddrs,
+			PeeringDNSInterval:               cctx.Duration("peering-dns-interval"),
 			PeeringSharedCache:               cctx.Bool("peering-shared-cache"),
+			PeeringSharedCacheAll:            cctx.Bool("peering-shared-cache-all"),
+			PeeringCacheSummaryInterval:      cctx.Duration("peering-cache-summary-interval"),
 			Seed:                             seed,
 			SeedIndex:                        index,
 			SeedPeering:                      seedPeering,
 			SeedPeeringMaxIndex:              cctx.Int("seed-peering-max-index"),
+			SeedPeeringSharding:              cctx.Bool("seed-peering-sharding"),
+			SeedPeeringShardingMemory:        cctx.Int("seed-peering-sharding-memory"),
 			RemoteBackends:                   remoteBackends,
 			RemoteBackendsIPNS:               cctx.Bool("remote-backends-ipns"),
 			RemoteBackendMode:                RemoteBackendMode(cctx.String("remote-backends-mode")),
 			GCInterval:                       cctx.Duration("gc-interval"),
 			GCThreshold:                      cctx.Float64("gc-threshold"),
 			ListenAddrs:                      cctx.StringSlice("libp2p-listen-addrs"),
-			TracingAuthToken:                 cctx.String("tracing-auth"),
 			Bootstrap:                        []string{cctx.String("bootstrap")},
 
 			AutoConf: AutoConfConfig{
@@ -761,10 +1125,19 @@ share the same seed as long as the indexes are different.
 			WALMinSyncInterval:          time.Second * time.Duration(cctx.Int("pebble-wal-min-sync-interval-sec")),
 
 			// Routing ProviderQueryManager config
-			RoutingMaxRequests:     cctx.Int("routing-max-requests"),
-			RoutingMaxProviders:    cctx.Int("routing-max-providers"),
-			RoutingMaxTimeout:      cctx.Duration("routing-max-timeout"),
-			RoutingIgnoreProviders: routingIgnoreProviders,
+			RoutingMaxRequests:         cctx.Int("routing-max-requests"),
+			RoutingMaxProviders:        cctx.Int("routing-max-providers"),
+			RoutingMaxTimeout:          cctx.Duration("routing-max-timeout"),
+			BitswapProviderSearchDelay: cctx.Duration("bitswap-provider-search-delay"),
+			BitswapRebroadcastDelay:    cctx.Duration("bitswap-rebroadcast-delay"),
+			RoutingIgnoreProviders:     routingIgnoreProviders,
+			RoutingCacheTTL:            cctx.Duration("routing-cache-ttl"),
+			RoutingBenchErrorRate:      cctx.Float64("routing-bench-error-rate"),
+			RoutingBenchCooldown:       cctx.Duration("routing-bench-cooldown"),
+			RoutingPolicy:              routingPolicy,
+			RoutingStaticFile:          cctx.String("routing-static-file"),
+			ProviderReputation:         cctx.Bool("provider-reputation"),
+			ProviderReputationMinScore: cctx.Float64("provider-reputation-min-score"),
 
 			// HTTP Retrieval config
 			HTTPRetrievalEnable:                    httpRetrievalEnable,
@@ -773,14 +1146,18 @@ share the same seed as long as the indexes are different.
 			HTTPRetrievalWorkers:                   httpRetrievalWorkers,
 			HTTPRetrievalMaxDontHaveErrors:         httpRetrievalMaxDontHaveErrors,
 			HTTPRetrievalMetricsLabelsForEndpoints: httpRetrievalMetricsLabelsForEndpoints,
-			// Gateway limits
-			MaxConcurrentRequests:       cctx.Int("max-concurrent-requests"),
-			RetrievalTimeout:            cctx.Duration("retrieval-timeout"),
-			MaxRequestDuration:          cctx.Duration("max-request-duration"),
-			MaxRangeRequestFileSize:     cctx.Int64("max-range-request-file-size"),
-			MaxDeserializedResponseSize: cctx.Int64("max-deserialized-response-size"),
-			MaxUnixFSDAGResponseSize:    cctx.Int64("max-unixfs-dag-response-size"),
-			DiagnosticServiceURL:        cctx.String("diagnostic-service-url"),
+
+			ReadyMinPeers: cctx.Int("ready-min-peers"),
+		}
+
+		// The gateway domains and limits, denylists and rate limits can be
+		// reloaded at runtime.
+		if err := reloadableConfig(cctx, &cfg); err != nil {
+			return err
+		}
+
+		if err := validatePrivateNetwork(cfg); err != nil {
+			return err
 		}
 
 		// Store original values for display
@@ -848,7 +1225,7 @@ share the same seed as long as the indexes are different.
 
 		var gnd *Node
 
-		goLog.Infof("Rainbow config: %+v", cfg)
+		goLog.Infof("Rainbow config: %+v", cfg.redacted())
 
 		if libp2p {
 			gnd, err = SetupWithLibp2p(cctx.Context, cfg, priv, cdns)
@@ -861,15 +1238,42 @@ share the same seed as long as the indexes are different.
 
 		gatewayListen := cctx.String("gateway-listen-address")
 		ctlListen := cctx.String("ctl-listen-address")
+		routingListen := cctx.String("routing-listen-address")
 
-		handler, err := setupGatewayHandler(cfg, gnd)
+		backend, err := setupGatewayBackend(cfg, gnd, nil)
 		if err != nil {
 			return err
 		}
+		drain := newDrainer(cctx.Duration("drain-grace"), cctx.Duration("drain-timeout"))
+		liveness := newLiveness()
+		readiness := newReadiness(cfg, gnd, drain)
+
+		// The health checks are served on the gateway domains, so they are
+		// reloaded with them.
+		limiter := newRequestLimiter()
+		newGateway := func(cfg Config, backend gateway.IPFSBackend) http.Handler {
+			return withHealth(newGatewayHandler(cfg, backend, limiter), cfg, liveness, readiness)
+		}
+		handler := newSwapHandler(newGateway(cfg, backend))
+		rl := newReloader(cctx.Context, cctx, os.Args[1:], env, cfg, gnd, backend, handler, newGateway)
 
+		// The node is closed once the handlers of the gateway and routing
+		// servers returned.
 		gatewaySrv := &http.Server{
 			Addr:    gatewayListen,
-			Handler: handler,
+			Handler: drain.track(handler),
+		}
+
+		var routingSrv *http.Server
+		if routingListen != "" {
+			routingHandler, err := setupRoutingServerHandler(cfg, gnd, rl)
+			if err != nil {
+				return err
+			}
+			routingSrv = &http.Server{
+				Addr:    routingListen,
+				Handler: drain.track(routingHandler),
+			}
 		}
 
 		fmt.Printf("Starting %s %s\n", name, version)
@@ -894,9 +1298,24 @@ share the same seed as long as the indexes are different.
 		otel.SetTextMapPropagator(autoprop.NewTextMapPropagator())
 
 		apiMux := makeMetricsAndDebuggingHandler()
+		apiMux.HandleFunc("/healthz", healthHandler(liveness))
+		apiMux.HandleFunc("/readyz", healthHandler(readiness))
 		apiMux.HandleFunc("/mgr/gc", gcHandler(gnd))
 		apiMux.HandleFunc("/mgr/purge", purgePeerHandler(gnd.host))
 		apiMux.HandleFunc("/mgr/peers", showPeersHandler(gnd.host))
+		apiMux.HandleFunc("/mgr/peering", peeringHandler(gnd.peering))
+		apiMux.HandleFunc("/mgr/bitswap/wantlist", bitswapWantlistHandler(gnd.bitswap))
+		apiMux.HandleFunc("/mgr/bitswap/stats", bitswapStatsHandler(gnd.bitswap))
+		apiMux.HandleFunc("/mgr/bitswap/tuning", bitswapTuningHandler(gnd.tuning))
+		apiMux.HandleFunc("/mgr/prefetch", prefetchHandler(gnd.warmer))
+		apiMux.HandleFunc("/mgr/http-retrieval", httpRetrievalHandler(gnd.httpRetrieval))
+		apiMux.HandleFunc("/mgr/reload", reloadHandler(rl))
+		apiMux.HandleFunc("/mgr/drain", drainHandler(drain))
+		apiMux.HandleFunc("/mgr/routing/cache", routingCacheHandler(gnd.providerCache))
+		apiMux.HandleFunc("/mgr/routing/routers", routersStatusHandler(gnd.routersHealth))
+		apiMux.HandleFunc("/mgr/routing/findprovs", findProvidersHandler(gnd.cr))
+		apiMux.HandleFunc("/mgr/routing/findpeer", findPeerHandler(gnd.pr))
+		apiMux.HandleFunc("/mgr/routing/reputation", providerReputationHandler(gnd.reputation))
 		addLogHandlers(apiMux)
 
 		apiSrv := &http.Server{
@@ -909,14 +1328,36 @@ share the same seed as long as the indexes are different.
 			quit,
 			syscall.SIGINT,
 			syscall.SIGTERM,
-			syscall.SIGHUP,
 		)
 
+		// SIGHUP reloads the settings that can change at runtime, until the
+		// node starts draining.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		stopReloads := make(chan struct{})
+		var reloads sync.WaitGroup
+		reloads.Go(func() {
+			for {
+				select {
+				case <-stopReloads:
+					return
+				case <-hup:
+				}
+				res, err := rl.reload()
+				if err != nil {
+					goLog.Errorw("cannot reload configuration", "err", err)
+					continue
+				}
+				goLog.Infow("Reloaded configuration", "applied", res.Applied, "restartRequired", res.RestartRequired)
+			}
+		})
+
 		fmt.Printf("IPFS Gateway listening at %s\n\n", gatewayListen)
 
 		printIfListConfigured(fmt.Sprintf("  %-40s = ", "RAINBOW_GATEWAY_DOMAINS"), cfg.GatewayDomains)
 		printIfListConfigured(fmt.Sprintf("  %-40s = ", "RAINBOW_SUBDOMAIN_GATEWAY_DOMAINS"), cfg.SubdomainGatewayDomains)
 		printIfListConfigured(fmt.Sprintf("  %-40s = ", "RAINBOW_TRUSTLESS_GATEWAY_DOMAINS"), cfg.TrustlessGatewayDomains)
+		printIfListConfigured(fmt.Sprintf("  %-40s = ", "RAINBOW_GATEWAY_DOMAINS_FILE"), slices.Sorted(maps.Keys(cfg.GatewayDomainPolicies)))
 
 		// Show autoconf status
 		if cfg.AutoConf.Enabled {
@@ -935,6 +1376,9 @@ share the same seed as long as the indexes are different.
 		fmt.Printf("\n")
 		fmt.Printf("CTL endpoint listening at http://%s\n", ctlListen)
 		fmt.Printf("  Metrics: http://%s/debug/metrics/prometheus\n\n", ctlListen)
+		if routingSrv != nil {
+			fmt.Printf("Delegated routing endpoint listening at http://%s/routing/v1\n\n", routingListen)
+		}
 
 		var wg sync.WaitGroup
 
@@ -956,6 +1400,16 @@ share the same seed as long as the indexes are different.
 			}
 		})
 
+		if routingSrv != nil {
+			wg.Go(func() {
+				err := routingSrv.ListenAndServe()
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					fmt.Fprintf(os.Stderr, "Failed to start routing endpoint: %s\n", err)
+					quit <- os.Interrupt
+				}
+			})
+		}
+
 		var gcTicker *time.Timer
 		var gcTickerDone chan bool
 
@@ -979,20 +1433,41 @@ share the same seed as long as the indexes are different.
 		}
 
 		sddaemon.SdNotify(false, sddaemon.SdNotifyReady)
-		<-quit
+		select {
+		case <-quit:
+			drain.trigger()
+		case <-drain.started():
+		}
 		sddaemon.SdNotify(false, sddaemon.SdNotifyStopping)
-		goLog.Info("Closing servers...")
-		go gatewaySrv.Close()
-		go apiSrv.Close()
+		goLog.Infow("Draining requests in flight...", "grace", drain.grace.String(), "timeout", drain.timeout.String())
+		signal.Stop(hup)
+		close(stopReloads)
+		reloads.Wait()
+
+		// A second signal stops waiting for the load balancers and the
+		// requests in flight.
+		abort, drained := make(chan struct{}), make(chan struct{})
+		go func() {
+			select {
+			case <-quit:
+				close(abort)
+			case <-drained:
+			}
+		}()
+		drain.shutdown(abort, gatewaySrv, routingSrv)
+		close(drained)
 
 		if gcTicker != nil {
 			gcTicker.Stop()
 			gcTickerDone <- true
 		}
 
-		for _, sub := range gnd.denylistSubs {
-			sub.Stop()
+		rl.close()
+		goLog.Info("Closing node...")
+		if err := gnd.close(); err != nil {
+			goLog.Errorw("error closing node", "err", err)
 		}
+		_ = apiSrv.Close()
 		wg.Wait()
 		return nil
 	}
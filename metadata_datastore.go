@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+var errMetadataClosed = errors.New("metadata datastore is closed")
+
+// lazyDatastore is the leveldb datastore used to persist rainbow's own state
+// (caches, routing tables...). It is only created on disk by the first write,
+// so that nodes without any feature persisting state do not open it. Until
+// then, reads find nothing.
+type lazyDatastore struct {
+	path string
+
+	mu     sync.Mutex
+	ds     datastore.Batching
+	closed bool
+}
+
+func newLazyDatastore(path string) *lazyDatastore {
+	return &lazyDatastore{path: path}
+}
+
+// open returns the underlying datastore. When create is false and the
+// datastore does not exist on disk, it returns nil.
+func (d *lazyDatastore) open(create bool) (datastore.Batching, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, errMetadataClosed
+	}
+	if d.ds != nil {
+		return d.ds, nil
+	}
+	if !create {
+		if _, err := os.Stat(d.path); errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	ds, err := leveldb.NewDatastore(d.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	d.ds = ds
+	return ds, nil
+}
+
+func (d *lazyDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	ds, err := d.open(false)
+	if err != nil {
+		return nil, err
+	}
+	if ds == nil {
+		return nil, datastore.ErrNotFound
+	}
+	return ds.Get(ctx, key)
+}
+
+func (d *lazyDatastore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	ds, err := d.open(false)
+	if err != nil || ds == nil {
+		return false, err
+	}
+	return ds.Has(ctx, key)
+}
+
+func (d *lazyDatastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	ds, err := d.open(false)
+	if err != nil {
+		return -1, err
+	}
+	if ds == nil {
+		return -1, datastore.ErrNotFound
+	}
+	return ds.GetSize(ctx, key)
+}
+
+func (d *lazyDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	ds, err := d.open(false)
+	if err != nil {
+		return nil, err
+	}
+	if ds == nil {
+		return query.ResultsWithEntries(q, nil), nil
+	}
+	return ds.Query(ctx, q)
+}
+
+func (d *lazyDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	ds, err := d.open(true)
+	if err != nil {
+		return err
+	}
+	return ds.Put(ctx, key, value)
+}
+
+func (d *lazyDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	ds, err := d.open(false)
+	if err != nil || ds == nil {
+		return err
+	}
+	return ds.Delete(ctx, key)
+}
+
+func (d *lazyDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	ds, err := d.open(true)
+	if err != nil {
+		return nil, err
+	}
+	return ds.Batch(ctx)
+}
+
+func (d *lazyDatastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	ds, err := d.open(false)
+	if err != nil || ds == nil {
+		return err
+	}
+	return ds.Sync(ctx, prefix)
+}
+
+// Close closes the underlying datastore, if it was opened.
+func (d *lazyDatastore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.ds == nil {
+		return nil
+	}
+	return d.ds.Close()
+}
+
+var _ datastore.Batching = (*lazyDatastore)(nil)
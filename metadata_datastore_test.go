@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazyDatastore(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "metadata")
+	key := datastore.NewKey("/test")
+
+	// Reads do not create the datastore.
+	ds := newLazyDatastore(path)
+	_, err := ds.Get(ctx, key)
+	assert.ErrorIs(t, err, datastore.ErrNotFound)
+	ok, err := ds.Has(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	res, err := ds.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	require.NoError(t, ds.Delete(ctx, key))
+	require.NoError(t, ds.Close())
+	assert.NoDirExists(t, path)
+
+	// The first write creates it.
+	ds = newLazyDatastore(path)
+	require.NoError(t, ds.Put(ctx, key, []byte("value")))
+	assert.DirExists(t, path)
+	require.NoError(t, ds.Close())
+	assert.ErrorIs(t, ds.Put(ctx, key, []byte("value")), errMetadataClosed)
+
+	// Existing datastores are opened by reads.
+	ds = newLazyDatastore(path)
+	t.Cleanup(func() { _ = ds.Close() })
+	value, err := ds.Get(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, "value", string(value))
+
+	_, err = os.Stat(filepath.Join(path, "CURRENT"))
+	require.NoError(t, err)
+}
@@ -22,6 +22,19 @@ func registerVersionMetric(version string) {
 // Duration histograms  use fixed definition here, as we don't want to break existing buckets if we need to add more.
 var defaultDurationHistogramBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 120, 240, 480, 960, 1920}
 
+// mustRegisterOrGet registers c, or returns the collector that was already
+// registered in its place, so that handlers can be set up again on reload.
+func mustRegisterOrGet[T prometheus.Collector](c T) T {
+	if err := prometheus.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			panic(err)
+		}
+		return are.ExistingCollector.(T)
+	}
+	return c
+}
+
 // withHTTPMetrics collects metrics around HTTP request/response count, duration, and size
 // per specific handler. Allows us to track them separately for /ipns and /ipfs.
 func withHTTPMetrics(handler http.Handler, handlerName string, disableMetrics bool) http.Handler {
@@ -47,7 +60,7 @@ func withHTTPMetrics(handler http.Handler, handlerName string, disableMetrics bo
 			ConstLabels: opts.ConstLabels,
 		},
 	)
-	prometheus.MustRegister(reqWip)
+	reqWip = mustRegisterOrGet(reqWip)
 
 	reqCnt := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -59,22 +72,22 @@ func withHTTPMetrics(handler http.Handler, handlerName string, disableMetrics bo
 		},
 		labels,
 	)
-	prometheus.MustRegister(reqCnt)
+	reqCnt = mustRegisterOrGet(reqCnt)
 
 	opts.Name = "request_duration_seconds"
 	opts.Help = "The HTTP request latencies in seconds. "
 	reqDurHist := prometheus.NewHistogramVec(opts, labels)
-	prometheus.MustRegister(reqDurHist)
+	reqDurHist = mustRegisterOrGet(reqDurHist)
 
 	opts.Name = "request_size_bytes"
 	opts.Help = "The HTTP request sizes in bytes."
 	reqSzHist := prometheus.NewHistogramVec(opts, labels)
-	prometheus.MustRegister(reqSzHist)
+	reqSzHist = mustRegisterOrGet(reqSzHist)
 
 	opts.Name = "response_size_bytes"
 	opts.Help = "The HTTP response sizes in bytes."
 	resSzHist := prometheus.NewHistogramVec(opts, labels)
-	prometheus.MustRegister(resSzHist)
+	resSzHist = mustRegisterOrGet(resSzHist)
 
 	handler = promhttp.InstrumentHandlerInFlight(reqWip, handler)
 	handler = promhttp.InstrumentHandlerCounter(reqCnt, handler)
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/peering"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// peeringSource tells where a peered peer comes from.
+type peeringSource string
+
+const (
+	peeringSourceConfig peeringSource = "config"
+	peeringSourceSeed   peeringSource = "seed"
+	peeringSourceDNS    peeringSource = "dns"
+	peeringSourceAPI    peeringSource = "api"
+)
+
+// peeringConnectTimeout bounds the first connection to peers added at runtime.
+const peeringConnectTimeout = 30 * time.Second
+
+var (
+	errPeeringConfigured = errors.New("peer is configured at startup and cannot be changed at runtime")
+	errPeeringSelf       = errors.New("cannot peer with ourselves")
+	errPeeringNotFound   = errors.New("not peered with this peer")
+)
+
+type peeringEntry struct {
+	peer.AddrInfo
+	source peeringSource
+}
+
+// peeredPeer is a peer we stay connected to, as exposed on the ctl API.
+type peeredPeer struct {
+	ID        peer.ID
+	Addrs     []string
+	Source    peeringSource
+	Connected bool
+}
+
+// peeringManager keeps the peering service and the list of peers allowed to
+// use our cache in sync. Peers added at runtime are persisted.
+type peeringManager struct {
+	h  host.Host
+	ps *peering.PeeringService
+	ds datastore.Datastore
+
+	// ctx and wg bound the dials to the peers added at runtime.
+	ctx context.Context
+	wg  *sync.WaitGroup
+
+	// dns keeps the peers found with the --peering DNS multiaddrs.
+	dns *dnsPeering
+
+	// shareAll lets the seed peers fetch from our cache too.
+	shareAll bool
+
+	mu    sync.RWMutex
+	peers map[peer.ID]peeringEntry
+}
+
+func newPeeringManager(ctx context.Context, wg *sync.WaitGroup, h host.Host, ds datastore.Datastore) (*peeringManager, error) {
+	pm := &peeringManager{
+		h:     h,
+		ps:    peering.NewPeeringService(h),
+		ds:    namespace.Wrap(ds, datastore.NewKey("peering")),
+		ctx:   ctx,
+		wg:    wg,
+		peers: make(map[peer.ID]peeringEntry),
+	}
+	if err := pm.ps.Start(); err != nil {
+		return nil, err
+	}
+
+	res, err := pm.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var ai peer.AddrInfo
+		if err := json.Unmarshal(r.Value, &ai); err != nil {
+			goLog.Warnw("ignoring invalid peering entry", "key", r.Key, "err", err)
+			continue
+		}
+		pm.addLocked(ai, peeringSourceAPI)
+	}
+
+	return pm, nil
+}
+
+func (pm *peeringManager) addLocked(ai peer.AddrInfo, source peeringSource) {
+	pm.ps.AddPeer(ai)
+	pm.peers[ai.ID] = peeringEntry{AddrInfo: ai, source: source}
+}
+
+// addConfigured adds the peers set at startup. They are not persisted.
+func (pm *peeringManager) addConfigured(source peeringSource, peers ...peer.AddrInfo) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, ai := range peers {
+		pm.addLocked(ai, source)
+	}
+}
+
+// sync replaces the peers from source with peers, updating the addresses of
+// the ones that were already known. Peers from other sources are left alone.
+func (pm *peeringManager) sync(source peeringSource, peers []peer.AddrInfo) (added, removed []peer.ID) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	keep := make(map[peer.ID]struct{}, len(peers))
+	for _, ai := range peers {
+		if ai.ID == pm.h.ID() {
+			continue
+		}
+		p, ok := pm.peers[ai.ID]
+		if ok && p.source != source {
+			continue
+		}
+		keep[ai.ID] = struct{}{}
+		if !ok {
+			added = append(added, ai.ID)
+		}
+		pm.addLocked(ai, source)
+	}
+	for id, p := range pm.peers {
+		if _, ok := keep[id]; ok || p.source != source {
+			continue
+		}
+		pm.ps.RemovePeer(id)
+		delete(pm.peers, id)
+		removed = append(removed, id)
+	}
+	return added, removed
+}
+
+// add peers with ai at runtime, updating its addresses if it was already
+// added at runtime.
+func (pm *peeringManager) add(ctx context.Context, ai peer.AddrInfo) error {
+	if ai.ID == pm.h.ID() {
+		return errPeeringSelf
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if p, ok := pm.peers[ai.ID]; ok && p.source != peeringSourceAPI {
+		return errPeeringConfigured
+	}
+	data, err := json.Marshal(ai)
+	if err != nil {
+		return err
+	}
+	if err := pm.ds.Put(ctx, datastore.NewKey(ai.ID.String()), data); err != nil {
+		return err
+	}
+	pm.addLocked(ai, peeringSourceAPI)
+
+	// The peering service waits a few seconds before connecting, dial right
+	// away instead.
+	if len(ai.Addrs) > 0 {
+		pm.wg.Go(func() {
+			ctx, cancel := context.WithTimeout(pm.ctx, peeringConnectTimeout)
+			defer cancel()
+			if err := pm.h.Connect(ctx, ai); err != nil {
+				goLog.Debugw("cannot connect to peered peer", "peer", ai.ID, "err", err)
+			}
+		})
+	}
+	return nil
+}
+
+// remove stops peering with a peer added at runtime.
+func (pm *peeringManager) remove(ctx context.Context, id peer.ID) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	p, ok := pm.peers[id]
+	if !ok {
+		return errPeeringNotFound
+	}
+	if p.source != peeringSourceAPI {
+		return errPeeringConfigured
+	}
+	if err := pm.ds.Delete(ctx, datastore.NewKey(id.String())); err != nil {
+		return err
+	}
+	pm.ps.RemovePeer(id)
+	delete(pm.peers, id)
+	return nil
+}
+
+// list returns the peered peers, sorted by ID.
+func (pm *peeringManager) list() []peeredPeer {
+	pm.mu.RLock()
+	out := make([]peeredPeer, 0, len(pm.peers))
+	for _, p := range pm.peers {
+		pp := peeredPeer{
+			ID:        p.ID,
+			Addrs:     make([]string, 0, len(p.Addrs)),
+			Source:    p.source,
+			Connected: pm.h.Network().Connectedness(p.ID) == network.Connected,
+		}
+		for _, a := range p.Addrs {
+			pp.Addrs = append(pp.Addrs, a.String())
+		}
+		out = append(out, pp)
+	}
+	pm.mu.RUnlock()
+
+	slices.SortFunc(out, func(a, b peeredPeer) int {
+		return strings.Compare(a.ID.String(), b.ID.String())
+	})
+	return out
+}
+
+// sharesCache reports whether p may fetch blocks from our cache when
+// --peering-shared-cache is enabled: the peers set with --peering or added at
+// runtime, and the seed peers with --peering-shared-cache-all.
+func (pm *peeringManager) sharesCache(p peer.ID) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	e, ok := pm.peers[p]
+	if !ok {
+		return false
+	}
+	return pm.shareAll || e.source != peeringSourceSeed
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+const (
+	// peeringDNSTimeout bounds each resolution of the DNS peering entries.
+	peeringDNSTimeout = 30 * time.Second
+	// peeringDNSMaxDepth bounds the recursion of /dnsaddr records pointing to
+	// other DNS names.
+	peeringDNSMaxDepth = 8
+)
+
+// multiaddrResolver resolves the DNS components of a multiaddr.
+type multiaddrResolver interface {
+	Resolve(context.Context, ma.Multiaddr) ([]ma.Multiaddr, error)
+}
+
+// parsePeerings parses the --peering entries into static peers and DNS
+// multiaddrs. With a seed and an index, rainbow-seed entries are replaced with
+// the peer ID derived from the seed.
+func parsePeerings(addrs []string, seed string, index int) ([]peer.AddrInfo, []ma.Multiaddr, error) {
+	var (
+		peers    []peer.AddrInfo
+		dnsAddrs []ma.Multiaddr
+		err      error
+	)
+	for _, maStr := range addrs {
+		if len(seed) > 0 && index >= 0 {
+			maStr, err = replaceRainbowSeedWithPeer(maStr, seed)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else if rainbowSeedRegex.MatchString(maStr) {
+			return nil, nil, fmt.Errorf("unable to peer with %q without defining --seed-index of this instance first", maStr)
+		}
+
+		ai, dnsAddr, err := parsePeeringAddr(maStr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if dnsAddr != nil {
+			dnsAddrs = append(dnsAddrs, dnsAddr)
+			continue
+		}
+		peers = append(peers, *ai)
+	}
+	return peers, dnsAddrs, nil
+}
+
+// parsePeeringAddr parses a --peering entry. Entries with a DNS component are
+// returned as a multiaddr to be resolved periodically, the others as a static
+// peer.
+func parsePeeringAddr(s string) (*peer.AddrInfo, ma.Multiaddr, error) {
+	m, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !madns.Matches(m) {
+		ai, err := peer.AddrInfoFromP2pAddr(m)
+		return ai, nil, err
+	}
+	// /dnsaddr records carry the peer IDs, other names need one.
+	if _, err := m.ValueForProtocol(ma.P_DNSADDR); err != nil {
+		if _, err := m.ValueForProtocol(ma.P_P2P); err != nil {
+			return nil, nil, fmt.Errorf("peering address %q must end with /p2p/<peer-id> or use /dnsaddr/", s)
+		}
+	}
+	return nil, m, nil
+}
+
+// dnsPeering peers with the peers found by resolving DNS multiaddrs, and keeps
+// the peer set in sync as the DNS records change. Its loop runs with the
+// context and the wait group of the node, even when a reload starts it.
+type dnsPeering struct {
+	ctx      context.Context
+	wg       *sync.WaitGroup
+	pm       *peeringManager
+	rslv     multiaddrResolver
+	interval time.Duration
+
+	mu      sync.Mutex
+	addrs   []ma.Multiaddr
+	started bool
+	// kick asks the running loop to resolve the entries right away.
+	kick chan struct{}
+
+	// last holds the peers found for each entry, kept when the entry fails
+	// to resolve so that a DNS outage does not drop peers.
+	last map[string][]ma.Multiaddr
+}
+
+func newDNSPeering(ctx context.Context, wg *sync.WaitGroup, pm *peeringManager, rslv multiaddrResolver, addrs []ma.Multiaddr, interval time.Duration) *dnsPeering {
+	return &dnsPeering{
+		ctx:      ctx,
+		wg:       wg,
+		pm:       pm,
+		rslv:     rslv,
+		addrs:    addrs,
+		interval: interval,
+		kick:     make(chan struct{}, 1),
+		last:     make(map[string][]ma.Multiaddr),
+	}
+}
+
+// update replaces the entries and resolves them, starting the loop if it was
+// not running.
+func (dp *dnsPeering) update(addrs []ma.Multiaddr) {
+	dp.mu.Lock()
+	dp.addrs = addrs
+	started := dp.started
+	dp.mu.Unlock()
+
+	if !started {
+		dp.start()
+		return
+	}
+	select {
+	case dp.kick <- struct{}{}:
+	default:
+	}
+}
+
+// resolve resolves maddr until no DNS component is left.
+func (dp *dnsPeering) resolve(ctx context.Context, maddr ma.Multiaddr, depth int) ([]ma.Multiaddr, error) {
+	if !madns.Matches(maddr) {
+		return []ma.Multiaddr{maddr}, nil
+	}
+	if depth >= peeringDNSMaxDepth {
+		return nil, errors.New("too many nested DNS records")
+	}
+
+	addrs, err := dp.rslv.Resolve(ctx, maddr)
+	if err != nil {
+		return nil, err
+	}
+	var out []ma.Multiaddr
+	for _, a := range addrs {
+		resolved, err := dp.resolve(ctx, a, depth+1)
+		if err != nil {
+			goLog.Debugw("cannot resolve peering address", "addr", a, "err", err)
+			continue
+		}
+		out = append(out, resolved...)
+	}
+	return out, nil
+}
+
+// refresh resolves all the entries and updates the peering service with the
+// peers that joined or left.
+func (dp *dnsPeering) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, peeringDNSTimeout)
+	defer cancel()
+
+	dp.mu.Lock()
+	addrs := dp.addrs
+	dp.mu.Unlock()
+
+	var all []ma.Multiaddr
+	for _, m := range addrs {
+		key := m.String()
+		resolved, err := dp.resolve(ctx, m, 0)
+		if err != nil || len(resolved) == 0 {
+			goLog.Warnw("cannot resolve peering address, keeping previous peers", "addr", m, "err", err)
+			all = append(all, dp.last[key]...)
+			continue
+		}
+
+		var withID []ma.Multiaddr
+		for _, a := range resolved {
+			if _, err := a.ValueForProtocol(ma.P_P2P); err != nil {
+				goLog.Warnw("ignoring peering address without peer ID", "addr", m, "resolved", a)
+				continue
+			}
+			withID = append(withID, a)
+		}
+		dp.last[key] = withID
+		all = append(all, withID...)
+	}
+	maps.DeleteFunc(dp.last, func(key string, _ []ma.Multiaddr) bool {
+		return !slices.ContainsFunc(addrs, func(m ma.Multiaddr) bool { return m.String() == key })
+	})
+
+	ais, err := peer.AddrInfosFromP2pAddrs(all...)
+	if err != nil {
+		goLog.Warnw("invalid resolved peering addresses", "err", err)
+		return
+	}
+	added, removed := dp.pm.sync(peeringSourceDNS, ais)
+	for _, id := range added {
+		goLog.Infow("peer joined DNS peering", "peer", id)
+	}
+	for _, id := range removed {
+		goLog.Infow("peer left DNS peering", "peer", id)
+	}
+}
+
+// start resolves the entries right away, then every interval and on update
+// until the node is closed. With a zero interval, they are only resolved again
+// on update.
+func (dp *dnsPeering) start() {
+	dp.mu.Lock()
+	dp.started = true
+	dp.mu.Unlock()
+
+	ctx := dp.ctx
+	dp.wg.Go(func() {
+		dp.refresh(ctx)
+
+		var tick <-chan time.Time
+		if dp.interval > 0 {
+			ticker := time.NewTicker(dp.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				dp.refresh(ctx)
+			case <-dp.kick:
+				dp.refresh(ctx)
+			}
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMultiaddrResolver struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (r *fakeMultiaddrResolver) set(name string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[name] = addrs
+}
+
+func (r *fakeMultiaddrResolver) Resolve(_ context.Context, m ma.Multiaddr) ([]ma.Multiaddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs, ok := r.records[m.String()]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	out := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, ma.StringCast(a))
+	}
+	return out, nil
+}
+
+func TestParsePeeringAddr(t *testing.T) {
+	t.Parallel()
+
+	pid := test.RandPeerIDFatal(t).String()
+	for _, tc := range []struct {
+		addr string
+		dns  bool
+		err  bool
+	}{
+		{addr: "/ip4/127.0.0.1/tcp/4001/p2p/" + pid},
+		{addr: "/dnsaddr/cache.example.com", dns: true},
+		{addr: "/dnsaddr/cache.example.com/p2p/" + pid, dns: true},
+		{addr: "/dns4/cache.example.com/tcp/4001/p2p/" + pid, dns: true},
+		{addr: "/dns4/cache.example.com/tcp/4001", err: true},
+		{addr: "/ip4/127.0.0.1/tcp/4001", err: true},
+		{addr: "not a multiaddr", err: true},
+	} {
+		ai, m, err := parsePeeringAddr(tc.addr)
+		if tc.err {
+			require.Error(t, err, tc.addr)
+			continue
+		}
+		require.NoError(t, err, tc.addr)
+		if tc.dns {
+			require.Nil(t, ai, tc.addr)
+			require.Equal(t, tc.addr, m.String())
+		} else {
+			require.Nil(t, m, tc.addr)
+			require.Equal(t, pid, ai.ID.String())
+		}
+	}
+}
+
+func TestDNSPeering(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	defer h.Close()
+	pm, err := newPeeringManager(ctx, &sync.WaitGroup{}, h, dssync.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, err)
+
+	p1, p2, p3 := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	pm.addConfigured(peeringSourceConfig, peer.AddrInfo{ID: p3})
+
+	rslv := &fakeMultiaddrResolver{records: make(map[string][]string)}
+	rslv.set("/dnsaddr/cache.example.com",
+		"/dns4/node1.example.com/tcp/4001/p2p/"+p1.String(),
+		"/ip4/10.0.0.2/tcp/4001/p2p/"+p2.String(),
+		// Peers that are already configured are left alone.
+		"/ip4/10.0.0.3/tcp/4001/p2p/"+p3.String(),
+	)
+	rslv.set("/dns4/node1.example.com/tcp/4001/p2p/"+p1.String(), "/ip4/10.0.0.1/tcp/4001/p2p/"+p1.String())
+
+	sources := func() map[peer.ID]peeringSource {
+		out := make(map[peer.ID]peeringSource)
+		for _, p := range pm.list() {
+			out[p.ID] = p.Source
+		}
+		return out
+	}
+
+	dp := newDNSPeering(ctx, &sync.WaitGroup{}, pm, rslv, []ma.Multiaddr{ma.StringCast("/dnsaddr/cache.example.com")}, 0)
+	dp.refresh(ctx)
+	require.Equal(t, map[peer.ID]peeringSource{
+		p1: peeringSourceDNS,
+		p2: peeringSourceDNS,
+		p3: peeringSourceConfig,
+	}, sources())
+	require.True(t, pm.sharesCache(p1))
+
+	// Nested names are resolved to IP addresses.
+	for _, p := range pm.list() {
+		if p.ID == p1 {
+			require.Equal(t, []string{"/ip4/10.0.0.1/tcp/4001"}, p.Addrs)
+		}
+	}
+
+	// Peers are dropped when they leave the DNS records.
+	rslv.set("/dnsaddr/cache.example.com", "/ip4/10.0.0.2/tcp/4001/p2p/"+p2.String())
+	dp.refresh(ctx)
+	require.Equal(t, map[peer.ID]peeringSource{
+		p2: peeringSourceDNS,
+		p3: peeringSourceConfig,
+	}, sources())
+
+	// DNS failures keep the previous peers.
+	rslv.mu.Lock()
+	delete(rslv.records, "/dnsaddr/cache.example.com")
+	rslv.mu.Unlock()
+	dp.refresh(ctx)
+	require.Contains(t, sources(), p2)
+}
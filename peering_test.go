@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeeringHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	newHost := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	h, configured, seed, remote := newHost(), newHost(), newHost(), newHost()
+
+	var wg sync.WaitGroup
+	newManager := func() *peeringManager {
+		pm, err := newPeeringManager(ctx, &wg, h, ds)
+		require.NoError(t, err)
+		pm.shareAll = true
+		pm.addConfigured(peeringSourceConfig, peer.AddrInfo{ID: configured.ID(), Addrs: configured.Addrs()})
+		pm.addConfigured(peeringSourceSeed, peer.AddrInfo{ID: seed.ID()})
+		return pm
+	}
+	pm := newManager()
+
+	do := func(method, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		peeringHandler(pm)(rec, httptest.NewRequest(method, "/mgr/peering?"+query, nil))
+		return rec
+	}
+	list := func() map[peer.ID]peeredPeer {
+		rec := do(http.MethodGet, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var body struct {
+			Count int
+			Peers []peeredPeer
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		require.Len(t, body.Peers, body.Count)
+		peers := make(map[peer.ID]peeredPeer, body.Count)
+		for _, p := range body.Peers {
+			peers[p.ID] = p
+		}
+		return peers
+	}
+
+	require.False(t, pm.sharesCache(remote.ID()))
+
+	// Peers are added at runtime from their multiaddrs, and connected to.
+	addr := remote.Addrs()[0].String() + "/p2p/" + remote.ID().String()
+	rec := do(http.MethodPost, "addr="+addr)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.True(t, pm.sharesCache(remote.ID()))
+	require.Eventually(t, func() bool {
+		return h.Network().Connectedness(remote.ID()) == network.Connected
+	}, 10*time.Second, 50*time.Millisecond)
+	// The dial is waited for when the node is closed.
+	wg.Wait()
+
+	peers := list()
+	require.Len(t, peers, 3)
+	require.Equal(t, peeringSourceAPI, peers[remote.ID()].Source)
+	require.True(t, peers[remote.ID()].Connected)
+	require.Equal(t, peeringSourceConfig, peers[configured.ID()].Source)
+	require.Equal(t, peeringSourceSeed, peers[seed.ID()].Source)
+
+	// Peers set at startup cannot be changed.
+	require.Equal(t, http.StatusConflict, do(http.MethodPost, "peer="+configured.ID().String()).Code)
+	require.Equal(t, http.StatusConflict, do(http.MethodDelete, "peer="+seed.ID().String()).Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "peer="+h.ID().String()).Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "addr=/ip4/127.0.0.1/tcp/1").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPut, "").Code)
+	require.True(t, pm.sharesCache(configured.ID()))
+	require.True(t, pm.sharesCache(seed.ID()))
+
+	// Without --peering-shared-cache-all, the seed peers do not share the
+	// cache.
+	pm.shareAll = false
+	require.True(t, pm.sharesCache(configured.ID()))
+	require.False(t, pm.sharesCache(seed.ID()))
+	require.True(t, pm.sharesCache(remote.ID()))
+
+	// Peers added at runtime are persisted.
+	pm = newManager()
+	peers = list()
+	require.Len(t, peers, 3)
+	require.Equal(t, []string{remote.Addrs()[0].String()}, peers[remote.ID()].Addrs)
+	require.True(t, pm.sharesCache(remote.ID()))
+
+	rec = do(http.MethodDelete, "peer="+remote.ID().String())
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.False(t, pm.sharesCache(remote.ID()))
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "peer="+remote.ID().String()).Code)
+
+	pm = newManager()
+	require.Len(t, list(), 2)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// prefetchWindow is the maximum number of blocks fetched at every level
+	// of a prefetch walk.
+	prefetchWindow = 64
+	// prefetchTracked bounds the number of CIDs remembered by the
+	// prefetcher, to skip the blocks already prefetched and to find the
+	// upcoming siblings of a block.
+	prefetchTracked = 1 << 16
+)
+
+var (
+	prefetchedBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "prefetch_blocks_total",
+		Help:      "Number of blocks fetched ahead of UnixFS reads.",
+	})
+	prefetchSkippedWalks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "prefetch_skipped_walks_total",
+		Help:      "Number of prefetch walks not started because the maximum number of concurrent walks was reached.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(prefetchedBlocks, prefetchSkippedWalks)
+}
+
+// prefetchSiblings locates a block among the links of its parent.
+type prefetchSiblings struct {
+	links []cid.Cid
+	index int
+}
+
+// dagPrefetcher fetches the blocks of UnixFS DAGs ahead of the reader. When a
+// file, directory or HAMT shard node is read, its children and its upcoming
+// siblings are fetched in the background, down to depth levels, so that the
+// reader finds them in the blockstore instead of waiting on a Bitswap
+// round-trip for every block. Walks run in wg and stop when the client
+// disconnects or ctx is cancelled.
+type dagPrefetcher struct {
+	blockservice.BlockService
+	ctx   context.Context
+	wg    *sync.WaitGroup
+	depth int
+	walks chan struct{}
+
+	// seen holds the CIDs already prefetched or being prefetched. It is
+	// cleared by GC.
+	seen     *lru.Cache[cid.Cid, struct{}]
+	siblings *lru.Cache[cid.Cid, prefetchSiblings]
+}
+
+func newDAGPrefetcher(ctx context.Context, wg *sync.WaitGroup, bs blockservice.BlockService, depth, concurrency int) *dagPrefetcher {
+	seen, _ := lru.New[cid.Cid, struct{}](prefetchTracked)
+	siblings, _ := lru.New[cid.Cid, prefetchSiblings](prefetchTracked)
+	return &dagPrefetcher{
+		BlockService: bs,
+		ctx:          ctx,
+		wg:           wg,
+		depth:        depth,
+		walks:        make(chan struct{}, concurrency),
+		seen:         seen,
+		siblings:     siblings,
+	}
+}
+
+func (p *dagPrefetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	b, err := p.BlockService.GetBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	p.read(ctx, b)
+	return b, nil
+}
+
+func (p *dagPrefetcher) GetBlocks(ctx context.Context, cids []cid.Cid) <-chan blocks.Block {
+	in := p.BlockService.GetBlocks(ctx, cids)
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for b := range in {
+			p.read(ctx, b)
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// links returns the links of b if it is a UnixFS node worth prefetching, and
+// remembers the position of every link among its siblings.
+func (p *dagPrefetcher) links(b blocks.Block) []cid.Cid {
+	if b.Cid().Type() != cid.DagProtobuf {
+		return nil
+	}
+	nd, err := merkledag.DecodeProtobufBlock(b)
+	if err != nil {
+		return nil
+	}
+	pn, ok := nd.(*merkledag.ProtoNode)
+	if !ok || len(pn.Links()) == 0 {
+		return nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return nil
+	}
+	switch fsn.Type() {
+	case unixfs.TFile, unixfs.TDirectory, unixfs.THAMTShard:
+	default:
+		return nil
+	}
+
+	links := make([]cid.Cid, len(pn.Links()))
+	for i, l := range pn.Links() {
+		links[i] = l.Cid
+		p.siblings.Add(l.Cid, prefetchSiblings{links: links, index: i})
+	}
+	return links
+}
+
+// read starts prefetching the children and the next prefetchWindow siblings
+// of b, so that prefetching never gets too far ahead of the reader.
+func (p *dagPrefetcher) read(ctx context.Context, b blocks.Block) {
+	links := p.links(b)
+	if s, ok := p.siblings.Get(b.Cid()); ok {
+		upcoming := s.links[s.index+1:]
+		links = append(links, upcoming[:min(len(upcoming), prefetchWindow)]...)
+	}
+	if ctx.Err() != nil || p.ctx.Err() != nil || !slices.ContainsFunc(links, func(c cid.Cid) bool { return !p.seen.Contains(c) }) {
+		return
+	}
+
+	select {
+	case p.walks <- struct{}{}:
+	default:
+		prefetchSkippedWalks.Inc()
+		return
+	}
+	// The walk keeps the values of the read, and stops with the read or
+	// when the node is closed.
+	walkCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stopRead := context.AfterFunc(ctx, cancel)
+	stopNode := context.AfterFunc(p.ctx, cancel)
+	p.wg.Go(func() {
+		defer func() {
+			stopRead()
+			stopNode()
+			cancel()
+			<-p.walks
+		}()
+		p.walk(walkCtx, links)
+	})
+}
+
+// forget clears the CIDs already prefetched, so that they are prefetched
+// again once garbage collection removed them from the blockstore.
+func (p *dagPrefetcher) forget() {
+	p.seen.Purge()
+}
+
+// walk fetches up to prefetchWindow of the given blocks, then their links, down
+// to depth levels, skipping the blocks already prefetched.
+func (p *dagPrefetcher) walk(ctx context.Context, level []cid.Cid) {
+	for range p.depth {
+		todo := make([]cid.Cid, 0, prefetchWindow)
+		for _, c := range level {
+			if len(todo) == prefetchWindow {
+				break
+			}
+			if seen, _ := p.seen.ContainsOrAdd(c, struct{}{}); !seen {
+				todo = append(todo, c)
+			}
+		}
+		if len(todo) == 0 {
+			return
+		}
+
+		// Blocks come back in any order: keep the links in DAG order.
+		children := make(map[cid.Cid][]cid.Cid, len(todo))
+		for b := range p.BlockService.GetBlocks(ctx, todo) {
+			prefetchedBlocks.Inc()
+			children[b.Cid()] = p.links(b)
+		}
+		if ctx.Err() != nil {
+			// Let the blocks that were not fetched be prefetched again.
+			for _, c := range todo {
+				if _, ok := children[c]; !ok {
+					p.seen.Remove(c)
+				}
+			}
+			return
+		}
+
+		level = level[:0:0]
+		for _, c := range todo {
+			level = append(level, children[c]...)
+		}
+	}
+}
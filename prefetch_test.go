@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+// blockstoreExchange serves the blocks of a blockstore, or blocks until the
+// request is cancelled when hold is set.
+type blockstoreExchange struct {
+	bs   blockstore.Blockstore
+	hold bool
+}
+
+func (e *blockstoreExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if e.hold {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return e.bs.Get(ctx, c)
+}
+
+func (e *blockstoreExchange) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			b, err := e.GetBlock(ctx, c)
+			if err != nil {
+				return
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (e *blockstoreExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error { return nil }
+
+func (e *blockstoreExchange) Close() error { return nil }
+
+func TestDAGPrefetcher(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	newBlockstore := func() blockstore.Blockstore {
+		return blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	}
+
+	// A file of 64 leaves, with 4 links per node: the root links to 4 nodes,
+	// which link to 16 nodes, which link to the leaves.
+	src := newBlockstore()
+	dserv := merkledag.NewDAGService(blockservice.New(src, offline.Exchange(src)))
+	var data bytes.Buffer
+	for i := range 64 {
+		data.WriteString(strconv.Itoa(1000 + i))
+	}
+	db, err := (&helpers.DagBuilderParams{
+		Dagserv:   dserv,
+		Maxlinks:  4,
+		RawLeaves: true,
+	}).New(chunker.NewSizeSplitter(&data, 4))
+	require.NoError(t, err)
+	root, err := balanced.Layout(db)
+	require.NoError(t, err)
+
+	var level1, level2, leaves []cid.Cid
+	for _, l := range root.Links() {
+		level1 = append(level1, l.Cid)
+		nd, err := dserv.Get(ctx, l.Cid)
+		require.NoError(t, err)
+		for _, l := range nd.Links() {
+			level2 = append(level2, l.Cid)
+			nd, err := dserv.Get(ctx, l.Cid)
+			require.NoError(t, err)
+			for _, l := range nd.Links() {
+				leaves = append(leaves, l.Cid)
+			}
+		}
+	}
+	require.Len(t, level2, 16)
+	require.Len(t, leaves, 64)
+
+	has := func(bs blockstore.Blockstore, cids []cid.Cid) (n int) {
+		for _, c := range cids {
+			ok, err := bs.Has(ctx, c)
+			require.NoError(t, err)
+			if ok {
+				n++
+			}
+		}
+		return n
+	}
+	idle := func(p *dagPrefetcher) func() bool {
+		return func() bool { return len(p.walks) == 0 }
+	}
+
+	local := newBlockstore()
+	p := newDAGPrefetcher(ctx, &sync.WaitGroup{}, blockservice.New(local, &blockstoreExchange{bs: src}), 2, 4)
+
+	// Reading the root fetches two levels of the DAG.
+	_, err = p.GetBlock(ctx, root.Cid())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return has(local, level1) == len(level1) && has(local, level2) == len(level2)
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Eventually(t, idle(p), 10*time.Second, 10*time.Millisecond)
+	require.Zero(t, has(local, leaves))
+
+	// Reading a node fetches its children, the siblings were already fetched.
+	_, err = p.GetBlock(ctx, level2[0])
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return has(local, leaves[:4]) == 4
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Eventually(t, idle(p), 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, 4, has(local, leaves))
+
+	// Reading a leaf fetches its upcoming siblings.
+	_, err = p.GetBlock(ctx, leaves[4])
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return has(local, leaves[5:8]) == 3
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Blocks removed by GC are prefetched again once forgotten.
+	require.Eventually(t, idle(p), 10*time.Second, 10*time.Millisecond)
+	for _, c := range level1 {
+		require.NoError(t, local.DeleteBlock(ctx, c))
+	}
+	p.forget()
+	_, err = p.GetBlock(ctx, root.Cid())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return has(local, level1) == len(level1)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Prefetching stops when the reader goes away.
+	local = newBlockstore()
+	rootBlk, err := src.Get(ctx, root.Cid())
+	require.NoError(t, err)
+	require.NoError(t, local.Put(ctx, rootBlk))
+	var wg sync.WaitGroup
+	nodeCtx, closeNode := context.WithCancel(ctx)
+	p = newDAGPrefetcher(nodeCtx, &wg, blockservice.New(local, &blockstoreExchange{bs: src, hold: true}), 2, 1)
+	readCtx, cancel := context.WithCancel(ctx)
+	_, err = p.GetBlock(readCtx, root.Cid())
+	require.NoError(t, err)
+	require.Len(t, p.walks, 1)
+
+	// The blocks being prefetched are not prefetched twice.
+	_, err = p.GetBlock(ctx, root.Cid())
+	require.NoError(t, err)
+	require.Len(t, p.walks, 1)
+
+	cancel()
+	require.Eventually(t, idle(p), 10*time.Second, 10*time.Millisecond)
+	require.Zero(t, has(local, level1))
+	require.False(t, p.seen.Contains(level1[0]))
+
+	// Closing the node stops the walks, which are waited for.
+	_, err = p.GetBlock(ctx, root.Cid())
+	require.NoError(t, err)
+	require.Len(t, p.walks, 1)
+	closeNode()
+	wg.Wait()
+	require.Empty(t, p.walks)
+}
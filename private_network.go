@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/ipfs/boxo/autoconf"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+)
+
+// privateNetworkListenAddrs are the default listen addresses in a private
+// network, where only TCP-based transports are available.
+var privateNetworkListenAddrs = []string{
+	"/ip4/0.0.0.0/tcp/4001",
+	"/ip6/::/tcp/4001",
+}
+
+// loadSwarmKey reads a libp2p pre-shared key in the swarm.key format used by
+// Kubo.
+func loadSwarmKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading swarm key %q: %w", path, err)
+	}
+	return psk, nil
+}
+
+// redacted returns a copy of cfg without the swarm key, which is a secret
+// shared by the members of the private network, so that it can be logged.
+func (cfg Config) redacted() Config {
+	cfg.SwarmKey = nil
+	return cfg
+}
+
+// dhtProtocolPrefix returns the protocol prefix of the DHTs run by rainbow.
+func dhtProtocolPrefix(cfg Config) protocol.ID {
+	if cfg.DHTProtocolPrefix == "" {
+		return dht.DefaultPrefix
+	}
+	return cfg.DHTProtocolPrefix
+}
+
+// isPrivateNetwork reports whether rainbow is configured to join a network
+// other than the public IPFS network.
+func isPrivateNetwork(cfg Config) bool {
+	return len(cfg.SwarmKey) > 0 || dhtProtocolPrefix(cfg) != dht.DefaultPrefix
+}
+
+// dhtRoutingTableFilter returns the filter for the peers of the DHT routing
+// table: peers on private addresses are only kept in a private network.
+func dhtRoutingTableFilter(cfg Config) dht.RouteTableFilterFunc {
+	if isPrivateNetwork(cfg) {
+		return dht.PrivateRoutingTableFilter
+	}
+	return dht.PublicRoutingTableFilter
+}
+
+// validatePrivateNetwork rejects the settings that only make sense on the
+// public IPFS network when a private network is configured. It must run
+// before autoconf placeholders are expanded.
+func validatePrivateNetwork(cfg Config) error {
+	if !isPrivateNetwork(cfg) {
+		return nil
+	}
+
+	if cfg.AutoConf.Enabled {
+		return errors.New("autoconf provides public network settings and cannot be used in a private network: set RAINBOW_AUTOCONF=false")
+	}
+	if slices.Contains(cfg.Bootstrap, autoconf.AutoPlaceholder) {
+		return errors.New("the public bootstrap peers cannot be used in a private network: set RAINBOW_BOOTSTRAP to peers of the private network")
+	}
+	if slices.Contains(cfg.RoutingV1Endpoints, autoconf.AutoPlaceholder) {
+		return errors.New("the public HTTP routers cannot be used in a private network: set RAINBOW_HTTP_ROUTERS to routers of the private network, or to an empty value")
+	}
+	if cfg.SeedPeering && !slices.ContainsFunc(cfg.Bootstrap, func(s string) bool { return s != "" }) {
+		return errors.New("seed peering falls back to the public bootstrap peers: set RAINBOW_BOOTSTRAP to peers of the private network")
+	}
+	return nil
+}
+
+// transportOptions returns the libp2p transport options for every host run
+// by rainbow. Pre-shared keys are only supported by TCP-based transports.
+func transportOptions(cfg Config) []libp2p.Option {
+	if len(cfg.SwarmKey) == 0 {
+		return []libp2p.Option{libp2p.DefaultTransports}
+	}
+	return []libp2p.Option{
+		libp2p.PrivateNetwork(cfg.SwarmKey),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(websocket.New),
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/autoconf"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/stretchr/testify/require"
+)
+
+func mustTestSwarmKey(t *testing.T) (string, pnet.PSK) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "swarm.key")
+	content := "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key) + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader([]byte(content)))
+	require.NoError(t, err)
+	return path, psk
+}
+
+func TestValidatePrivateNetwork(t *testing.T) {
+	t.Parallel()
+
+	_, psk := mustTestSwarmKey(t)
+	bootstrap := []string{"/ip4/10.0.0.1/tcp/4001/p2p/12D3KooWRBy97UB99e3J6hiPesre1MZeuNQvfan4gBziswrRJsNK"}
+
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		err  string
+	}{
+		{
+			name: "public network",
+			cfg: Config{
+				AutoConf:  AutoConfConfig{Enabled: true},
+				Bootstrap: []string{autoconf.AutoPlaceholder},
+			},
+		},
+		{
+			name: "autoconf",
+			cfg:  Config{SwarmKey: psk, AutoConf: AutoConfConfig{Enabled: true}},
+			err:  "RAINBOW_AUTOCONF=false",
+		},
+		{
+			name: "auto bootstrap",
+			cfg:  Config{DHTProtocolPrefix: "/private", Bootstrap: []string{autoconf.AutoPlaceholder}},
+			err:  "RAINBOW_BOOTSTRAP",
+		},
+		{
+			name: "auto http routers",
+			cfg:  Config{SwarmKey: psk, Bootstrap: bootstrap, RoutingV1Endpoints: []string{autoconf.AutoPlaceholder}},
+			err:  "RAINBOW_HTTP_ROUTERS",
+		},
+		{
+			name: "seed peering without bootstrap",
+			cfg:  Config{SwarmKey: psk, Bootstrap: []string{""}, SeedPeering: true},
+			err:  "seed peering",
+		},
+		{
+			name: "valid",
+			cfg:  Config{SwarmKey: psk, DHTProtocolPrefix: "/private", Bootstrap: bootstrap, SeedPeering: true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePrivateNetwork(tc.cfg)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestPrivateNetworkTransports(t *testing.T) {
+	t.Parallel()
+
+	path, _ := mustTestSwarmKey(t)
+	psk, err := loadSwarmKey(path)
+	require.NoError(t, err)
+	_, otherPSK := mustTestSwarmKey(t)
+
+	newHost := func(cfg Config) peer.AddrInfo {
+		opts := append([]libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")}, transportOptions(cfg)...)
+		h, err := libp2p.New(opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { h.Close() })
+		return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+	}
+
+	opts := append([]libp2p.Option{libp2p.NoListenAddrs}, transportOptions(Config{SwarmKey: psk})...)
+	h, err := libp2p.New(opts...)
+	require.NoError(t, err)
+	defer h.Close()
+
+	ctx := t.Context()
+	require.NoError(t, h.Connect(ctx, newHost(Config{SwarmKey: psk})))
+	require.Error(t, h.Connect(ctx, newHost(Config{SwarmKey: otherPSK})))
+	require.Error(t, h.Connect(ctx, newHost(Config{})))
+}
+
+func TestConfigRedacted(t *testing.T) {
+	t.Parallel()
+
+	_, psk := mustTestSwarmKey(t)
+	cfg := Config{SwarmKey: psk}
+	logged := fmt.Sprintf("%+v", cfg.redacted())
+	require.NotContains(t, logged, fmt.Sprint([]byte(psk)))
+	require.Equal(t, psk, cfg.SwarmKey)
+}
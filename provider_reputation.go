@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	pb "github.com/ipfs/boxo/bitswap/message/pb"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// reputationWantTimeout is how long a provider has to answer a
+	// want-block before it counts as a timeout.
+	reputationWantTimeout = 30 * time.Second
+	// reputationMinSamples is the number of outcomes needed before a
+	// provider can be filtered out.
+	reputationMinSamples = 10
+	// reputationDecayInterval is how often all counters are halved, so that
+	// old behaviour weighs less and filtered providers get another chance.
+	reputationDecayInterval = time.Hour
+	// reputationSaveInterval is how often changed scores are persisted.
+	reputationSaveInterval = time.Minute
+	// reputationMaxPending bounds the want-blocks tracked per provider.
+	reputationMaxPending = 1024
+)
+
+var reputationFilteredProviders = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ipfs",
+	Subsystem: "rainbow",
+	Name:      "provider_reputation_filtered_total",
+	Help:      "Number of providers skipped because of a low reputation score.",
+})
+
+func init() {
+	prometheus.MustRegister(reputationFilteredProviders)
+}
+
+// providerStats are the outcomes of the want-blocks sent to a provider, over
+// Bitswap or HTTP retrieval. Counters decay over time.
+type providerStats struct {
+	Blocks         float64
+	Bytes          float64
+	DontHaves      float64
+	Timeouts       float64
+	BytesPerSecond float64
+	LastSeen       time.Time
+}
+
+func (s *providerStats) samples() float64 {
+	return s.Blocks + s.DontHaves + s.Timeouts
+}
+
+// score is the share of want-blocks answered with a block.
+func (s *providerStats) score() float64 {
+	n := s.samples()
+	if n == 0 {
+		return 1
+	}
+	return s.Blocks / n
+}
+
+// providerReputation tracks how well providers deliver the blocks they are
+// asked for, and filters out the ones that do not.
+type providerReputation struct {
+	ds       datastore.Batching
+	minScore float64
+
+	mu      sync.Mutex
+	peers   map[peer.ID]*providerStats
+	pending map[peer.ID]map[cid.Cid]time.Time
+	dirty   map[peer.ID]struct{}
+}
+
+func newProviderReputation(ctx context.Context, ds datastore.Batching, minScore float64) (*providerReputation, error) {
+	rep := &providerReputation{
+		ds:       namespace.Wrap(ds, datastore.NewKey("provider-reputation")),
+		minScore: minScore,
+		peers:    make(map[peer.ID]*providerStats),
+		pending:  make(map[peer.ID]map[cid.Cid]time.Time),
+		dirty:    make(map[peer.ID]struct{}),
+	}
+
+	res, err := rep.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		p, err := peer.Decode(datastore.NewKey(r.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		var st providerStats
+		if err := json.Unmarshal(r.Value, &st); err != nil {
+			continue
+		}
+		rep.peers[p] = &st
+	}
+
+	return rep, nil
+}
+
+func (rep *providerReputation) statsLocked(p peer.ID) *providerStats {
+	st, ok := rep.peers[p]
+	if !ok {
+		st = &providerStats{}
+		rep.peers[p] = st
+	}
+	st.LastSeen = time.Now()
+	rep.dirty[p] = struct{}{}
+	return st
+}
+
+// sent records the want-blocks and cancels of a message sent to p.
+func (rep *providerReputation) sent(p peer.ID, msg bsmsg.BitSwapMessage) {
+	entries := msg.Wantlist()
+	if len(entries) == 0 {
+		return
+	}
+
+	now := time.Now()
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	pending := rep.pending[p]
+	for _, e := range entries {
+		if e.Cancel {
+			delete(pending, e.Cid)
+			continue
+		}
+		if e.WantType != pb.Message_Wantlist_Block {
+			continue
+		}
+		if pending == nil {
+			pending = make(map[cid.Cid]time.Time)
+			rep.pending[p] = pending
+		}
+		if _, ok := pending[e.Cid]; !ok && len(pending) < reputationMaxPending {
+			pending[e.Cid] = now
+		}
+	}
+}
+
+// received records the blocks and DONT_HAVEs of a message received from p.
+func (rep *providerReputation) received(p peer.ID, msg bsmsg.BitSwapMessage) {
+	blks := msg.Blocks()
+	dontHaves := msg.DontHaves()
+	if len(blks) == 0 && len(dontHaves) == 0 {
+		return
+	}
+
+	now := time.Now()
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	st := rep.statsLocked(p)
+	pending := rep.pending[p]
+	for _, b := range blks {
+		size := float64(len(b.RawData()))
+		st.Blocks++
+		st.Bytes += size
+		if sentAt, ok := pending[b.Cid()]; ok {
+			delete(pending, b.Cid())
+			if elapsed := now.Sub(sentAt).Seconds(); elapsed > 0 {
+				bps := size / elapsed
+				if st.BytesPerSecond == 0 {
+					st.BytesPerSecond = bps
+				} else {
+					st.BytesPerSecond = 0.8*st.BytesPerSecond + 0.2*bps
+				}
+			}
+		}
+	}
+	for _, c := range dontHaves {
+		if _, ok := pending[c]; ok {
+			delete(pending, c)
+			st.DontHaves++
+		}
+	}
+}
+
+// sweep counts the want-blocks that have not been answered in time as
+// timeouts.
+func (rep *providerReputation) sweep(now time.Time) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	for p, pending := range rep.pending {
+		var timeouts int
+		for c, sentAt := range pending {
+			if now.Sub(sentAt) > reputationWantTimeout {
+				delete(pending, c)
+				timeouts++
+			}
+		}
+		if timeouts > 0 {
+			rep.statsLocked(p).Timeouts += float64(timeouts)
+		}
+		if len(pending) == 0 {
+			delete(rep.pending, p)
+		}
+	}
+}
+
+// decay halves all counters and forgets providers with no samples left.
+func (rep *providerReputation) decay() {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+
+	for p, st := range rep.peers {
+		st.Blocks /= 2
+		st.Bytes /= 2
+		st.DontHaves /= 2
+		st.Timeouts /= 2
+		if st.samples() < 1 {
+			delete(rep.peers, p)
+		}
+		rep.dirty[p] = struct{}{}
+	}
+}
+
+// save persists the scores that changed since the last save.
+func (rep *providerReputation) save(ctx context.Context) error {
+	rep.mu.Lock()
+	records := make(map[peer.ID][]byte, len(rep.dirty))
+	for p := range rep.dirty {
+		var data []byte
+		if st, ok := rep.peers[p]; ok {
+			var err error
+			data, err = json.Marshal(st)
+			if err != nil {
+				rep.mu.Unlock()
+				return err
+			}
+		}
+		records[p] = data
+	}
+	clear(rep.dirty)
+	rep.mu.Unlock()
+
+	b, err := rep.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for p, data := range records {
+		k := datastore.NewKey(p.String())
+		if data == nil {
+			err = b.Delete(ctx, k)
+		} else {
+			err = b.Put(ctx, k, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Commit(ctx)
+}
+
+// start runs the timeout sweeps, decay and persistence until ctx is
+// cancelled, when the scores are saved one last time. The goroutine is added
+// to wg.
+func (rep *providerReputation) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		sweep := time.NewTicker(reputationWantTimeout / 6)
+		defer sweep.Stop()
+		save := time.NewTicker(reputationSaveInterval)
+		defer save.Stop()
+		decay := time.NewTicker(reputationDecayInterval)
+		defer decay.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				if err := rep.save(context.Background()); err != nil {
+					goLog.Warnw("error saving provider reputation", "err", err)
+				}
+				return
+			case now := <-sweep.C:
+				rep.sweep(now)
+			case <-decay.C:
+				rep.decay()
+			case <-save.C:
+				if err := rep.save(ctx); err != nil {
+					goLog.Warnw("error saving provider reputation", "err", err)
+				}
+			}
+		}
+	})
+}
+
+// allowed reports whether p may be used as a provider.
+func (rep *providerReputation) allowed(p peer.ID) bool {
+	if rep.minScore <= 0 {
+		return true
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	st, ok := rep.peers[p]
+	return !ok || st.samples() < reputationMinSamples || st.score() >= rep.minScore
+}
+
+// providerScore is the reputation of a provider as exposed on the ctl API.
+type providerScore struct {
+	ID    peer.ID
+	Score float64
+	providerStats
+}
+
+// scores returns the reputation of every known provider, best first.
+func (rep *providerReputation) scores() []providerScore {
+	rep.mu.Lock()
+	out := make([]providerScore, 0, len(rep.peers))
+	for p, st := range rep.peers {
+		out = append(out, providerScore{ID: p, Score: st.score(), providerStats: *st})
+	}
+	rep.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b providerScore) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		case a.BytesPerSecond > b.BytesPerSecond:
+			return -1
+		case a.BytesPerSecond < b.BytesPerSecond:
+			return 1
+		}
+		return 0
+	})
+	return out
+}
+
+// reset forgets the reputation of p, or of every provider if p is empty. It
+// returns the number of providers forgotten.
+func (rep *providerReputation) reset(p peer.ID) int {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	var n int
+	for id := range rep.peers {
+		if p == "" || id == p {
+			delete(rep.peers, id)
+			rep.dirty[id] = struct{}{}
+			n++
+		}
+	}
+	return n
+}
+
+// reputationRouter drops providers with a bad reputation from lookups.
+type reputationRouter struct {
+	routing.ContentRouting
+	rep *providerReputation
+}
+
+func (r *reputationRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	in := r.ContentRouting.FindProvidersAsync(ctx, c, count)
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		for ai := range in {
+			if !r.rep.allowed(ai.ID) {
+				reputationFilteredProviders.Inc()
+				continue
+			}
+			select {
+			case out <- ai:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+var (
+	_ routing.ContentRouting = (*reputationRouter)(nil)
+)
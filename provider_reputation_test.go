@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	pb "github.com/ipfs/boxo/bitswap/message/pb"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderReputation(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	_, good := mustTestPeer(t)
+	_, bad := mustTestPeer(t)
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	rep, err := newProviderReputation(ctx, ds, 0.5)
+	require.NoError(t, err)
+
+	for i := range reputationMinSamples {
+		blk := blocks.NewBlock([]byte{byte(i)})
+
+		// The good provider sends the blocks it is asked for.
+		want := bsmsg.New(false)
+		want.AddEntry(blk.Cid(), 1, pb.Message_Wantlist_Block, true)
+		rep.sent(good, want)
+		res := bsmsg.New(false)
+		res.AddBlock(blk)
+		rep.received(good, res)
+
+		// The bad one answers DONT_HAVE or nothing at all.
+		rep.sent(bad, want)
+		if i%2 == 0 {
+			res := bsmsg.New(false)
+			res.AddDontHave(blk.Cid())
+			rep.received(bad, res)
+		}
+	}
+
+	// Wants that are cancelled are not held against the provider.
+	cancelled := blocks.NewBlock([]byte("cancelled"))
+	want := bsmsg.New(false)
+	want.AddEntry(cancelled.Cid(), 1, pb.Message_Wantlist_Block, true)
+	rep.sent(good, want)
+	cancel := bsmsg.New(false)
+	cancel.Cancel(cancelled.Cid())
+	rep.sent(good, cancel)
+
+	rep.sweep(time.Now().Add(2 * reputationWantTimeout))
+
+	require.True(t, rep.allowed(good))
+	require.False(t, rep.allowed(bad))
+
+	scores := rep.scores()
+	require.Len(t, scores, 2)
+	require.Equal(t, good, scores[0].ID)
+	require.Equal(t, 1.0, scores[0].Score)
+	require.EqualValues(t, reputationMinSamples, scores[0].Blocks)
+	require.Zero(t, scores[0].Timeouts)
+	require.EqualValues(t, reputationMinSamples/2, scores[1].DontHaves)
+	require.EqualValues(t, reputationMinSamples/2, scores[1].Timeouts)
+
+	// Bad providers are dropped from lookups.
+	cr := &countingContentRouter{providers: []peer.AddrInfo{{ID: good}, {ID: bad}}}
+	rr := &reputationRouter{ContentRouting: cr, rep: rep}
+	providers := collectProviders(rr.FindProvidersAsync(ctx, mustTestCid(t, "reputation"), 0))
+	require.Equal(t, []peer.AddrInfo{{ID: good}}, providers)
+
+	// Scores survive restarts.
+	require.NoError(t, rep.save(ctx))
+	rep, err = newProviderReputation(ctx, ds, 0.5)
+	require.NoError(t, err)
+	require.False(t, rep.allowed(bad))
+
+	// Decay gives providers another chance eventually.
+	rep.decay()
+	require.True(t, rep.allowed(bad))
+
+	require.Equal(t, 2, rep.reset(""))
+	require.NoError(t, rep.save(ctx))
+	rep, err = newProviderReputation(ctx, ds, 0.5)
+	require.NoError(t, err)
+	require.Empty(t, rep.scores())
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	nopfs "github.com/ipfs-shipyard/nopfs"
+	"github.com/ipfs/boxo/gateway"
+	logging "github.com/ipfs/go-log/v2"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/urfave/cli/v2"
+)
+
+// envLogLevel is the go-log variable with the log levels, which is applied on
+// reload like the flags.
+const envLogLevel = "GOLOG_LOG_LEVEL"
+
+// Flags applied by a reload, by component. Changes to the other flags are
+// reported as requiring a restart.
+var (
+	reloadGatewayFlags = []string{
+		"gateway-domains",
+		"subdomain-gateway-domains",
+		"trustless-gateway-domains",
+		"dnslink-gateway-domains",
+		"gateway-domains-file",
+		"max-concurrent-requests",
+		"retrieval-timeout",
+		"max-request-duration",
+		"max-range-request-file-size",
+		"max-deserialized-response-size",
+		"max-unixfs-dag-response-size",
+		"diagnostic-service-url",
+		"tracing-auth",
+	}
+	reloadDenylistFlags      = []string{"denylists"}
+	reloadPeeringFlags       = []string{"peering"}
+	reloadBitswapServerFlags = []string{
+		"bitswap-server-peer-requests",
+		"bitswap-server-peer-bandwidth",
+		"bitswap-server-max-bandwidth",
+	}
+	// The routing timeouts are set on the routers and their HTTP clients
+	// when they are created, so changing them requires a restart.
+	restartRoutingFlags = []string{
+		"routing-timeout",
+		"http-routers-timeout",
+	}
+	// The Bitswap session delays and the provider query limits are options
+	// of the Bitswap client and of the provider query manager, which cannot
+	// be changed once they are created.
+	restartBitswapFlags = []string{
+		"bitswap-provider-search-delay",
+		"bitswap-rebroadcast-delay",
+		"routing-max-requests",
+		"routing-max-providers",
+		"routing-max-timeout",
+	}
+)
+
+// reloadableConfig sets the fields of cfg that can be reloaded from cctx.
+func reloadableConfig(cctx *cli.Context, cfg *Config) error {
+	cfg.GatewayDomainPolicies = nil
+	if path := cctx.String("gateway-domains-file"); path != "" {
+		gd, err := loadGatewayDomains(path)
+		if err != nil {
+			return err
+		}
+		cfg.GatewayDomainPolicies = gd.PublicGateways
+	}
+
+	cfg.GatewayDomains = cctx.StringSlice("gateway-domains")
+	cfg.SubdomainGatewayDomains = cctx.StringSlice("subdomain-gateway-domains")
+	cfg.TrustlessGatewayDomains = cctx.StringSlice("trustless-gateway-domains")
+	isEmpty := func(s string) bool { return s == "" }
+	cfg.DNSLinkGatewayDomains = slices.DeleteFunc(cctx.StringSlice("dnslink-gateway-domains"), isEmpty)
+	cfg.MaxConcurrentRequests = cctx.Int("max-concurrent-requests")
+	cfg.RetrievalTimeout = cctx.Duration("retrieval-timeout")
+	cfg.MaxRequestDuration = cctx.Duration("max-request-duration")
+	cfg.MaxRangeRequestFileSize = cctx.Int64("max-range-request-file-size")
+	cfg.MaxDeserializedResponseSize = cctx.Int64("max-deserialized-response-size")
+	cfg.MaxUnixFSDAGResponseSize = cctx.Int64("max-unixfs-dag-response-size")
+	cfg.DiagnosticServiceURL = cctx.String("diagnostic-service-url")
+	cfg.TracingAuthToken = cctx.String("tracing-auth")
+	cfg.DenylistSubs = slices.DeleteFunc(cctx.StringSlice("denylists"), isEmpty)
+	cfg.BitswapServerPeerRequests = cctx.Int("bitswap-server-peer-requests")
+	cfg.BitswapServerPeerBandwidth = cctx.Int64("bitswap-server-peer-bandwidth")
+	cfg.BitswapServerMaxBandwidth = cctx.Int64("bitswap-server-max-bandwidth")
+	return nil
+}
+
+// parseFlags parses args and the environment again with the flags of app, and
+// runs the flag actions that validate them.
+func parseFlags(ctx context.Context, app *cli.App, args []string) (*cli.Context, error) {
+	set := flag.NewFlagSet(app.Name, flag.ContinueOnError)
+	set.SetOutput(io.Discard)
+	for _, f := range app.Flags {
+		if err := f.Apply(set); err != nil {
+			return nil, err
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cctx := cli.NewContext(app, set, nil)
+	cctx.Context = ctx
+	for _, f := range app.Flags {
+		af, ok := f.(cli.ActionableFlag)
+		if !ok || !slices.ContainsFunc(f.Names(), cctx.IsSet) {
+			continue
+		}
+		if err := af.RunAction(cctx); err != nil {
+			return nil, err
+		}
+	}
+	return cctx, nil
+}
+
+// flagValue returns the value of a flag as a string, to compare it.
+func flagValue(cctx *cli.Context, name string) string {
+	switch v := cctx.Value(name).(type) {
+	case cli.StringSlice:
+		return strings.Join(v.Value(), ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// settingName returns the environment variable of a flag, or the flag when it
+// has none.
+func settingName(f cli.Flag) string {
+	if df, ok := f.(cli.DocGenerationFlag); ok && len(df.GetEnvVars()) > 0 {
+		return df.GetEnvVars()[0]
+	}
+	return "--" + f.Names()[0]
+}
+
+// parseLogLevels parses a GOLOG_LOG_LEVEL value: a default level and
+// subsystem=level pairs, comma-separated.
+func parseLogLevels(spec string) (string, map[string]string, error) {
+	level := "error"
+	subsystems := make(map[string]string)
+	for kv := range strings.SplitSeq(spec, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		name, lvl, ok := strings.Cut(kv, "=")
+		if !ok {
+			name, lvl = "", name
+		}
+		if _, err := logging.Parse(lvl); err != nil {
+			return "", nil, fmt.Errorf("invalid value for %s: %w", envLogLevel, err)
+		}
+		if name == "" {
+			level = lvl
+		} else {
+			subsystems[name] = lvl
+		}
+	}
+	return level, subsystems, nil
+}
+
+// setLogLevels applies a GOLOG_LOG_LEVEL value.
+func setLogLevels(spec string) error {
+	level, subsystems, err := parseLogLevels(spec)
+	if err != nil {
+		return err
+	}
+	if err := logging.SetLogLevel("*", level); err != nil {
+		return err
+	}
+	for name, lvl := range subsystems {
+		if err := logging.SetLogLevel(name, lvl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envFile sets the variables of a file of KEY=value lines in the environment,
+// so that settings given as environment variables can be reloaded.
+type envFile struct {
+	path string
+	// orig holds the values the variables had before being set from the
+	// file, nil when they were not set.
+	orig map[string]*string
+}
+
+func newEnvFile(path string) *envFile {
+	return &envFile{path: path, orig: make(map[string]*string)}
+}
+
+// load sets the variables of the file, and restores the ones it set before
+// but no longer contains.
+func (e *envFile) load() error {
+	vars, err := readEnvFile(e.path)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range vars {
+		if _, ok := e.orig[key]; !ok {
+			if v, ok := os.LookupEnv(key); ok {
+				e.orig[key] = &v
+			} else {
+				e.orig[key] = nil
+			}
+		}
+		os.Setenv(key, value)
+	}
+	for key, v := range e.orig {
+		if _, ok := vars[key]; ok {
+			continue
+		}
+		if v != nil {
+			os.Setenv(key, *v)
+		} else {
+			os.Unsetenv(key)
+		}
+		delete(e.orig, key)
+	}
+	return nil
+}
+
+// readEnvFile parses a file of KEY=value lines. Empty lines and lines
+// starting with # are ignored, and values may be quoted.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("env file %q: line %d: expected KEY=value", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("env file %q: %w", path, err)
+	}
+	return vars, nil
+}
+
+// swapHandler serves the requests with the handler set last, so that
+// reloading it does not affect the requests in flight.
+type swapHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func newSwapHandler(h http.Handler) *swapHandler {
+	s := &swapHandler{}
+	s.set(h)
+	return s
+}
+
+func (s *swapHandler) set(h http.Handler) {
+	s.h.Store(&h)
+}
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.h.Load()).ServeHTTP(w, r)
+}
+
+// reloadResult is the outcome of a reload, as returned by /mgr/reload. Both
+// lists hold the environment variables of the settings that changed.
+type reloadResult struct {
+	Applied         []string
+	RestartRequired []string
+}
+
+// reloader applies the settings that changed in the flags, the environment
+// and the files they point to, without restarting.
+type reloader struct {
+	ctx     context.Context
+	args    []string
+	env     *envFile
+	nd      *Node
+	gateway *swapHandler
+	// newGateway builds the handler of the gateway for a configuration.
+	newGateway func(cfg Config, backend gateway.IPFSBackend) http.Handler
+
+	mu      sync.Mutex
+	closed  bool
+	cctx    *cli.Context
+	cfg     Config
+	backend gateway.IPFSBackend
+	// subs are the denylist subscriptions by URL. The ones loaded at startup
+	// stay subscribed to and blocked until the restart, even when removed.
+	subs map[string]*nopfs.HTTPSubscriber
+	// blocker holds the denylists subscribed to at runtime, which are not
+	// in the blocker of nd.
+	blocker  *nopfs.Blocker
+	logLevel string
+}
+
+// newReloader returns a reloader for a gateway started with cfg, built from
+// cctx. env, when not nil, is read again on every reload. The handler of gw
+// is replaced by the one built by newGateway when the gateway settings
+// change.
+func newReloader(ctx context.Context, cctx *cli.Context, args []string, env *envFile, cfg Config, nd *Node, backend gateway.IPFSBackend, gw *swapHandler, newGateway func(Config, gateway.IPFSBackend) http.Handler) *reloader {
+	rl := &reloader{
+		ctx:        ctx,
+		args:       args,
+		env:        env,
+		nd:         nd,
+		gateway:    gw,
+		newGateway: newGateway,
+		cctx:       cctx,
+		cfg:        cfg,
+		backend:    backend,
+		subs:       make(map[string]*nopfs.HTTPSubscriber),
+		logLevel:   os.Getenv(envLogLevel),
+	}
+	nd.denylistMu.Lock()
+	maps.Copy(rl.subs, nd.denylistSubs)
+	nd.denylistMu.Unlock()
+	return rl
+}
+
+// reload reads the settings again and applies the ones that changed. Nothing
+// is applied when any of them is invalid.
+func (rl *reloader) reload() (*reloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.closed {
+		return nil, errors.New("rainbow is shutting down")
+	}
+
+	if rl.env != nil {
+		if err := rl.env.load(); err != nil {
+			return nil, err
+		}
+	}
+	cctx, err := parseFlags(rl.ctx, rl.cctx.App, rl.args)
+	if err != nil {
+		return nil, err
+	}
+	cfg := rl.cfg
+	if err := reloadableConfig(cctx, &cfg); err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]string)
+	for _, f := range cctx.App.Flags {
+		name := f.Names()[0]
+		if flagValue(rl.cctx, name) != flagValue(cctx, name) {
+			changed[name] = settingName(f)
+		}
+	}
+	if !reflect.DeepEqual(rl.cfg.GatewayDomainPolicies, cfg.GatewayDomainPolicies) {
+		changed["gateway-domains-file"] = "RAINBOW_GATEWAY_DOMAINS_FILE"
+	}
+
+	res := &reloadResult{Applied: []string{}, RestartRequired: []string{}}
+	// classify reports whether any of flags changed, and can be applied
+	// when available is true.
+	classify := func(flags []string, available bool) bool {
+		found := false
+		for _, name := range flags {
+			setting, ok := changed[name]
+			if !ok {
+				continue
+			}
+			delete(changed, name)
+			found = true
+			if available {
+				res.Applied = append(res.Applied, setting)
+			} else {
+				res.RestartRequired = append(res.RestartRequired, setting)
+			}
+		}
+		return found && available
+	}
+
+	// Check and prepare everything before applying anything.
+	logLevel := os.Getenv(envLogLevel)
+	reloadLogLevel := logLevel != rl.logLevel
+	if reloadLogLevel {
+		if _, _, err := parseLogLevels(logLevel); err != nil {
+			return nil, err
+		}
+		res.Applied = append(res.Applied, envLogLevel)
+	}
+
+	reloadPeering := classify(reloadPeeringFlags, rl.nd.peering != nil)
+	if reloadPeering {
+		cfg.Peering, cfg.PeeringDNS, err = parsePeerings(cctx.StringSlice("peering"), cfg.Seed, cfg.SeedIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Denylists subscribed to at runtime are in rl.blocker, which can be
+	// rebuilt without the removed ones. Those loaded at startup are in the
+	// blocker of nd, so removing them only takes effect after a restart:
+	// until then they are left as they are. The files of the removed
+	// denylists are kept in the data directory.
+	_, reloadDenylists := changed["denylists"]
+	var (
+		added        = make(map[string]*nopfs.HTTPSubscriber)
+		removedFiles []string
+		blocker      = rl.blocker
+	)
+	stopAdded := func() {
+		for _, sub := range added {
+			sub.Stop()
+		}
+	}
+	if reloadDenylists {
+		keep := make(map[string]bool)
+		for _, url := range cfg.DenylistSubs {
+			keep[denylistFile(cfg.DataDir, url)] = true
+		}
+		restartRequired := false
+		for url := range rl.subs {
+			f := denylistFile(cfg.DataDir, url)
+			if slices.Contains(cfg.DenylistSubs, url) || keep[f] {
+				continue
+			}
+			if _, ok := rl.nd.blocker.Denylists[f]; ok {
+				restartRequired = true
+				continue
+			}
+			removedFiles = append(removedFiles, f)
+		}
+		classify(reloadDenylistFlags, !restartRequired)
+
+		var files []string
+		if rl.blocker != nil {
+			for f := range rl.blocker.Denylists {
+				if !slices.Contains(removedFiles, f) {
+					files = append(files, f)
+				}
+			}
+		}
+		runtimeChanged := rl.blocker != nil && len(files) != len(rl.blocker.Denylists)
+		for _, url := range cfg.DenylistSubs {
+			if _, ok := rl.subs[url]; ok {
+				continue
+			}
+			sub, err := newDenylistSubscriber(cfg.DataDir, url)
+			if err != nil {
+				stopAdded()
+				return nil, fmt.Errorf("subscribing to denylist %q: %w", url, err)
+			}
+			added[url] = sub
+			f := denylistFile(cfg.DataDir, url)
+			if _, ok := rl.nd.blocker.Denylists[f]; !ok && !slices.Contains(files, f) {
+				files = append(files, f)
+				runtimeChanged = true
+			}
+		}
+		if runtimeChanged {
+			blocker = nil
+			if len(files) > 0 {
+				blocker, err = nopfs.NewBlocker(files)
+				if err != nil {
+					stopAdded()
+					return nil, err
+				}
+			}
+		}
+	}
+
+	backend := rl.backend
+	if blocker != rl.blocker {
+		backend, err = setupGatewayBackend(cfg, rl.nd, blocker)
+		if err != nil {
+			stopAdded()
+			if blocker != nil {
+				blocker.Close()
+			}
+			return nil, err
+		}
+	}
+	reloadGateway := classify(reloadGatewayFlags, true) || backend != rl.backend
+
+	// Apply.
+	if reloadLogLevel {
+		_ = setLogLevels(logLevel)
+	}
+	if reloadGateway {
+		rl.gateway.set(rl.newGateway(cfg, backend))
+	}
+	if reloadDenylists {
+		for url, sub := range rl.subs {
+			if slices.Contains(cfg.DenylistSubs, url) {
+				continue
+			}
+			if _, ok := rl.nd.blocker.Denylists[denylistFile(cfg.DataDir, url)]; ok {
+				continue
+			}
+			sub.Stop()
+			delete(rl.subs, url)
+		}
+		maps.Copy(rl.subs, added)
+		rl.nd.denylistMu.Lock()
+		rl.nd.denylistSubs = maps.Clone(rl.subs)
+		rl.nd.denylistMu.Unlock()
+		if blocker != rl.blocker && rl.blocker != nil {
+			rl.blocker.Close()
+		}
+	}
+	if reloadPeering {
+		added, removed := rl.nd.peering.sync(peeringSourceConfig, cfg.Peering)
+		goLog.Infow("reloaded peering", "added", added, "removed", removed)
+		if !slices.EqualFunc(rl.cfg.PeeringDNS, cfg.PeeringDNS, func(a, b ma.Multiaddr) bool { return a.Equal(b) }) {
+			rl.nd.peering.dns.update(cfg.PeeringDNS)
+		}
+	}
+	if classify(reloadBitswapServerFlags, rl.nd.servingLimiter != nil) {
+		rl.nd.servingLimiter.setLimits(cfg.BitswapServerPeerRequests, cfg.BitswapServerPeerBandwidth, cfg.BitswapServerMaxBandwidth)
+	}
+
+	classify(restartRoutingFlags, false)
+	classify(restartBitswapFlags, false)
+	for _, setting := range changed {
+		res.RestartRequired = append(res.RestartRequired, setting)
+	}
+	slices.Sort(res.Applied)
+	slices.Sort(res.RestartRequired)
+
+	rl.cctx, rl.cfg, rl.backend, rl.blocker, rl.logLevel = cctx, cfg, backend, blocker, logLevel
+	return res, nil
+}
+
+// runtimeBlocker returns the blocker of the denylists subscribed to at
+// runtime, or nil when there are none.
+func (rl *reloader) runtimeBlocker() *nopfs.Blocker {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.blocker
+}
+
+// close stops the denylist subscriptions. Reloads fail afterwards.
+func (rl *reloader) close() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.closed {
+		return
+	}
+	rl.closed = true
+	for _, sub := range rl.subs {
+		sub.Stop()
+	}
+	if rl.blocker != nil {
+		rl.blocker.Close()
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/gateway"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	t.Parallel()
+
+	p := filepath.Join(t.TempDir(), "rainbow.env")
+	require.NoError(t, os.WriteFile(p, []byte(`
+# Comment
+RAINBOW_A=1
+export RAINBOW_B = "two, three"
+RAINBOW_C='four'
+RAINBOW_D=
+`), 0o600))
+
+	vars, err := readEnvFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"RAINBOW_A": "1",
+		"RAINBOW_B": "two, three",
+		"RAINBOW_C": "four",
+		"RAINBOW_D": "",
+	}, vars)
+
+	require.NoError(t, os.WriteFile(p, []byte("RAINBOW_A\n"), 0o600))
+	_, err = readEnvFile(p)
+	assert.Error(t, err)
+}
+
+func TestEnvFileLoad(t *testing.T) {
+	t.Setenv("RAINBOW_TEST_SET", "orig")
+	t.Setenv("RAINBOW_TEST_UNSET", "")
+	os.Unsetenv("RAINBOW_TEST_UNSET")
+
+	p := filepath.Join(t.TempDir(), "rainbow.env")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+	}
+
+	e := newEnvFile(p)
+	write("RAINBOW_TEST_SET=a\nRAINBOW_TEST_UNSET=b\n")
+	require.NoError(t, e.load())
+	assert.Equal(t, "a", os.Getenv("RAINBOW_TEST_SET"))
+	assert.Equal(t, "b", os.Getenv("RAINBOW_TEST_UNSET"))
+
+	// Variables removed from the file get their original value back.
+	write("RAINBOW_TEST_SET=c\n")
+	require.NoError(t, e.load())
+	assert.Equal(t, "c", os.Getenv("RAINBOW_TEST_SET"))
+	_, ok := os.LookupEnv("RAINBOW_TEST_UNSET")
+	assert.False(t, ok)
+
+	write("")
+	require.NoError(t, e.load())
+	assert.Equal(t, "orig", os.Getenv("RAINBOW_TEST_SET"))
+
+	require.NoError(t, os.Remove(p))
+	assert.Error(t, e.load())
+}
+
+func TestParseLogLevels(t *testing.T) {
+	t.Parallel()
+
+	level, subsystems, err := parseLogLevels("info, rainbow=debug,bitswap=error")
+	require.NoError(t, err)
+	assert.Equal(t, "info", level)
+	assert.Equal(t, map[string]string{"rainbow": "debug", "bitswap": "error"}, subsystems)
+
+	level, subsystems, err = parseLogLevels("")
+	require.NoError(t, err)
+	assert.Equal(t, "error", level)
+	assert.Empty(t, subsystems)
+
+	_, _, err = parseLogLevels("rainbow=loud")
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	envPath := filepath.Join(t.TempDir(), "rainbow.env")
+	for _, key := range []string{"RAINBOW_TRUSTLESS_GATEWAY_DOMAINS", "ROUTING_MAX_REQUESTS", "RAINBOW_ROUTING_TIMEOUT", "RAINBOW_BITSWAP_PROVIDER_SEARCH_DELAY", "RAINBOW_LIBP2P_CONNMGR_LOW"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	app := &cli.App{
+		Name: "rainbow",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:    "trustless-gateway-domains",
+				Value:   cli.NewStringSlice(),
+				EnvVars: []string{"RAINBOW_TRUSTLESS_GATEWAY_DOMAINS"},
+			},
+			&cli.DurationFlag{
+				Name:    "bitswap-provider-search-delay",
+				Value:   time.Second,
+				EnvVars: []string{"RAINBOW_BITSWAP_PROVIDER_SEARCH_DELAY"},
+			},
+			&cli.DurationFlag{
+				Name:    "bitswap-rebroadcast-delay",
+				Value:   10 * time.Second,
+				EnvVars: []string{"RAINBOW_BITSWAP_REBROADCAST_DELAY"},
+			},
+			&cli.IntFlag{
+				Name:    "routing-max-requests",
+				Value:   16,
+				EnvVars: []string{"ROUTING_MAX_REQUESTS"},
+				Action: func(ctx *cli.Context, v int) error {
+					if v < 0 {
+						return errors.New("must not be negative")
+					}
+					return nil
+				},
+			},
+			&cli.DurationFlag{
+				Name:    "routing-max-timeout",
+				Value:   10 * time.Second,
+				EnvVars: []string{"ROUTING_MAX_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "routing-timeout",
+				Value:   30 * time.Second,
+				EnvVars: []string{"RAINBOW_ROUTING_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "libp2p-connmgr-low",
+				Value:   100,
+				EnvVars: []string{"RAINBOW_LIBP2P_CONNMGR_LOW"},
+			},
+		},
+	}
+	cctx, err := parseFlags(context.Background(), app, nil)
+	require.NoError(t, err)
+
+	cfg := Config{
+		DataDir:                    t.TempDir(),
+		BlockstoreType:             "flatfs",
+		Bitswap:                    true,
+		BitswapProviderSearchDelay: time.Second,
+		RoutingMaxRequests:         16,
+	}
+	require.NoError(t, reloadableConfig(cctx, &cfg))
+	nd := mustTestNode(t, cfg)
+
+	backend, err := setupGatewayBackend(cfg, nd, nil)
+	require.NoError(t, err)
+	readiness := &healthChecks{checks: []healthCheck{}}
+	limiter := newRequestLimiter()
+	newGateway := func(cfg Config, backend gateway.IPFSBackend) http.Handler {
+		return withHealth(newGatewayHandler(cfg, backend, limiter), cfg, newLiveness(), readiness)
+	}
+	gw := newSwapHandler(newGateway(cfg, backend))
+	ts := httptest.NewServer(gw)
+	t.Cleanup(ts.Close)
+
+	rl := newReloader(context.Background(), cctx, nil, newEnvFile(envPath), cfg, nd, backend, gw, newGateway)
+	t.Cleanup(rl.close)
+
+	cid := mustAddFile(t, nd, []byte("hello world"))
+	do := func(t *testing.T, path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = "trustless.com"
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+	get := func(t *testing.T) int {
+		return do(t, "/ipfs/"+cid.String()).StatusCode
+	}
+	// isHealthCheck tells whether /readyz is answered by the health checks
+	// rather than the gateway.
+	isHealthCheck := func(t *testing.T) bool {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/readyz", nil)
+		require.NoError(t, err)
+		req.Host = "trustless.com"
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body) == "OK\n"
+	}
+	require.Equal(t, http.StatusOK, get(t))
+	require.False(t, isHealthCheck(t))
+
+	t.Run("Invalid settings are not applied", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(envPath, []byte("RAINBOW_TRUSTLESS_GATEWAY_DOMAINS=trustless.com\nROUTING_MAX_REQUESTS=-1\n"), 0o600))
+		_, err := rl.reload()
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusOK, get(t))
+		assert.Equal(t, 16, nd.tuning.get().RoutingMaxRequests)
+	})
+
+	t.Run("Changed settings are applied", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(envPath, []byte("RAINBOW_TRUSTLESS_GATEWAY_DOMAINS=trustless.com\nROUTING_MAX_REQUESTS=4\nRAINBOW_ROUTING_TIMEOUT=5s\nRAINBOW_BITSWAP_PROVIDER_SEARCH_DELAY=2s\nRAINBOW_LIBP2P_CONNMGR_LOW=10\n"), 0o600))
+
+		// Reload through /mgr/reload.
+		mgr := httptest.NewServer(http.HandlerFunc(reloadHandler(rl)))
+		t.Cleanup(mgr.Close)
+
+		res, err := http.Get(mgr.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+		res, err = http.Post(mgr.URL, "", nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var result reloadResult
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		assert.Equal(t, []string{"RAINBOW_TRUSTLESS_GATEWAY_DOMAINS"}, result.Applied)
+		assert.Equal(t, []string{"RAINBOW_BITSWAP_PROVIDER_SEARCH_DELAY", "RAINBOW_LIBP2P_CONNMGR_LOW", "RAINBOW_ROUTING_TIMEOUT", "ROUTING_MAX_REQUESTS"}, result.RestartRequired)
+
+		assert.Equal(t, http.StatusNotAcceptable, get(t))
+		assert.Equal(t, 16, nd.tuning.get().RoutingMaxRequests)
+		assert.Equal(t, "1s", nd.tuning.get().ProviderSearchDelay)
+
+		// The health checks are served on the new gateway domains.
+		assert.True(t, isHealthCheck(t))
+	})
+
+	t.Run("Unchanged settings", func(t *testing.T) {
+		result, err := rl.reload()
+		require.NoError(t, err)
+		assert.Empty(t, result.Applied)
+		assert.Empty(t, result.RestartRequired)
+	})
+}
+
+func TestReloadDenylists(t *testing.T) {
+	envPath := filepath.Join(t.TempDir(), "rainbow.env")
+	t.Setenv("RAINBOW_DENYLISTS", "")
+
+	cfg := Config{
+		DataDir:        t.TempDir(),
+		BlockstoreType: "flatfs",
+		Bitswap:        true,
+	}
+	nd := mustTestNode(t, Config{DataDir: cfg.DataDir, Bitswap: true})
+	startup := mustAddFile(t, nd, []byte("denied at startup"))
+	runtime := mustAddFile(t, nd, []byte("denied at runtime"))
+	require.NoError(t, nd.close())
+
+	// Subscriptions only append the ranges returned with 206.
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c cid.Cid
+		switch r.URL.Path {
+		case "/startup.deny":
+			c = startup
+		case "/runtime.deny":
+			c = runtime
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("/ipfs/"+c.String()+"\n"))
+	}))
+	t.Cleanup(lists.Close)
+	startupURL, runtimeURL := lists.URL+"/startup.deny", lists.URL+"/runtime.deny"
+	t.Setenv("RAINBOW_DENYLISTS", startupURL)
+
+	app := &cli.App{
+		Name: "rainbow",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:    "denylists",
+				Value:   cli.NewStringSlice(),
+				EnvVars: []string{"RAINBOW_DENYLISTS"},
+			},
+		},
+	}
+	cctx, err := parseFlags(context.Background(), app, nil)
+	require.NoError(t, err)
+	require.NoError(t, reloadableConfig(cctx, &cfg))
+	nd = mustTestNode(t, cfg)
+	t.Cleanup(func() { _ = nd.close() })
+
+	backend, err := setupGatewayBackend(cfg, nd, nil)
+	require.NoError(t, err)
+	limiter := newRequestLimiter()
+	newGateway := func(cfg Config, backend gateway.IPFSBackend) http.Handler {
+		return newGatewayHandler(cfg, backend, limiter)
+	}
+	gw := newSwapHandler(newGateway(cfg, backend))
+	ts := httptest.NewServer(gw)
+	t.Cleanup(ts.Close)
+
+	rl := newReloader(context.Background(), cctx, nil, newEnvFile(envPath), cfg, nd, backend, gw, newGateway)
+	t.Cleanup(rl.close)
+	require.Equal(t, []string{startupURL}, slices.Collect(maps.Keys(rl.subs)))
+
+	get := func(t *testing.T, c cid.Cid) int {
+		res, err := http.Get(ts.URL + "/ipfs/" + c.String())
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	reload := func(t *testing.T, denylists string) *reloadResult {
+		require.NoError(t, os.WriteFile(envPath, []byte("RAINBOW_DENYLISTS="+denylists+"\n"), 0o600))
+		res, err := rl.reload()
+		require.NoError(t, err)
+		return res
+	}
+	require.Equal(t, http.StatusGone, get(t, startup))
+	require.Equal(t, http.StatusOK, get(t, runtime))
+
+	t.Run("Added denylists are applied", func(t *testing.T) {
+		res := reload(t, startupURL+","+runtimeURL)
+		assert.Equal(t, []string{"RAINBOW_DENYLISTS"}, res.Applied)
+		assert.Equal(t, http.StatusGone, get(t, runtime))
+	})
+
+	t.Run("Removed denylists added at runtime are applied", func(t *testing.T) {
+		res := reload(t, startupURL)
+		assert.Equal(t, []string{"RAINBOW_DENYLISTS"}, res.Applied)
+		assert.Empty(t, res.RestartRequired)
+		assert.Equal(t, http.StatusOK, get(t, runtime))
+		assert.FileExists(t, denylistFile(cfg.DataDir, runtimeURL))
+	})
+
+	t.Run("Removed denylists loaded at startup require a restart", func(t *testing.T) {
+		res := reload(t, "")
+		assert.Empty(t, res.Applied)
+		assert.Equal(t, []string{"RAINBOW_DENYLISTS"}, res.RestartRequired)
+		assert.Equal(t, http.StatusGone, get(t, startup))
+
+		rl.close()
+		assert.FileExists(t, denylistFile(cfg.DataDir, startupURL))
+	})
+}
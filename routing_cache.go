@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	routingCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "routing_cache_hits_total",
+		Help:      "Number of provider lookups answered from the provider record cache.",
+	})
+	routingCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "routing_cache_misses_total",
+		Help:      "Number of provider lookups that had to go to the routers.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(routingCacheHits, routingCacheMisses)
+}
+
+// providerCacheRecord is what gets persisted for every multihash.
+type providerCacheRecord struct {
+	Expires   time.Time
+	Providers []peer.AddrInfo
+}
+
+// providerCache is a routing.ContentRouting that remembers the providers
+// found for a multihash for a given TTL. Only the results of lookups that ran
+// to completion, or until the routing max timeout, are remembered. Lookups
+// are answered from the cache when possible and only hit the wrapped router
+// (DHT, HTTP routers) on a miss. Records are persisted so they survive
+// restarts.
+type providerCache struct {
+	routing.ContentRouting
+
+	ds  datastore.Batching
+	ttl time.Duration
+}
+
+func newProviderCache(cr routing.ContentRouting, ds datastore.Batching, ttl time.Duration) *providerCache {
+	return &providerCache{
+		ContentRouting: cr,
+		ds:             namespace.Wrap(ds, datastore.NewKey("routing-cache")),
+		ttl:            ttl,
+	}
+}
+
+func (pc *providerCache) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	rec, err := pc.get(ctx, c)
+	if err != nil {
+		goLog.Debugw("reading provider cache", "cid", c, "err", err)
+	}
+
+	// Only complete answers are cached, but a caller asking for more
+	// providers than were found may still get them from the routers.
+	if rec != nil && (count == 0 || len(rec.Providers) >= count) {
+		routingCacheHits.Inc()
+		trace := routingTraceFromContext(ctx)
+		out := make(chan peer.AddrInfo)
+		go func() {
+			defer close(out)
+			for i, ai := range rec.Providers {
+				if count > 0 && i >= count {
+					return
+				}
+				if trace != nil {
+					trace(providerCacheRouterName, ai)
+				}
+				select {
+				case out <- ai:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+
+	routingCacheMisses.Inc()
+	in := pc.ContentRouting.FindProvidersAsync(ctx, c, count)
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		var found []peer.AddrInfo
+	loop:
+		for ai := range in {
+			found = append(found, ai)
+			select {
+			case out <- ai:
+			case <-ctx.Done():
+				break loop
+			}
+		}
+
+		// Lookups limited by count, or cut short by the caller, return a
+		// subset of the providers that must not be served as the answer.
+		// Lookups that reached the routing max timeout return all the
+		// providers found in the time they were given.
+		if count != 0 || len(found) == 0 {
+			return
+		}
+		if ctx.Err() != nil && !errors.Is(context.Cause(ctx), errProviderQueryTimeout) {
+			return
+		}
+		if err := pc.put(c, found); err != nil {
+			goLog.Debugw("writing provider cache", "cid", c, "err", err)
+		}
+	}()
+	return out
+}
+
+// get returns the cached record for c. It returns nil if there is no record
+// or if it expired, in which case the record is removed.
+func (pc *providerCache) get(ctx context.Context, c cid.Cid) (*providerCacheRecord, error) {
+	k := dshelp.MultihashToDsKey(c.Hash())
+	data, err := pc.ds.Get(ctx, k)
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rec providerCacheRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(rec.Expires) {
+		return nil, pc.ds.Delete(ctx, k)
+	}
+	return &rec, nil
+}
+
+func (pc *providerCache) put(c cid.Cid, providers []peer.AddrInfo) error {
+	data, err := json.Marshal(providerCacheRecord{
+		Expires:   time.Now().Add(pc.ttl),
+		Providers: providers,
+	})
+	if err != nil {
+		return err
+	}
+	// The lookup context is usually cancelled by the time we are done
+	// reading results.
+	return pc.ds.Put(context.Background(), dshelp.MultihashToDsKey(c.Hash()), data)
+}
+
+// Lookup returns the non-expired cached providers for c, if any.
+func (pc *providerCache) Lookup(ctx context.Context, c cid.Cid) ([]peer.AddrInfo, time.Time, bool, error) {
+	rec, err := pc.get(ctx, c)
+	if err != nil || rec == nil {
+		return nil, time.Time{}, false, err
+	}
+	return rec.Providers, rec.Expires, true, nil
+}
+
+// Len returns the number of records in the cache, including expired ones
+// that have not been removed yet.
+func (pc *providerCache) Len(ctx context.Context) (int, error) {
+	res, err := pc.ds.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var n int
+	for r := range res.Next() {
+		if r.Error != nil {
+			return n, r.Error
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Remove drops the cached record for c.
+func (pc *providerCache) Remove(ctx context.Context, c cid.Cid) error {
+	return pc.ds.Delete(ctx, dshelp.MultihashToDsKey(c.Hash()))
+}
+
+// Flush drops every record, or only the expired ones when expiredOnly is
+// set. It returns the number of removed records.
+func (pc *providerCache) Flush(ctx context.Context, expiredOnly bool) (int, error) {
+	res, err := pc.ds.Query(ctx, query.Query{KeysOnly: !expiredOnly})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	b, err := pc.ds.Batch(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var n int
+	for r := range res.Next() {
+		if r.Error != nil {
+			return n, r.Error
+		}
+		if expiredOnly {
+			var rec providerCacheRecord
+			if err := json.Unmarshal(r.Value, &rec); err == nil && now.Before(rec.Expires) {
+				continue
+			}
+		}
+		if err := b.Delete(ctx, datastore.NewKey(r.Key)); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, b.Commit(ctx)
+}
+
+// startSweeper periodically removes expired records until ctx is cancelled.
+func (pc *providerCache) startSweeper(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		ticker := time.NewTicker(pc.ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := pc.Flush(ctx, true)
+				if err != nil {
+					goLog.Warnw("error sweeping provider cache", "err", err)
+					continue
+				}
+				goLog.Debugw("swept provider cache", "removed", n)
+			}
+		}
+	})
+}
+
+var _ routing.ContentRouting = (*providerCache)(nil)
+
+// errProviderQueryTimeout is the cause of the cancellation of provider
+// queries that reached the routing max timeout.
+var errProviderQueryTimeout = errors.New("provider query timed out")
+
+// queryTimeoutRouter is the router of the provider query manager, which gives
+// its queries no deadline but the routing max timeout. Queries that reach a
+// deadline are cancelled with errProviderQueryTimeout instead, so that the
+// provider cache tells them from the queries cut short by their caller.
+type queryTimeoutRouter struct {
+	routing.ContentRouting
+}
+
+func (r *queryTimeoutRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	qctx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			cancel(errProviderQueryTimeout)
+		} else {
+			cancel(context.Cause(ctx))
+		}
+	})
+	in := r.ContentRouting.FindProvidersAsync(qctx, c, count)
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		defer cancel(nil)
+		defer stop()
+		for ai := range in {
+			select {
+			case out <- ai:
+			case <-qctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+type countingContentRouter struct {
+	calls     atomic.Int32
+	providers []peer.AddrInfo
+}
+
+func (r *countingContentRouter) Provide(context.Context, cid.Cid, bool) error {
+	return nil
+}
+
+func (r *countingContentRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	r.calls.Add(1)
+	ch := make(chan peer.AddrInfo, len(r.providers))
+	for i, p := range r.providers {
+		if count > 0 && i >= count {
+			break
+		}
+		ch <- p
+	}
+	close(ch)
+	return ch
+}
+
+func mustTestCid(t *testing.T, data string) cid.Cid {
+	h, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+func collectProviders(ch <-chan peer.AddrInfo) []peer.AddrInfo {
+	var out []peer.AddrInfo
+	for ai := range ch {
+		out = append(out, ai)
+	}
+	return out
+}
+
+func TestProviderCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	_, pid1 := mustTestPeer(t)
+	_, pid2 := mustTestPeer(t)
+
+	cr := &countingContentRouter{providers: []peer.AddrInfo{{ID: pid1}, {ID: pid2}}}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	pc := newProviderCache(cr, ds, time.Hour)
+	c := mustTestCid(t, "routing-cache-test")
+
+	// Lookups limited by count are not cached.
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, c, 1)), 1)
+	require.EqualValues(t, 1, cr.calls.Load())
+	_, _, ok, err := pc.Lookup(ctx, c)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Neither are lookups cancelled by the caller.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	collectProviders(pc.FindProvidersAsync(cctx, c, 0))
+	require.EqualValues(t, 2, cr.calls.Load())
+	_, _, ok, err = pc.Lookup(ctx, c)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Miss goes to the router and fills the cache.
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, c, 0)), 2)
+	require.EqualValues(t, 3, cr.calls.Load())
+
+	// The record is written before the results channel is closed.
+	providers, _, ok, err := pc.Lookup(ctx, c)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, providers, 2)
+
+	// Hit is answered locally and honours count.
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, c, 1)), 1)
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, c, 0)), 2)
+	require.EqualValues(t, 3, cr.calls.Load())
+
+	// Asking for more providers than cached goes to the router.
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, c, 3)), 2)
+	require.EqualValues(t, 4, cr.calls.Load())
+
+	// The same multihash with a different CID version shares the record.
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, cid.NewCidV1(cid.DagProtobuf, c.Hash()), 0)), 2)
+	require.EqualValues(t, 4, cr.calls.Load())
+
+	n, err := pc.Len(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	removed, err := pc.Flush(ctx, true)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+
+	removed, err = pc.Flush(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, c, 0)), 2)
+	require.EqualValues(t, 5, cr.calls.Load())
+}
+
+func TestProviderCacheExpiry(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	_, pid := mustTestPeer(t)
+
+	cr := &countingContentRouter{providers: []peer.AddrInfo{{ID: pid}}}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	pc := newProviderCache(cr, ds, time.Hour)
+	c := mustTestCid(t, "routing-cache-expiry")
+
+	require.NoError(t, pc.put(c, cr.providers))
+	require.Len(t, collectProviders(pc.FindProvidersAsync(ctx, c, 0)), 1)
+	require.Zero(t, cr.calls.Load())
+
+	// Expired records are ignored and removed.
+	pc.ttl = -time.Second
+	require.NoError(t, pc.put(c, cr.providers))
+	_, _, ok, err := pc.Lookup(ctx, c)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	n, err := pc.Len(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// Lookups that find nothing are not cached.
+	cr.providers = nil
+	require.Empty(t, collectProviders(pc.FindProvidersAsync(ctx, c, 0)))
+	require.EqualValues(t, 1, cr.calls.Load())
+	n, err = pc.Len(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+// hangingRouter returns a provider, then hangs until the query is cancelled.
+type hangingRouter struct{}
+
+func (r *hangingRouter) Provide(context.Context, cid.Cid, bool) error {
+	return nil
+}
+
+func (r *hangingRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	ch := make(chan peer.AddrInfo, 1)
+	ch <- peer.AddrInfo{ID: test.RandPeerIDFatal(nil)}
+	go func() {
+		defer close(ch)
+		<-ctx.Done()
+	}()
+	return ch
+}
+
+func TestProviderCacheQueryTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	c := mustTestCid(t, "routing-cache-timeout")
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	pc := newProviderCache(&hangingRouter{}, ds, time.Hour)
+	r := &queryTimeoutRouter{ContentRouting: pc}
+
+	// The providers found before the routing max timeout of the provider
+	// query manager are cached.
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.Len(t, collectProviders(r.FindProvidersAsync(tctx, c, 0)), 1)
+	providers, _, ok, err := pc.Lookup(ctx, c)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, providers, 1)
+
+	// Lookups cut short by the caller are not, even by a deadline.
+	require.NoError(t, pc.Remove(ctx, c))
+	cctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	require.Len(t, collectProviders(r.FindProvidersAsync(cctx, c, 0)), 1)
+	_, _, ok, err = pc.Lookup(ctx, c)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	tctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.Len(t, collectProviders(pc.FindProvidersAsync(tctx, c, 0)), 1)
+	_, _, ok, err = pc.Lookup(ctx, c)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
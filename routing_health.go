@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// routerHealthWindow is the number of most recent outcomes used to
+	// compute the error rate of a router.
+	routerHealthWindow = 50
+	// routerHealthMinSamples is the number of outcomes needed before a
+	// router can be benched.
+	routerHealthMinSamples = 20
+)
+
+const (
+	routerOpFindProviders = "find_providers"
+	routerOpFindPeer      = "find_peer"
+	routerOpGetValue      = "get_value"
+	routerOpSearchValue   = "search_value"
+)
+
+type routerOutcome string
+
+const (
+	routerOutcomeSuccess  routerOutcome = "success"
+	routerOutcomeNotFound routerOutcome = "not_found"
+	routerOutcomeError    routerOutcome = "error"
+	routerOutcomeTimeout  routerOutcome = "timeout"
+)
+
+var (
+	routerRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "routing_router_requests_total",
+		Help:      "Number of requests made to each router, by operation and outcome.",
+	}, []string{"router", "operation", "outcome"})
+	routerLatencyMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "routing_router_latency_seconds",
+		Help:      "Time until a router returned its first result, or until it gave up.",
+		Buckets:   defaultDurationHistogramBuckets,
+	}, []string{"router", "operation"})
+	routerResultsMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "routing_router_results",
+		Help:      "Number of results returned by a router per request.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100},
+	}, []string{"router", "operation"})
+	routerBenchedMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "routing_router_benched",
+		Help:      "Whether a router is currently benched because of its error rate.",
+	}, []string{"router"})
+)
+
+func init() {
+	prometheus.MustRegister(routerRequestsMetric, routerLatencyMetric, routerResultsMetric, routerBenchedMetric)
+}
+
+// routerOpStats are the counters kept for every router operation.
+type routerOpStats struct {
+	Requests     int64
+	Successes    int64
+	NotFound     int64
+	Errors       int64
+	Timeouts     int64
+	Results      int64
+	TotalLatency time.Duration
+}
+
+// routerHealth tracks the outcomes of the requests made to a router. When
+// benching is enabled, a router whose error rate over the last requests
+// crosses the threshold is skipped until the cooldown expires.
+type routerHealth struct {
+	name     string
+	canBench bool
+	errRate  float64
+	cooldown time.Duration
+
+	mu           sync.Mutex
+	window       []bool // true for failures
+	benchedUntil time.Time
+	benchedTimes int
+	// unbench resets the benched gauge when the cooldown expires.
+	unbench *time.Timer
+	ops     map[string]*routerOpStats
+}
+
+func (rh *routerHealth) benched() bool {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	return time.Now().Before(rh.benchedUntil)
+}
+
+func (rh *routerHealth) record(op string, outcome routerOutcome, latency time.Duration, results int) {
+	routerRequestsMetric.WithLabelValues(rh.name, op, string(outcome)).Inc()
+	routerLatencyMetric.WithLabelValues(rh.name, op).Observe(latency.Seconds())
+	if op == routerOpFindProviders || op == routerOpSearchValue {
+		routerResultsMetric.WithLabelValues(rh.name, op).Observe(float64(results))
+	}
+
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	st, ok := rh.ops[op]
+	if !ok {
+		st = &routerOpStats{}
+		rh.ops[op] = st
+	}
+	st.Requests++
+	st.Results += int64(results)
+	st.TotalLatency += latency
+	switch outcome {
+	case routerOutcomeSuccess:
+		st.Successes++
+	case routerOutcomeNotFound:
+		st.NotFound++
+	case routerOutcomeError:
+		st.Errors++
+	case routerOutcomeTimeout:
+		st.Timeouts++
+	}
+
+	failed := outcome == routerOutcomeError || outcome == routerOutcomeTimeout
+	rh.window = append(rh.window, failed)
+	if len(rh.window) > routerHealthWindow {
+		rh.window = rh.window[len(rh.window)-routerHealthWindow:]
+	}
+
+	if !rh.canBench || rh.errRate <= 0 || len(rh.window) < routerHealthMinSamples {
+		return
+	}
+	if rate := rh.errorRateLocked(); rate >= rh.errRate {
+		rh.benchedUntil = time.Now().Add(rh.cooldown)
+		rh.benchedTimes++
+		rh.window = rh.window[:0]
+		routerBenchedMetric.WithLabelValues(rh.name).Set(1)
+		goLog.Warnw("benching router", "router", rh.name, "error_rate", rate, "until", rh.benchedUntil)
+		if rh.unbench == nil {
+			rh.unbench = time.AfterFunc(rh.cooldown, rh.endBench)
+		} else {
+			rh.unbench.Reset(rh.cooldown)
+		}
+	}
+}
+
+// endBench resets the benched gauge, unless the router was benched again
+// since the timer was set.
+func (rh *routerHealth) endBench() {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if !time.Now().Before(rh.benchedUntil) {
+		routerBenchedMetric.WithLabelValues(rh.name).Set(0)
+	}
+}
+
+func (rh *routerHealth) errorRateLocked() float64 {
+	if len(rh.window) == 0 {
+		return 0
+	}
+	var failures int
+	for _, f := range rh.window {
+		if f {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(rh.window))
+}
+
+// routerStatus is the JSON representation of a routerHealth.
+type routerStatus struct {
+	Name         string
+	Benched      bool
+	BenchedUntil *time.Time `json:",omitempty"`
+	BenchedTimes int
+	ErrorRate    float64
+	Operations   map[string]routerOpStats
+}
+
+func (rh *routerHealth) status() routerStatus {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	st := routerStatus{
+		Name:         rh.name,
+		BenchedTimes: rh.benchedTimes,
+		ErrorRate:    rh.errorRateLocked(),
+		Operations:   make(map[string]routerOpStats, len(rh.ops)),
+	}
+	if time.Now().Before(rh.benchedUntil) {
+		until := rh.benchedUntil
+		st.Benched = true
+		st.BenchedUntil = &until
+	}
+	for op, s := range rh.ops {
+		st.Operations[op] = *s
+	}
+	return st
+}
+
+// routersHealth is the set of routers being monitored by a node.
+type routersHealth struct {
+	errRate  float64
+	cooldown time.Duration
+
+	mu      sync.Mutex
+	routers []*routerHealth
+}
+
+func newRoutersHealth(cfg Config) *routersHealth {
+	return &routersHealth{
+		errRate:  cfg.RoutingBenchErrorRate,
+		cooldown: cfg.RoutingBenchCooldown,
+	}
+}
+
+// wrap returns a router that reports the outcome of every request made to r
+// under the given name. Routers that can be benched are skipped while their
+// error rate is too high.
+func (rhs *routersHealth) wrap(name string, r routing.Routing, canBench bool) routing.Routing {
+	rh := &routerHealth{
+		name:     name,
+		canBench: canBench,
+		errRate:  rhs.errRate,
+		cooldown: rhs.cooldown,
+		ops:      make(map[string]*routerOpStats),
+	}
+	rhs.mu.Lock()
+	rhs.routers = append(rhs.routers, rh)
+	rhs.mu.Unlock()
+
+	routerBenchedMetric.WithLabelValues(name).Set(0)
+	return &monitoredRouter{Routing: r, health: rh}
+}
+
+func (rhs *routersHealth) status() []routerStatus {
+	rhs.mu.Lock()
+	routers := slices.Clone(rhs.routers)
+	rhs.mu.Unlock()
+
+	out := make([]routerStatus, 0, len(routers))
+	for _, rh := range routers {
+		out = append(out, rh.status())
+	}
+	return out
+}
+
+// monitoredRouter reports the outcome of the requests to the wrapped router
+// to its routerHealth.
+type monitoredRouter struct {
+	routing.Routing
+	health *routerHealth
+}
+
+// supports reports whether the wrapped router implements op. Delegated
+// routers are composed from the capabilities of the endpoint, and the
+// operations they lack always return "not found" without doing anything.
+func (r *monitoredRouter) supports(op string) bool {
+	cr, ok := r.Routing.(*routinghelpers.Compose)
+	if !ok {
+		return true
+	}
+	switch op {
+	case routerOpFindProviders:
+		return cr.ContentRouting != nil
+	case routerOpFindPeer:
+		return cr.PeerRouting != nil
+	default:
+		return cr.ValueStore != nil
+	}
+}
+
+// outcomeFromErr classifies the result of a request. It returns false when
+// the request should not be accounted for: the operation is not supported by
+// the router, or the caller cancelled it.
+func outcomeFromErr(ctx context.Context, err error) (routerOutcome, bool) {
+	switch {
+	case err == nil:
+		return routerOutcomeSuccess, true
+	case errors.Is(err, routing.ErrNotSupported):
+		return "", false
+	case errors.Is(err, routing.ErrNotFound):
+		return routerOutcomeNotFound, true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return routerOutcomeTimeout, true
+	case errors.Is(err, context.Canceled):
+		return "", false
+	default:
+		return routerOutcomeError, true
+	}
+}
+
+// outcomeFromResults classifies the result of a streaming request that
+// returned n results.
+func outcomeFromResults(ctx context.Context, n int) (routerOutcome, bool) {
+	if n > 0 {
+		return routerOutcomeSuccess, true
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return routerOutcomeTimeout, true
+	case ctx.Err() != nil:
+		return "", false
+	default:
+		return routerOutcomeNotFound, true
+	}
+}
+
+func (r *monitoredRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	if !r.supports(routerOpFindProviders) {
+		return r.Routing.FindProvidersAsync(ctx, c, count)
+	}
+	if r.health.benched() {
+		ch := make(chan peer.AddrInfo)
+		close(ch)
+		return ch
+	}
+	ch := monitorStream(ctx, r.health, routerOpFindProviders, r.Routing.FindProvidersAsync(ctx, c, count))
+	return traceProviders(ctx, routerLabel(r.health.name, r.Routing), ch)
+}
+
+func (r *monitoredRouter) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	if !r.supports(routerOpFindPeer) {
+		return r.Routing.FindPeer(ctx, id)
+	}
+	if r.health.benched() {
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+	start := time.Now()
+	ai, err := r.Routing.FindPeer(ctx, id)
+	if outcome, ok := outcomeFromErr(ctx, err); ok {
+		r.health.record(routerOpFindPeer, outcome, time.Since(start), 0)
+	}
+	if trace := routingTraceFromContext(ctx); trace != nil && err == nil {
+		trace(routerLabel(r.health.name, r.Routing), ai)
+	}
+	return ai, err
+}
+
+func (r *monitoredRouter) GetValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error) {
+	if !r.supports(routerOpGetValue) {
+		return r.Routing.GetValue(ctx, key, opts...)
+	}
+	if r.health.benched() {
+		return nil, routing.ErrNotFound
+	}
+	start := time.Now()
+	val, err := r.Routing.GetValue(ctx, key, opts...)
+	if outcome, ok := outcomeFromErr(ctx, err); ok {
+		r.health.record(routerOpGetValue, outcome, time.Since(start), 0)
+	}
+	return val, err
+}
+
+func (r *monitoredRouter) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	if !r.supports(routerOpSearchValue) {
+		return r.Routing.SearchValue(ctx, key, opts...)
+	}
+	if r.health.benched() {
+		ch := make(chan []byte)
+		close(ch)
+		return ch, nil
+	}
+	start := time.Now()
+	in, err := r.Routing.SearchValue(ctx, key, opts...)
+	if err != nil {
+		if outcome, ok := outcomeFromErr(ctx, err); ok {
+			r.health.record(routerOpSearchValue, outcome, time.Since(start), 0)
+		}
+		return nil, err
+	}
+	return monitorStream(ctx, r.health, routerOpSearchValue, in), nil
+}
+
+// Close closes the wrapped router, when it can be closed.
+func (r *monitoredRouter) Close() error {
+	if c, ok := r.Routing.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// monitorStream forwards the results from in and records the outcome of the
+// request once in is closed.
+func monitorStream[T any](ctx context.Context, rh *routerHealth, op string, in <-chan T) <-chan T {
+	start := time.Now()
+	out := make(chan T)
+	go func() {
+		defer close(out)
+
+		var (
+			n       int
+			latency time.Duration
+		)
+		defer func() {
+			if n == 0 {
+				latency = time.Since(start)
+			}
+			if outcome, ok := outcomeFromResults(ctx, n); ok {
+				rh.record(op, outcome, latency, n)
+			}
+		}()
+
+		for v := range in {
+			if n == 0 {
+				latency = time.Since(start)
+			}
+			n++
+			select {
+			case out <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+var _ routing.Routing = (*monitoredRouter)(nil)
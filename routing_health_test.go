@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type failingRouter struct {
+	routinghelpers.Null
+	calls atomic.Int32
+	err   error
+}
+
+func (r *failingRouter) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	r.calls.Add(1)
+	return peer.AddrInfo{}, r.err
+}
+
+func (r *failingRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	r.calls.Add(1)
+	ch := make(chan peer.AddrInfo)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func TestRouterHealthBenching(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	_, pid := mustTestPeer(t)
+
+	rhs := newRoutersHealth(Config{
+		RoutingBenchErrorRate: 0.5,
+		RoutingBenchCooldown:  time.Hour,
+	})
+
+	bad := &failingRouter{err: errors.New("boom")}
+	benchable := rhs.wrap("bad-router", bad, true)
+
+	dht := &failingRouter{err: errors.New("boom")}
+	notBenchable := rhs.wrap("dht", dht, false)
+
+	for range routerHealthMinSamples {
+		_, err := benchable.FindPeer(ctx, pid)
+		require.Error(t, err)
+		_, err = notBenchable.FindPeer(ctx, pid)
+		require.Error(t, err)
+	}
+
+	// The benched router is not called anymore.
+	_, err := benchable.FindPeer(ctx, pid)
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	require.EqualValues(t, routerHealthMinSamples, bad.calls.Load())
+
+	// Routers that cannot be benched keep being called.
+	_, err = notBenchable.FindPeer(ctx, pid)
+	require.Error(t, err)
+	require.EqualValues(t, routerHealthMinSamples+1, dht.calls.Load())
+
+	st := rhs.status()
+	require.Len(t, st, 2)
+	require.Equal(t, "bad-router", st[0].Name)
+	require.True(t, st[0].Benched)
+	require.Equal(t, 1, st[0].BenchedTimes)
+	require.EqualValues(t, routerHealthMinSamples, st[0].Operations[routerOpFindPeer].Errors)
+	require.False(t, st[1].Benched)
+	require.Equal(t, 1.0, st[1].ErrorRate)
+}
+
+func TestRouterHealthOutcomes(t *testing.T) {
+	t.Parallel()
+
+	rhs := newRoutersHealth(Config{})
+	_, pid := mustTestPeer(t)
+
+	r := &failingRouter{err: routing.ErrNotFound}
+	mr := rhs.wrap("router", r, true)
+
+	// Not found is not a failure.
+	_, err := mr.FindPeer(t.Context(), pid)
+	require.ErrorIs(t, err, routing.ErrNotFound)
+
+	// Running out of time without results is a timeout.
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	for range mr.FindProvidersAsync(ctx, mustTestCid(t, "health"), 0) {
+	}
+
+	// Being cancelled by the caller is not accounted for.
+	ctx, cancel = context.WithCancel(t.Context())
+	cancel()
+	for range mr.FindProvidersAsync(ctx, mustTestCid(t, "health"), 0) {
+	}
+
+	st := rhs.status()[0]
+	require.EqualValues(t, 1, st.Operations[routerOpFindPeer].NotFound)
+	require.EqualValues(t, 1, st.Operations[routerOpFindProviders].Requests)
+	require.EqualValues(t, 1, st.Operations[routerOpFindProviders].Timeouts)
+	require.Equal(t, 0.5, st.ErrorRate)
+
+	// Operations not supported by a router are not accounted for.
+	cr := rhs.wrap("providers-only", &routinghelpers.Compose{}, true)
+	_, err = cr.GetValue(t.Context(), "/ipns/foo")
+	require.ErrorIs(t, err, routing.ErrNotFound)
+	require.Empty(t, rhs.status()[1].Operations)
+}
+
+func TestRouterHealthBenchedGauge(t *testing.T) {
+	t.Parallel()
+
+	rh := &routerHealth{
+		name:     "benched-gauge-router",
+		canBench: true,
+		errRate:  0.5,
+		cooldown: 100 * time.Millisecond,
+		ops:      make(map[string]*routerOpStats),
+	}
+	gauge := routerBenchedMetric.WithLabelValues(rh.name)
+	bench := func() {
+		for range routerHealthMinSamples {
+			rh.record(routerOpFindPeer, routerOutcomeError, time.Millisecond, 0)
+		}
+		require.True(t, rh.benched())
+	}
+
+	bench()
+	require.Equal(t, 1.0, testutil.ToFloat64(gauge))
+
+	// A timer of an earlier bench does not reset the gauge of the current one.
+	bench()
+	rh.mu.Lock()
+	rh.benchedUntil = time.Now().Add(time.Hour)
+	rh.mu.Unlock()
+	rh.endBench()
+	require.Equal(t, 1.0, testutil.ToFloat64(gauge))
+
+	rh.mu.Lock()
+	rh.benchedUntil = time.Now()
+	rh.mu.Unlock()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(gauge) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, rh.benchedTimes)
+}
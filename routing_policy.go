@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// Operations that can be enabled per router in a routing policy.
+const (
+	routingPolicyOpProviders = "providers"
+	routingPolicyOpPeers     = "peers"
+	routingPolicyOpIPNS      = "ipns"
+)
+
+// dhtRouterName is the name used to refer to the DHT in routing policies and
+// router health.
+const dhtRouterName = "dht"
+
+// RoutingPolicy controls how the composite router queries the DHT and the
+// HTTP routers. Routers are started in the order they are listed. Routers
+// that are not listed keep the defaults (start immediately, global timeout,
+// all operations) and are started after the listed ones.
+type RoutingPolicy struct {
+	Routers []RouterPolicy
+}
+
+// RouterPolicy is the policy for a single router.
+type RouterPolicy struct {
+	// Name is "dht" or the base URL of an HTTP router as given in
+	// RAINBOW_HTTP_ROUTERS (e.g. https://cid.contact).
+	Name string
+	// ExecuteAfter delays the start of the router.
+	ExecuteAfter policyDuration
+	// Timeout for requests to this router. Defaults to RAINBOW_ROUTING_TIMEOUT
+	// for HTTP routers, and no timeout for the DHT.
+	Timeout policyDuration
+	// Operations the router is used for: "providers", "peers" and/or "ipns".
+	// Defaults to all the operations the router supports.
+	Operations []string
+	// OnlyIfNoResults skips the router when another router already returned
+	// results by the time ExecuteAfter expires.
+	OnlyIfNoResults bool
+}
+
+// policyDuration is a time.Duration that reads from JSON strings like "300ms".
+type policyDuration time.Duration
+
+func (d *policyDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = policyDuration(v)
+	return nil
+}
+
+func (d policyDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// loadRoutingPolicy reads a JSON routing policy from path.
+func loadRoutingPolicy(path string) (*RoutingPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p RoutingPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing routing policy %q: %w", path, err)
+	}
+
+	seen := make(map[string]struct{}, len(p.Routers))
+	for _, rp := range p.Routers {
+		if rp.Name == "" {
+			return nil, fmt.Errorf("routing policy %q: router without name", path)
+		}
+		if _, ok := seen[rp.Name]; ok {
+			return nil, fmt.Errorf("routing policy %q: router %q listed more than once", path, rp.Name)
+		}
+		seen[rp.Name] = struct{}{}
+
+		if rp.ExecuteAfter < 0 || rp.Timeout < 0 {
+			return nil, fmt.Errorf("routing policy %q: router %q has negative durations", path, rp.Name)
+		}
+		for _, op := range rp.Operations {
+			switch op {
+			case routingPolicyOpProviders, routingPolicyOpPeers, routingPolicyOpIPNS:
+			default:
+				return nil, fmt.Errorf("routing policy %q: router %q has unknown operation %q: use 'providers', 'peers' or 'ipns'", path, rp.Name, op)
+			}
+		}
+	}
+
+	return &p, nil
+}
+
+// routerName returns the name a router is known by in routing policies. It is
+// empty for routers that cannot be targeted (e.g. remote backends).
+func routerName(r routing.Routing) string {
+	if mr, ok := r.(*monitoredRouter); ok {
+		return mr.health.name
+	}
+	return ""
+}
+
+// applyRoutingPolicy sets delays, timeouts and operations on routers
+// according to p, and orders them as listed in the policy.
+func applyRoutingPolicy(p *RoutingPolicy, routers []*routinghelpers.ParallelRouter) []*routinghelpers.ParallelRouter {
+	index := func(pr *routinghelpers.ParallelRouter) int {
+		name := routerName(pr.Router)
+		i := slices.IndexFunc(p.Routers, func(rp RouterPolicy) bool { return rp.Name == name })
+		if i < 0 || name == "" {
+			return len(p.Routers)
+		}
+		return i
+	}
+
+	for _, rp := range p.Routers {
+		if !slices.ContainsFunc(routers, func(pr *routinghelpers.ParallelRouter) bool { return routerName(pr.Router) == rp.Name }) {
+			goLog.Warnf("routing policy: router %q is not configured, ignoring", rp.Name)
+		}
+	}
+
+	routers = slices.Clone(routers)
+	slices.SortStableFunc(routers, func(a, b *routinghelpers.ParallelRouter) int {
+		return index(a) - index(b)
+	})
+
+	for _, pr := range routers {
+		// Routers that are not listed are wrapped too, so that their results
+		// count for the routers listed with OnlyIfNoResults.
+		i := index(pr)
+		policy := &policyRouter{Routing: pr.Router}
+		pr.Router = policy
+		if i == len(p.Routers) {
+			continue
+		}
+		rp := p.Routers[i]
+
+		pr.ExecuteAfter = time.Duration(rp.ExecuteAfter)
+		if rp.Timeout > 0 {
+			pr.Timeout = time.Duration(rp.Timeout)
+		}
+		policy.ops = rp.Operations
+		policy.onlyIfNoResults = rp.OnlyIfNoResults
+	}
+
+	return routers
+}
+
+type routingResultsKey struct{}
+
+// resultsFromContext returns the flag set by policy routers when they return
+// results for the request carried by ctx.
+func resultsFromContext(ctx context.Context) *atomic.Bool {
+	seen, _ := ctx.Value(routingResultsKey{}).(*atomic.Bool)
+	return seen
+}
+
+// policyRouter restricts the operations of a router and, when
+// onlyIfNoResults is set, skips it if other routers already returned results
+// for the same request.
+type policyRouter struct {
+	routing.Routing
+	ops             []string
+	onlyIfNoResults bool
+}
+
+func (r *policyRouter) skip(ctx context.Context, op string) bool {
+	if len(r.ops) > 0 && !slices.Contains(r.ops, op) {
+		return true
+	}
+	if !r.onlyIfNoResults {
+		return false
+	}
+	seen := resultsFromContext(ctx)
+	return seen != nil && seen.Load()
+}
+
+func (r *policyRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	if r.skip(ctx, routingPolicyOpProviders) {
+		ch := make(chan peer.AddrInfo)
+		close(ch)
+		return ch
+	}
+	return flagResults(ctx, r.Routing.FindProvidersAsync(ctx, c, count))
+}
+
+func (r *policyRouter) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	if r.skip(ctx, routingPolicyOpPeers) {
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+	ai, err := r.Routing.FindPeer(ctx, id)
+	if err == nil {
+		if seen := resultsFromContext(ctx); seen != nil {
+			seen.Store(true)
+		}
+	}
+	return ai, err
+}
+
+func (r *policyRouter) GetValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error) {
+	if r.skip(ctx, routingPolicyOpIPNS) {
+		return nil, routing.ErrNotFound
+	}
+	val, err := r.Routing.GetValue(ctx, key, opts...)
+	if err == nil {
+		if seen := resultsFromContext(ctx); seen != nil {
+			seen.Store(true)
+		}
+	}
+	return val, err
+}
+
+func (r *policyRouter) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	if r.skip(ctx, routingPolicyOpIPNS) {
+		ch := make(chan []byte)
+		close(ch)
+		return ch, nil
+	}
+	in, err := r.Routing.SearchValue(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return flagResults(ctx, in), nil
+}
+
+// flagResults forwards in and marks the request carried by ctx as having
+// results as soon as the first one arrives.
+func flagResults[T any](ctx context.Context, in <-chan T) <-chan T {
+	seen := resultsFromContext(ctx)
+	if seen == nil {
+		return in
+	}
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for v := range in {
+			seen.Store(true)
+			select {
+			case out <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// resultsTrackingRouter gives every request a fresh results flag for the
+// policy routers underneath.
+type resultsTrackingRouter struct {
+	routing.Routing
+}
+
+func withResultsFlag(ctx context.Context) context.Context {
+	return context.WithValue(ctx, routingResultsKey{}, new(atomic.Bool))
+}
+
+func (r *resultsTrackingRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	return r.Routing.FindProvidersAsync(withResultsFlag(ctx), c, count)
+}
+
+func (r *resultsTrackingRouter) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	return r.Routing.FindPeer(withResultsFlag(ctx), id)
+}
+
+func (r *resultsTrackingRouter) GetValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error) {
+	return r.Routing.GetValue(withResultsFlag(ctx), key, opts...)
+}
+
+func (r *resultsTrackingRouter) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	return r.Routing.SearchValue(withResultsFlag(ctx), key, opts...)
+}
+
+var (
+	_ routing.Routing = (*policyRouter)(nil)
+	_ routing.Routing = (*resultsTrackingRouter)(nil)
+)
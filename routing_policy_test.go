@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/stretchr/testify/require"
+)
+
+type providersRouter struct {
+	routinghelpers.Null
+	calls     atomic.Int32
+	providers []peer.AddrInfo
+}
+
+func (r *providersRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	r.calls.Add(1)
+	ch := make(chan peer.AddrInfo, len(r.providers))
+	for _, p := range r.providers {
+		ch <- p
+	}
+	close(ch)
+	return ch
+}
+
+func writeRoutingPolicy(t *testing.T, policy string) string {
+	path := filepath.Join(t.TempDir(), "routing-policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(policy), 0o600))
+	return path
+}
+
+func TestLoadRoutingPolicy(t *testing.T) {
+	t.Parallel()
+
+	p, err := loadRoutingPolicy(writeRoutingPolicy(t, `{"Routers": [
+		{"Name": "https://cid.contact", "Timeout": "5s", "Operations": ["providers"]},
+		{"Name": "dht", "ExecuteAfter": "300ms", "OnlyIfNoResults": true}
+	]}`))
+	require.NoError(t, err)
+	require.Len(t, p.Routers, 2)
+	require.Equal(t, 5*time.Second, time.Duration(p.Routers[0].Timeout))
+	require.Equal(t, 300*time.Millisecond, time.Duration(p.Routers[1].ExecuteAfter))
+	require.True(t, p.Routers[1].OnlyIfNoResults)
+
+	for _, bad := range []string{
+		`{"Routers": [{"Name": "dht", "Operations": ["blocks"]}]}`,
+		`{"Routers": [{"Name": "dht"}, {"Name": "dht"}]}`,
+		`{"Routers": [{"ExecuteAfter": "1s"}]}`,
+		`{"Routers": [{"Name": "dht", "Timeout": "soon"}]}`,
+	} {
+		_, err := loadRoutingPolicy(writeRoutingPolicy(t, bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestRoutingPolicy(t *testing.T) {
+	t.Parallel()
+
+	_, pid := mustTestPeer(t)
+	rhs := newRoutersHealth(Config{})
+
+	fast := &providersRouter{providers: []peer.AddrInfo{{ID: pid}}}
+	dht := &providersRouter{providers: []peer.AddrInfo{{ID: pid}}}
+	peersOnly := &providersRouter{providers: []peer.AddrInfo{{ID: pid}}}
+
+	cfg := Config{
+		RoutingPolicy: &RoutingPolicy{Routers: []RouterPolicy{
+			{Name: "https://fast.example"},
+			{Name: dhtRouterName, ExecuteAfter: policyDuration(100 * time.Millisecond), OnlyIfNoResults: true},
+			{Name: "https://peers.example", Operations: []string{routingPolicyOpPeers}},
+		}},
+	}
+	router := setupCompositeRouting([]routing.Routing{
+		rhs.wrap("https://peers.example", peersOnly, true),
+		rhs.wrap("https://fast.example", fast, true),
+	}, rhs.wrap(dhtRouterName, dht, false), cfg)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	// The delayed DHT is skipped because the first router had results, and
+	// the peers-only router is never asked for providers.
+	require.NotEmpty(t, collectProviders(router.FindProvidersAsync(ctx, mustTestCid(t, "policy"), 0)))
+	require.EqualValues(t, 1, fast.calls.Load())
+	require.Zero(t, dht.calls.Load())
+	require.Zero(t, peersOnly.calls.Load())
+
+	// Without results from the first router, the DHT is used.
+	fast.providers = nil
+	require.NotEmpty(t, collectProviders(router.FindProvidersAsync(ctx, mustTestCid(t, "policy"), 0)))
+	require.EqualValues(t, 2, fast.calls.Load())
+	require.EqualValues(t, 1, dht.calls.Load())
+}
+
+func TestRoutingPolicyUnlistedRouterResults(t *testing.T) {
+	t.Parallel()
+
+	_, pid := mustTestPeer(t)
+	rhs := newRoutersHealth(Config{})
+
+	unlisted := &providersRouter{providers: []peer.AddrInfo{{ID: pid}}}
+	dht := &providersRouter{providers: []peer.AddrInfo{{ID: pid}}}
+
+	cfg := Config{
+		RoutingPolicy: &RoutingPolicy{Routers: []RouterPolicy{
+			{Name: dhtRouterName, ExecuteAfter: policyDuration(100 * time.Millisecond), OnlyIfNoResults: true},
+		}},
+	}
+	router := setupCompositeRouting([]routing.Routing{
+		rhs.wrap("https://unlisted.example", unlisted, true),
+	}, rhs.wrap(dhtRouterName, dht, false), cfg)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	// Results from a router that is not in the policy also skip the DHT.
+	require.NotEmpty(t, collectProviders(router.FindProvidersAsync(ctx, mustTestCid(t, "unlisted"), 0)))
+	require.EqualValues(t, 1, unlisted.calls.Load())
+	require.Zero(t, dht.calls.Load())
+}
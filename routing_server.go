@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ipfs-shipyard/nopfs"
+	"github.com/ipfs/boxo/ipns"
+	"github.com/ipfs/boxo/routing/http/server"
+	"github.com/ipfs/boxo/routing/http/types"
+	"github.com/ipfs/boxo/routing/http/types/iter"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// routingServer exposes the routing of a node (DHT, HTTP routers, provider
+// cache) as a read-only Delegated Routing V1 HTTP API. Lookups for denylisted
+// content and names are answered as not found.
+type routingServer struct {
+	cr      routing.ContentRouting
+	pr      routing.PeerRouting
+	vs      routing.ValueStore
+	blocker *nopfs.Blocker
+	// reloader, when not nil, holds the denylists subscribed to at runtime.
+	reloader *reloader
+}
+
+func setupRoutingServerHandler(cfg Config, nd *Node, rl *reloader) (http.Handler, error) {
+	if nd.cr == nil || nd.pr == nil || nd.vs == nil {
+		return nil, errors.New("the routing server requires libp2p to be enabled")
+	}
+
+	var opts []server.Option
+	if cfg.RoutingTimeout > 0 {
+		opts = append(opts, server.WithRoutingTimeout(cfg.RoutingTimeout))
+	}
+
+	return server.Handler(&routingServer{
+		cr:       nd.cr,
+		pr:       nd.pr,
+		vs:       nd.vs,
+		blocker:  nd.blocker,
+		reloader: rl,
+	}, opts...), nil
+}
+
+func (rs *routingServer) FindProviders(ctx context.Context, c cid.Cid, limit int) (iter.ResultIter[types.Record], error) {
+	for _, b := range rs.blockers() {
+		if err := b.IsCidBlocked(c).ToError(); err != nil {
+			return nil, fmt.Errorf("%w: %w", routing.ErrNotFound, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &routingResultsIter[peer.AddrInfo, types.Record]{
+		ch:     rs.cr.FindProvidersAsync(ctx, c, limit),
+		cancel: cancel,
+		convert: func(ai peer.AddrInfo) types.Record {
+			return peerRecord(ai)
+		},
+	}, nil
+}
+
+func (rs *routingServer) FindPeers(ctx context.Context, pid peer.ID, limit int) (iter.ResultIter[*types.PeerRecord], error) {
+	ai, err := rs.pr.FindPeer(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	return iter.ToResultIter[*types.PeerRecord](iter.FromSlice([]*types.PeerRecord{peerRecord(ai)})), nil
+}
+
+func (rs *routingServer) GetIPNS(ctx context.Context, name ipns.Name) (*ipns.Record, error) {
+	if err := rs.checkName(name); err != nil {
+		return nil, err
+	}
+
+	raw, err := rs.vs.GetValue(ctx, string(name.RoutingKey()))
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := ipns.UnmarshalRecord(raw)
+	if err != nil {
+		return nil, err
+	}
+	return rec, ipns.ValidateWithName(rec, name)
+}
+
+// PutIPNS is not supported: the server only answers lookups, it does not
+// publish records on behalf of its clients.
+func (rs *routingServer) PutIPNS(ctx context.Context, name ipns.Name, rec *ipns.Record) error {
+	return routing.ErrNotSupported
+}
+
+func (rs *routingServer) checkName(name ipns.Name) error {
+	for _, b := range rs.blockers() {
+		if err := b.IsPathBlocked(name.AsPath()).ToError(); err != nil {
+			return fmt.Errorf("%w: %w", routing.ErrNotFound, err)
+		}
+	}
+	return nil
+}
+
+// blockers returns the blocker of the denylists loaded at startup and, when
+// there are some, the one of the denylists subscribed to by a reload.
+func (rs *routingServer) blockers() []*nopfs.Blocker {
+	blockers := []*nopfs.Blocker{rs.blocker}
+	if rs.reloader != nil {
+		if b := rs.reloader.runtimeBlocker(); b != nil {
+			blockers = append(blockers, b)
+		}
+	}
+	return blockers
+}
+
+func (rs *routingServer) ProvideBitswap(ctx context.Context, req *server.BitswapWriteProvideRequest) (time.Duration, error) {
+	return 0, routing.ErrNotSupported
+}
+
+func (rs *routingServer) GetClosestPeers(ctx context.Context, key cid.Cid) (iter.ResultIter[*types.PeerRecord], error) {
+	return nil, routing.ErrNotSupported
+}
+
+func peerRecord(ai peer.AddrInfo) *types.PeerRecord {
+	addrs := make([]types.Multiaddr, 0, len(ai.Addrs))
+	for _, a := range ai.Addrs {
+		addrs = append(addrs, types.Multiaddr{Multiaddr: a})
+	}
+	return &types.PeerRecord{
+		Schema: types.SchemaPeer,
+		ID:     &ai.ID,
+		Addrs:  addrs,
+	}
+}
+
+// routingResultsIter turns a channel of routing results into the iterator
+// expected by the routing server. Closing it cancels the lookup.
+type routingResultsIter[T, U any] struct {
+	ch      <-chan T
+	cancel  context.CancelFunc
+	convert func(T) U
+	val     iter.Result[U]
+}
+
+func (it *routingResultsIter[T, U]) Next() bool {
+	v, ok := <-it.ch
+	if !ok {
+		return false
+	}
+	it.val = iter.Result[U]{Val: it.convert(v)}
+	return true
+}
+
+func (it *routingResultsIter[T, U]) Val() iter.Result[U] {
+	return it.val
+}
+
+func (it *routingResultsIter[T, U]) Close() error {
+	it.cancel()
+	return nil
+}
+
+var _ server.DelegatedRouter = (*routingServer)(nil)
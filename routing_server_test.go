@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/nopfs"
+	"github.com/ipfs/boxo/ipns"
+	"github.com/ipfs/boxo/path"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingServer(t *testing.T) {
+	t.Parallel()
+
+	sk, pid := mustTestPeer(t)
+	allowed := mustTestCid(t, "routing-server-allowed")
+	blocked := mustTestCid(t, "routing-server-blocked")
+
+	denylist := filepath.Join(t.TempDir(), "test.deny")
+	require.NoError(t, os.WriteFile(denylist, []byte("/ipfs/"+blocked.String()+"\n"), 0o600))
+	blocker, err := nopfs.NewBlocker([]string{denylist})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = blocker.Close() })
+
+	// Denylists subscribed to by a reload apply too.
+	runtimeBlocked := mustTestCid(t, "routing-server-runtime-blocked")
+	runtimeDenylist := filepath.Join(t.TempDir(), "runtime.deny")
+	require.NoError(t, os.WriteFile(runtimeDenylist, []byte("/ipfs/"+runtimeBlocked.String()+"\n"), 0o600))
+	runtimeBlocker, err := nopfs.NewBlocker([]string{runtimeDenylist})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runtimeBlocker.Close() })
+	rl := &reloader{}
+
+	cr := &countingContentRouter{providers: []peer.AddrInfo{{ID: pid}}}
+	handler, err := setupRoutingServerHandler(Config{}, &Node{
+		cr:      cr,
+		pr:      routinghelpers.Null{},
+		vs:      routinghelpers.Null{},
+		blocker: blocker,
+	}, rl)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	get := func(path string) (int, string) {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	code, body := get("/routing/v1/providers/" + allowed.String())
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, pid.String())
+
+	// Denylisted content is never looked up.
+	code, body = get("/routing/v1/providers/" + blocked.String())
+	require.Equal(t, http.StatusOK, code)
+	require.NotContains(t, body, pid.String())
+	require.EqualValues(t, 1, cr.calls.Load())
+
+	code, body = get("/routing/v1/providers/" + runtimeBlocked.String())
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, pid.String())
+	rl.mu.Lock()
+	rl.blocker = runtimeBlocker
+	rl.mu.Unlock()
+	code, body = get("/routing/v1/providers/" + runtimeBlocked.String())
+	require.Equal(t, http.StatusOK, code)
+	require.NotContains(t, body, pid.String())
+	require.EqualValues(t, 2, cr.calls.Load())
+
+	// IPNS records cannot be published through the routing server.
+	rec, err := ipns.NewRecord(sk, path.FromCid(allowed), 1, time.Now().Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	raw, err := ipns.MarshalRecord(rec)
+	require.NoError(t, err)
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, ts.URL+"/routing/v1/ipns/"+ipns.NameFromPeer(pid).String(), bytes.NewReader(raw))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/vnd.ipfs.ipns-record")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	msg, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	require.Contains(t, string(msg), routing.ErrNotSupported.Error())
+	require.ErrorIs(t, (&routingServer{}).PutIPNS(t.Context(), ipns.NameFromPeer(pid), rec), routing.ErrNotSupported)
+
+	// The routing server needs libp2p routing.
+	_, err = setupRoutingServerHandler(Config{}, &Node{vs: routinghelpers.Null{}}, nil)
+	require.Error(t, err)
+}
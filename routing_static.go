@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+)
+
+// staticRouterName is the name used to refer to the static router in routing
+// policies and router health.
+const staticRouterName = "static"
+
+// staticRoutingReloadInterval is how often the static routing file is checked
+// for changes.
+const staticRoutingReloadInterval = 10 * time.Second
+
+// staticRoutingFile is the format of RAINBOW_ROUTING_STATIC_FILE. Providers
+// maps a CID, a CID prefix ending in "*" or the "*" wildcard to provider
+// peer multiaddrs (with /p2p/) or HTTP gateway URLs.
+type staticRoutingFile struct {
+	Providers map[string][]string
+}
+
+type staticPrefix struct {
+	prefix    string
+	providers []peer.AddrInfo
+}
+
+// staticRoutingTable is a parsed staticRoutingFile.
+type staticRoutingTable struct {
+	exact    map[string][]peer.AddrInfo // by multihash
+	prefixes []staticPrefix             // longest first
+	fallback []peer.AddrInfo
+	peers    map[peer.ID]peer.AddrInfo
+}
+
+func parseStaticRoutingFile(data []byte) (*staticRoutingTable, error) {
+	var f staticRoutingFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	t := &staticRoutingTable{
+		exact: make(map[string][]peer.AddrInfo),
+		peers: make(map[peer.ID]peer.AddrInfo),
+	}
+
+	for key, entries := range f.Providers {
+		var providers []peer.AddrInfo
+		for _, e := range entries {
+			ai, err := parseStaticProvider(e)
+			if err != nil {
+				return nil, fmt.Errorf("providers for %q: %w", key, err)
+			}
+			providers = append(providers, ai)
+
+			known := t.peers[ai.ID]
+			known.ID = ai.ID
+			for _, a := range ai.Addrs {
+				if !slices.ContainsFunc(known.Addrs, a.Equal) {
+					known.Addrs = append(known.Addrs, a)
+				}
+			}
+			t.peers[ai.ID] = known
+		}
+
+		switch {
+		case key == "*":
+			t.fallback = providers
+		case strings.HasSuffix(key, "*"):
+			t.prefixes = append(t.prefixes, staticPrefix{prefix: strings.TrimSuffix(key, "*"), providers: providers})
+		default:
+			c, err := cid.Decode(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CID %q: %w", key, err)
+			}
+			t.exact[string(c.Hash())] = providers
+		}
+	}
+
+	// Longest prefix wins.
+	slices.SortFunc(t.prefixes, func(a, b staticPrefix) int {
+		return len(b.prefix) - len(a.prefix)
+	})
+	return t, nil
+}
+
+// parseStaticProvider parses a peer multiaddr or an HTTP gateway URL.
+//
+// URLs carry no peer ID, so a synthetic one is derived from the sha256 of the
+// URL: every entry with the same URL is the same provider, and it never
+// matches a real peer. Gateways with a peer ID of their own must be given as
+// a multiaddr, e.g. /dns/example.com/tcp/443/https/p2p/12D3KooW... URLs must
+// point to the root of the gateway, as multiaddrs have no path.
+func parseStaticProvider(s string) (peer.AddrInfo, error) {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		ai, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		return *ai, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	if strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return peer.AddrInfo{}, fmt.Errorf("HTTP gateway URL %q must not have a path, query, fragment or credentials", s)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	host := "/dns/" + u.Hostname()
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		host = "/ip4/" + ip.String()
+		if ip.To4() == nil {
+			host = "/ip6/" + ip.String()
+		}
+	}
+
+	ma, err := multiaddr.NewMultiaddr(fmt.Sprintf("%s/tcp/%s/%s", host, port, u.Scheme))
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	mh, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	return peer.AddrInfo{ID: peer.ID(mh), Addrs: []multiaddr.Multiaddr{ma}}, nil
+}
+
+func (t *staticRoutingTable) providers(c cid.Cid) []peer.AddrInfo {
+	if providers, ok := t.exact[string(c.Hash())]; ok {
+		return providers
+	}
+	s := c.String()
+	for _, p := range t.prefixes {
+		if strings.HasPrefix(s, p.prefix) {
+			return p.providers
+		}
+	}
+	return t.fallback
+}
+
+// staticRouter answers provider and peer lookups from a file mapping CIDs to
+// known providers. The file is reloaded when it changes.
+type staticRouter struct {
+	path string
+
+	mu      sync.RWMutex
+	table   *staticRoutingTable
+	modTime time.Time
+}
+
+func newStaticRouter(path string) (*staticRouter, error) {
+	sr := &staticRouter{path: path}
+	if _, err := sr.reload(); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// reload reads the file again if it was modified since the last load.
+func (sr *staticRouter) reload() (bool, error) {
+	st, err := os.Stat(sr.path)
+	if err != nil {
+		return false, err
+	}
+
+	sr.mu.RLock()
+	unchanged := st.ModTime().Equal(sr.modTime)
+	sr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(sr.path)
+	if err != nil {
+		return false, err
+	}
+	table, err := parseStaticRoutingFile(data)
+	if err != nil {
+		return false, fmt.Errorf("parsing static routing file %q: %w", sr.path, err)
+	}
+
+	sr.mu.Lock()
+	sr.table = table
+	sr.modTime = st.ModTime()
+	sr.mu.Unlock()
+	return true, nil
+}
+
+// startReloader checks the file for changes until ctx is cancelled. Broken
+// files are logged and the previous table is kept. The reloading goroutine is
+// added to wg.
+func (sr *staticRouter) startReloader(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		ticker := time.NewTicker(staticRoutingReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reloaded, err := sr.reload()
+				if err != nil {
+					goLog.Errorw("error reloading static routing file", "path", sr.path, "err", err)
+					continue
+				}
+				if reloaded {
+					goLog.Infow("reloaded static routing file", "path", sr.path)
+				}
+			}
+		}
+	})
+}
+
+func (sr *staticRouter) current() *staticRoutingTable {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.table
+}
+
+func (sr *staticRouter) Provide(context.Context, cid.Cid, bool) error {
+	return routing.ErrNotSupported
+}
+
+func (sr *staticRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	providers := sr.current().providers(c)
+	if count > 0 && len(providers) > count {
+		providers = providers[:count]
+	}
+
+	ch := make(chan peer.AddrInfo, len(providers))
+	for _, ai := range providers {
+		ch <- ai
+	}
+	close(ch)
+	return ch
+}
+
+func (sr *staticRouter) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	ai, ok := sr.current().peers[id]
+	if !ok {
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+	return ai, nil
+}
+
+var (
+	_ routing.ContentRouting = (*staticRouter)(nil)
+	_ routing.PeerRouting    = (*staticRouter)(nil)
+)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// providerCacheRouterName is the router reported for providers answered by
+// the provider record cache.
+const providerCacheRouterName = "cache"
+
+type routingTraceKey struct{}
+
+// routingTraceFunc is called for every result returned by an individual
+// router during a traced lookup. It may be called concurrently.
+type routingTraceFunc func(router string, ai peer.AddrInfo)
+
+// withRoutingTrace returns a context that makes the routers report their
+// results to trace.
+func withRoutingTrace(ctx context.Context, trace routingTraceFunc) context.Context {
+	return context.WithValue(ctx, routingTraceKey{}, trace)
+}
+
+func routingTraceFromContext(ctx context.Context) routingTraceFunc {
+	trace, _ := ctx.Value(routingTraceKey{}).(routingTraceFunc)
+	return trace
+}
+
+// routerLabel is the name reported in traces for a router: the accelerated
+// DHT client is told apart from the standard one.
+func routerLabel(name string, r routing.Routing) string {
+	if b, ok := r.(*bundledDHT); ok && b.fullRT.Ready() {
+		return name + " (fullrt)"
+	}
+	return name
+}
+
+// traceProviders reports the providers from in to the trace in ctx, if any.
+func traceProviders(ctx context.Context, router string, in <-chan peer.AddrInfo) <-chan peer.AddrInfo {
+	trace := routingTraceFromContext(ctx)
+	if trace == nil {
+		return in
+	}
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		for ai := range in {
+			trace(router, ai)
+			select {
+			case out <- ai:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -5,10 +5,12 @@ import (
 	crand "crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/pebble/v2"
@@ -23,7 +25,6 @@ import (
 	"github.com/ipfs/boxo/gateway"
 	"github.com/ipfs/boxo/namesys"
 	"github.com/ipfs/boxo/path/resolver"
-	"github.com/ipfs/boxo/peering"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
@@ -35,11 +36,14 @@ import (
 	"github.com/ipfs/go-unixfsnode"
 	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/metrics"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/routing"
 	"github.com/libp2p/go-libp2p/gologshim"
 	"github.com/libp2p/go-libp2p/p2p/host/observedaddrs"
@@ -88,17 +92,42 @@ func init() {
 }
 
 type Node struct {
-	ns           namesys.NameSystem
-	vs           routing.ValueStore
-	dataDir      string
-	bsrv         blockservice.BlockService
-	denylistSubs []*nopfs.HTTPSubscriber
+	ns      namesys.NameSystem
+	vs      routing.ValueStore
+	dataDir string
+	bsrv    blockservice.BlockService
+	// denylistMu guards denylistSubs, the subscriptions by URL, which
+	// reloads replace.
+	denylistMu    sync.Mutex
+	denylistSubs  map[string]*nopfs.HTTPSubscriber
+	blocker       *nopfs.Blocker
+	routersHealth *routersHealth
 
 	// Maybe not be set depending on the configuration:
-	host       host.Host
-	datastore  datastore.Batching
-	blockstore blockstore.Blockstore
-	resolver   resolver.Resolver
+	host           host.Host
+	datastore      datastore.Batching
+	metadata       datastore.Batching
+	cr             routing.ContentRouting
+	pr             routing.PeerRouting
+	blockstore     blockstore.Blockstore
+	resolver       resolver.Resolver
+	providerCache  *providerCache
+	reputation     *providerReputation
+	rootProvider   *rootProvider
+	peering        *peeringManager
+	bitswap        *bitswapInspector
+	prefetcher     *dagPrefetcher
+	warmer         *cacheWarmer
+	httpRetrieval  *httpRetrieval
+	tuning         *bitswapTuning
+	servingLimiter *servingLimiter
+	dht            routing.Routing
+
+	// Closed by close, in order:
+	dhtHost    host.Host
+	routers    []io.Closer
+	cancel     context.CancelFunc
+	background sync.WaitGroup
 }
 
 type Config struct {
@@ -108,27 +137,43 @@ type Config struct {
 	ListenAddrs   []string
 	AnnounceAddrs []string
 
-	ConnMgrLow   int
-	ConnMgrHi    int
-	ConnMgrGrace time.Duration
+	ConnMgrLow       int
+	ConnMgrHi        int
+	ConnMgrGrace     time.Duration
+	PersistPeerstore bool
+	WarmPeers        int
 
 	InMemBlockCache int64
 	MaxMemory       uint64
 	MaxFD           int
 
-	GatewayDomains           []string
-	SubdomainGatewayDomains  []string
-	TrustlessGatewayDomains  []string
-	DNSLinkGatewayDomains    []string
-	RoutingV1Endpoints       []string
-	RoutingV1FilterProtocols []string
-	HTTPRoutersTimeout       time.Duration
-	RoutingTimeout           time.Duration
-	RoutingIgnoreProviders   []peer.ID
-	DHTRouting               DHTRouting
-	DHTSharedHost            bool
-	IpnsMaxCacheTTL          time.Duration
-	Bitswap                  bool
+	GatewayDomains             []string
+	SubdomainGatewayDomains    []string
+	TrustlessGatewayDomains    []string
+	DNSLinkGatewayDomains      []string
+	GatewayDomainPolicies      map[string]*GatewayDomain
+	RoutingV1Endpoints         []string
+	RoutingV1FilterProtocols   []string
+	HTTPRoutersTimeout         time.Duration
+	RoutingTimeout             time.Duration
+	RoutingIgnoreProviders     []peer.ID
+	RoutingCacheTTL            time.Duration
+	RoutingBenchErrorRate      float64
+	RoutingBenchCooldown       time.Duration
+	RoutingPolicy              *RoutingPolicy
+	RoutingStaticFile          string
+	ProviderReputation         bool
+	ProviderReputationMinScore float64
+	DHTRouting                 DHTRouting
+	DHTSharedHost              bool
+	DHTProtocolPrefix          protocol.ID
+	DHTServer                  bool
+	DHTProvideStrategy         DHTProvideStrategy
+	DHTProvideMaxRoots         int
+	DHTProvideInterval         time.Duration
+	SwarmKey                   pnet.PSK
+	IpnsMaxCacheTTL            time.Duration
+	Bitswap                    bool
 
 	DNSLinkResolver madns.BasicResolver
 
@@ -138,16 +183,30 @@ type Config struct {
 	// when processing HaveWant requests.
 	BitswapWantHaveReplaceSize       int
 	BitswapEnableDuplicateBlockStats bool
+	BitswapInspect                   bool
+	BitswapServerPublic              bool
+	BitswapServerPeerRequests        int
+	BitswapServerPeerBandwidth       int64
+	BitswapServerMaxBandwidth        int64
+	PrefetchDepth                    int
+	PrefetchConcurrency              int
 
 	DenylistSubs []string
 
-	Peering            []peer.AddrInfo
-	PeeringSharedCache bool
+	Peering                     []peer.AddrInfo
+	PeeringDNS                  []multiaddr.Multiaddr
+	PeeringDNSInterval          time.Duration
+	PeeringSharedCache          bool
+	PeeringSharedCacheAll       bool
+	PeeringCacheSummaryInterval time.Duration
 
 	Seed                string
 	SeedIndex           int
 	SeedPeering         bool
 	SeedPeeringMaxIndex int
+	SeedPeeringSharding bool
+	// Size of the in-memory cache of the blocks owned by other instances.
+	SeedPeeringShardingMemory int
 
 	RemoteBackends     []string
 	RemoteBackendsIPNS bool
@@ -177,6 +236,10 @@ type Config struct {
 	RoutingMaxProviders int
 	RoutingMaxTimeout   time.Duration
 
+	// Bitswap client session delays.
+	BitswapProviderSearchDelay time.Duration
+	BitswapRebroadcastDelay    time.Duration
+
 	// HTTP Retrieval configuration
 	HTTPRetrievalEnable                    bool
 	HTTPRetrievalAllowlist                 []string
@@ -199,6 +262,9 @@ type Config struct {
 	MaxDeserializedResponseSize int64
 	MaxUnixFSDAGResponseSize    int64
 	DiagnosticServiceURL        string
+
+	// Minimum number of connected peers for the node to be ready.
+	ReadyMinPeers int
 }
 
 func SetupNoLibp2p(ctx context.Context, cfg Config, dnsCache *cachedDNS) (*Node, error) {
@@ -221,41 +287,69 @@ func SetupNoLibp2p(ctx context.Context, cfg Config, dnsCache *cachedDNS) (*Node,
 
 	// Setup a Value Store composed of both the remote backends and the delegated
 	// routers, if they exist. This vs is only used for resolving IPNS Records.
-	vs, err := setupRoutingNoLibp2p(cfg, dnsCache)
+	rhs := newRoutersHealth(cfg)
+	vs, err := setupRoutingNoLibp2p(cfg, dnsCache, rhs)
 	if err != nil {
 		return nil, err
 	}
 
+	n := &Node{
+		vs:            vs,
+		dataDir:       cfg.DataDir,
+		denylistSubs:  denylists,
+		blocker:       blocker,
+		routersHealth: rhs,
+	}
+	// The background tasks stop when the node is closed.
+	ctx, n.cancel = context.WithCancel(ctx)
+
 	// Setup the remote blockstore if that's the mode we're using.
-	var bsrv blockservice.BlockService
 	if cfg.RemoteBackendMode == RemoteBackendBlock {
 		blkst, err := gateway.NewRemoteBlockstore(cfg.RemoteBackends, nil)
 		if err != nil {
 			return nil, err
 		}
 
-		bsrv = blockservice.New(blkst, offline.Exchange(blkst))
+		bsrv := blockservice.New(blkst, offline.Exchange(blkst))
 		bsrv = nopfsipfs.WrapBlockService(bsrv, blocker)
+		if cfg.PrefetchDepth > 0 {
+			n.prefetcher = newDAGPrefetcher(ctx, &n.background, bsrv, cfg.PrefetchDepth, cfg.PrefetchConcurrency)
+			bsrv = n.prefetcher
+		}
+		n.bsrv = bsrv
 	}
 
-	ns, err := setupNamesys(cfg, vs, blocker, cfg.DNSLinkResolver)
+	n.ns, err = setupNamesys(cfg, vs, blocker, cfg.DNSLinkResolver)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Node{
-		vs:           vs,
-		ns:           ns,
-		dataDir:      cfg.DataDir,
-		denylistSubs: denylists,
-		bsrv:         bsrv,
-	}, nil
+	return n, nil
 }
 
 func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCache *cachedDNS) (*Node, error) {
 	if !cfg.Bitswap && cfg.DHTRouting == DHTOff {
 		return nil, errors.New("libp2p is enabled, but not used: bitswap and dht are disabled")
 	}
+	if cfg.DHTServer {
+		// Provider records point to the DHT host: it must be the one serving
+		// the blocks over Bitswap.
+		if cfg.DHTRouting == DHTOff || !cfg.DHTSharedHost || !cfg.Bitswap {
+			return nil, errors.New("dht server mode requires dht routing, a shared dht host and bitswap")
+		}
+	}
+	if cfg.SeedPeeringSharding && (!cfg.SeedPeering || !cfg.PeeringSharedCache || !cfg.PeeringSharedCacheAll || !cfg.Bitswap) {
+		return nil, errors.New("cache sharding requires seed peering, a peering cache shared with all peers and bitswap")
+	}
+	if cfg.SeedPeeringSharding && cfg.SeedPeeringShardingMemory <= 0 {
+		return nil, errors.New("cache sharding requires a positive memory size for the blocks owned by other instances")
+	}
+	if cfg.BitswapServerPublic && !cfg.Bitswap {
+		return nil, errors.New("public bitswap server requires bitswap")
+	}
+	if cfg.WarmPeers > 0 && !cfg.PersistPeerstore {
+		return nil, errors.New("warm peers require a persisted peerstore")
+	}
 
 	var err error
 
@@ -270,9 +364,13 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 	}
 
 	n := &Node{
-		dataDir:      cfg.DataDir,
-		denylistSubs: denylists,
+		dataDir:       cfg.DataDir,
+		denylistSubs:  denylists,
+		blocker:       blocker,
+		routersHealth: newRoutersHealth(cfg),
 	}
+	// The background tasks stop when the node is closed.
+	ctx, n.cancel = context.WithCancel(ctx)
 
 	bwc := metrics.NewBandwidthCounter()
 
@@ -292,16 +390,20 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 		libp2p.Identity(key),
 		libp2p.UserAgent("rainbow/" + buildVersion()),
 		libp2p.BandwidthReporter(bwc),
-		libp2p.DefaultTransports,
 		libp2p.DefaultMuxers,
 		libp2p.ResourceManager(bitswapRcMgr),
 		libp2p.EnableHolePunching(),
 	}
+	opts = append(opts, transportOptions(cfg)...)
 
 	if len(cfg.ListenAddrs) == 0 {
 		// Note: because the transports are set above we must also set the listen addresses
 		// We need to set listen addresses in order for hole punching to work
-		opts = append(opts, libp2p.DefaultListenAddrs)
+		if len(cfg.SwarmKey) > 0 {
+			opts = append(opts, libp2p.ListenAddrStrings(privateNetworkListenAddrs...))
+		} else {
+			opts = append(opts, libp2p.DefaultListenAddrs)
+		}
 	} else {
 		opts = append(opts, libp2p.ListenAddrStrings(cfg.ListenAddrs...))
 	}
@@ -325,27 +427,48 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 		return nil, err
 	}
 
+	mds := setupMetadataDatastore(cfg)
+	n.metadata = mds
+
 	var (
-		vs      routing.ValueStore
-		cr      routing.ContentRouting
-		pr      routing.PeerRouting
-		dhtHost host.Host
+		vs        routing.ValueStore
+		cr        routing.ContentRouting
+		pr        routing.PeerRouting
+		dhtRouter routing.Routing
+		dhtHost   host.Host
 	)
 
 	opts = append(opts, libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
-		cr, pr, vs, dhtHost, err = setupRouting(cfg, h, ds, dhtRcMgr, bwc, dnsCache)
+		cr, pr, vs, dhtRouter, dhtHost, err = setupRouting(ctx, &n.background, cfg, h, ds, mds, dhtRcMgr, bwc, dnsCache, n.routersHealth)
 		return pr, err
 	}))
 	h, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, err
 	}
+	if dhtHost != h {
+		n.dhtHost = dhtHost
+	}
+	n.dht = dhtRouter
+	if c, ok := dhtRouter.(io.Closer); ok {
+		n.routers = append(n.routers, c)
+	}
+	// pr is a DHT of its own when seed peering cannot use the main one.
+	if seedDHT, ok := pr.(*dht.IpfsDHT); ok {
+		n.routers = append(n.routers, seedDHT)
+	}
 
-	err = setupPeering(cfg, h)
+	n.peering, err = setupPeering(ctx, &n.background, cfg, h, mds)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.RoutingCacheTTL > 0 && cr != nil {
+		n.providerCache = newProviderCache(cr, mds, cfg.RoutingCacheTTL)
+		n.providerCache.startSweeper(ctx, &n.background)
+		cr = n.providerCache
+	}
+
 	var bsrv blockservice.BlockService
 	if cfg.Bitswap {
 		blkst := blockstore.NewBlockstore(ds,
@@ -356,6 +479,18 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 			// See also comment in blockservice.
 			blockstore.WriteThrough(true),
 		)
+		var ring *shardRing
+		if cfg.SeedPeeringSharding {
+			fleet, err := derivePeerIDs(cfg.Seed, cfg.SeedIndex, cfg.SeedPeeringMaxIndex)
+			if err != nil {
+				return nil, err
+			}
+			ring = newShardRing(h, fleet)
+			if err := ring.start(ctx, &n.background); err != nil {
+				return nil, err
+			}
+			blkst = newShardingBlockstore(blkst, ring, cfg.SeedPeeringShardingMemory)
+		}
 		blkst = &switchingBlockstore{
 			baseBlockstore:      blkst,
 			contextSwitchingKey: NoBlockcache{},
@@ -369,7 +504,45 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 		if dhtHost != nil && dhtHost != h {
 			dhtAddrs = dhtHost.Peerstore()
 		}
-		bsrv = blockservice.New(blkst, setupBitswapExchange(ctx, cfg, h, dhtAddrs, cr, blkst),
+		var wp *warmPeers
+		if cfg.WarmPeers > 0 {
+			wp, err = newWarmPeers(ctx, h, mds, cfg.WarmPeers)
+			if err != nil {
+				return nil, err
+			}
+			wp.start(ctx, &n.background)
+		}
+		if cfg.ProviderReputation {
+			n.reputation, err = newProviderReputation(ctx, mds, cfg.ProviderReputationMinScore)
+			if err != nil {
+				return nil, err
+			}
+			n.reputation.start(ctx, &n.background)
+		}
+
+		var cs *cacheSummaries
+		if cfg.PeeringSharedCache && cfg.PeeringCacheSummaryInterval > 0 {
+			cs = newCacheSummaries(h, blkst, n.peering, cfg.PeeringCacheSummaryInterval)
+			cs.start(ctx, &n.background)
+		}
+
+		if cfg.BitswapInspect {
+			n.bitswap = newBitswapInspector()
+			n.bitswap.start(ctx, &n.background)
+		}
+		n.tuning = newBitswapTuning(cfg)
+		if cfg.HTTPRetrievalEnable {
+			n.httpRetrieval = newHTTPRetrieval(cfg.HTTPRetrievalAllowlist, cfg.HTTPRetrievalDenylist)
+			n.httpRetrieval.start(ctx, &n.background)
+		}
+		// Serving blocks to anyone is subject to budgets, so that it never
+		// competes with the gateway.
+		if cfg.BitswapServerPublic || cfg.DHTServer {
+			n.servingLimiter = newServingLimiter(cfg.BitswapServerPeerRequests, cfg.BitswapServerPeerBandwidth, cfg.BitswapServerMaxBandwidth)
+			n.servingLimiter.start(ctx, &n.background)
+		}
+
+		bsrv = blockservice.New(blkst, setupBitswapExchange(ctx, cfg, h, dhtAddrs, cr, blkst, n.reputation, wp, n.peering, ring, cs, n.bitswap, n.httpRetrieval, n.servingLimiter),
 			// if we are doing things right, our bitswap wantlists should
 			// not have blocks that we already have (see
 			// https://github.com/ipfs/boxo/blob/e0d4b3e9b91e9904066a10278e366c9a6d9645c7/blockservice/blockservice.go#L272). Thus
@@ -378,6 +551,14 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 			// before writing new blocks.
 			blockservice.WriteThrough(true),
 		)
+
+		if cfg.DHTServer && cfg.DHTProvideMaxRoots > 0 {
+			n.rootProvider, err = newRootProvider(ctx, cfg, dhtRouter, blkst, mds)
+			if err != nil {
+				return nil, err
+			}
+			n.rootProvider.start(ctx, &n.background)
+		}
 	} else {
 		if len(cfg.RemoteBackends) == 0 || cfg.RemoteBackendMode != RemoteBackendBlock {
 			return nil, errors.New("remote backends in block mode must be set when disabling bitswap")
@@ -396,12 +577,19 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 	}
 
 	bsrv = nopfsipfs.WrapBlockService(bsrv, blocker)
+	// The cache warmer walks the DAGs itself, it does not go through the
+	// prefetcher.
+	warmBsrv := bsrv
+	if cfg.PrefetchDepth > 0 {
+		n.prefetcher = newDAGPrefetcher(ctx, &n.background, bsrv, cfg.PrefetchDepth, cfg.PrefetchConcurrency)
+		bsrv = n.prefetcher
+	}
 
-	fetcherCfg := bsfetcher.NewFetcherConfig(bsrv)
-	fetcherCfg.PrototypeChooser = dagpb.AddSupportToChooser(bsfetcher.DefaultPrototypeChooser)
-	fetcher := fetcherCfg.WithReifier(unixfsnode.Reify)
-	r := resolver.NewBasicResolver(fetcher)
-	r = nopfsipfs.WrapResolver(r, blocker)
+	r := setupResolver(bsrv, blocker)
+	warmResolver := r
+	if n.prefetcher != nil {
+		warmResolver = setupResolver(warmBsrv, blocker)
+	}
 
 	n.host = h
 	n.datastore = ds
@@ -413,12 +601,24 @@ func SetupWithLibp2p(ctx context.Context, cfg Config, key crypto.PrivKey, dnsCac
 		return nil, err
 	}
 
+	n.cr = cr
+	n.pr = pr
 	n.vs = vs
 	n.ns = ns
+	n.warmer = newCacheWarmer(ctx, &n.background, warmBsrv, ns, warmResolver)
 
 	return n, nil
 }
 
+// setupResolver returns the path resolver fetching the blocks from bsrv.
+func setupResolver(bsrv blockservice.BlockService, blocker *nopfs.Blocker) resolver.Resolver {
+	fetcherCfg := bsfetcher.NewFetcherConfig(bsrv)
+	fetcherCfg.PrototypeChooser = dagpb.AddSupportToChooser(bsfetcher.DefaultPrototypeChooser)
+	fetcher := fetcherCfg.WithReifier(unixfsnode.Reify)
+	r := resolver.NewBasicResolver(fetcher)
+	return nopfsipfs.WrapResolver(r, blocker)
+}
+
 func setupDatastore(cfg Config) (datastore.Batching, error) {
 	switch cfg.BlockstoreType {
 	case "flatfs":
@@ -480,6 +680,14 @@ func setupDatastore(cfg Config) (datastore.Batching, error) {
 	}
 }
 
+// setupMetadataDatastore returns the datastore used to persist rainbow's own
+// state (caches, routing tables...). It is kept apart from the blockstore
+// datastore because the latter may be flatfs, which only accepts block keys.
+// It is only created on disk once a feature writes to it.
+func setupMetadataDatastore(cfg Config) datastore.Batching {
+	return newLazyDatastore(filepath.Join(cfg.DataDir, "metadata"))
+}
+
 func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
 	data, err := os.ReadFile(kf)
 	if err != nil {
@@ -506,58 +714,64 @@ func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
 	return crypto.UnmarshalPrivateKey(data)
 }
 
-func setupPeering(cfg Config, h host.Host) error {
-	if len(cfg.Peering) == 0 && !cfg.SeedPeering {
-		return nil
-	}
-
-	ps := peering.NewPeeringService(h)
-	if err := ps.Start(); err != nil {
-		return err
+// setupPeering starts the peering service with the configured, DNS and seed
+// peers, and the peers added at runtime that were persisted in ds.
+func setupPeering(ctx context.Context, wg *sync.WaitGroup, cfg Config, h host.Host, ds datastore.Datastore) (*peeringManager, error) {
+	pm, err := newPeeringManager(ctx, wg, h, ds)
+	if err != nil {
+		return nil, err
 	}
-	for _, a := range cfg.Peering {
-		ps.AddPeer(a)
+	pm.shareAll = cfg.PeeringSharedCacheAll
+	pm.addConfigured(peeringSourceConfig, cfg.Peering...)
+	pm.dns = newDNSPeering(ctx, wg, pm, madns.DefaultResolver, cfg.PeeringDNS, cfg.PeeringDNSInterval)
+	if len(cfg.PeeringDNS) > 0 {
+		pm.dns.start()
 	}
 
 	if !cfg.SeedPeering {
-		return nil
+		return pm, nil
 	}
 
 	if cfg.SeedIndex < 0 {
-		return fmt.Errorf("seed index must be equal or greater than 0, it is %d", cfg.SeedIndex)
+		return nil, fmt.Errorf("seed index must be equal or greater than 0, it is %d", cfg.SeedIndex)
 	}
 
 	if cfg.SeedPeeringMaxIndex < 0 {
-		return fmt.Errorf("seed peering max index must be a positive number, it is %d", cfg.SeedPeeringMaxIndex)
+		return nil, fmt.Errorf("seed peering max index must be a positive number, it is %d", cfg.SeedPeeringMaxIndex)
 	}
 
 	pids, err := derivePeerIDs(cfg.Seed, cfg.SeedIndex, cfg.SeedPeeringMaxIndex)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, pid := range pids {
 		// The peering module will automatically perform lookups to find the
 		// addresses of the given peers.
-		ps.AddPeer(peer.AddrInfo{ID: pid})
+		pm.addConfigured(peeringSourceSeed, peer.AddrInfo{ID: pid})
 	}
 
-	return nil
+	return pm, nil
 }
 
-func setupDenylists(cfg Config) ([]*nopfs.HTTPSubscriber, *nopfs.Blocker, error) {
+// setupDenylists subscribes to the denylists of cfg, and returns the
+// subscriptions by URL and the blocker of the denylists in the data directory.
+func setupDenylists(cfg Config) (map[string]*nopfs.HTTPSubscriber, *nopfs.Blocker, error) {
 	err := os.Mkdir(filepath.Join(cfg.DataDir, "denylists"), 0755)
 	if err != nil && !errors.Is(err, fs.ErrExist) {
 		return nil, nil, err
 	}
 
-	var denylists []*nopfs.HTTPSubscriber
+	denylists := make(map[string]*nopfs.HTTPSubscriber)
 	for _, dl := range cfg.DenylistSubs {
-		s, err := nopfs.NewHTTPSubscriber(dl, filepath.Join(cfg.DataDir, "denylists", filepath.Base(dl)), time.Minute)
+		if _, ok := denylists[dl]; ok {
+			continue
+		}
+		s, err := newDenylistSubscriber(cfg.DataDir, dl)
 		if err != nil {
 			return nil, nil, err
 		}
-		denylists = append(denylists, s)
+		denylists[dl] = s
 	}
 
 	files, err := nopfs.GetDenylistFilesInDir(filepath.Join(cfg.DataDir, "denylists"))
@@ -572,6 +786,17 @@ func setupDenylists(cfg Config) ([]*nopfs.HTTPSubscriber, *nopfs.Blocker, error)
 	return denylists, blocker, nil
 }
 
+// denylistFile returns the file a denylist subscription is appended to.
+func denylistFile(dataDir, url string) string {
+	return filepath.Join(dataDir, "denylists", filepath.Base(url))
+}
+
+// newDenylistSubscriber subscribes to the denylist at url. The first download
+// is done before returning.
+func newDenylistSubscriber(dataDir, url string) (*nopfs.HTTPSubscriber, error) {
+	return nopfs.NewHTTPSubscriber(url, denylistFile(dataDir, url), time.Minute)
+}
+
 func setupNamesys(cfg Config, vs routing.ValueStore, blocker *nopfs.Blocker, dnslinkResolver madns.BasicResolver) (namesys.NameSystem, error) {
 	nsOptions := []namesys.Option{namesys.WithDNSResolver(dnslinkResolver)}
 	if cfg.IpnsMaxCacheTTL > 0 {
@@ -3,12 +3,12 @@ package main
 import (
 	"context"
 	"slices"
-	"time"
 
 	"github.com/ipfs/boxo/routing/providerquerymanager"
 
 	"github.com/ipfs/boxo/bitswap"
 	bsclient "github.com/ipfs/boxo/bitswap/client"
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
 	"github.com/ipfs/boxo/bitswap/network"
 	bsnet "github.com/ipfs/boxo/bitswap/network/bsnet"
 	"github.com/ipfs/boxo/bitswap/network/httpnet"
@@ -84,8 +84,15 @@ func isUndialableMergedAddr(a ma.Multiaddr) bool {
 
 // setupBitswapExchange wires bitswap onto h, the main libp2p host. In the
 // split-host setup (dhtAddrs non-nil), h is wrapped so each bitswap Connect
-// copies DHT-known public addresses into the peerstore before dialing.
-func setupBitswapExchange(ctx context.Context, cfg Config, h host.Host, dhtAddrs peerstore.AddrBook, cr routing.ContentRouting, bstore blockstore.Blockstore) exchange.Interface {
+// copies DHT-known public addresses into the peerstore before dialing. When
+// rep is set, the outcomes of the requests sent to providers are tracked and
+// providers with a bad reputation are skipped. When wp is set, the peers
+// sending us blocks are tracked so they can be reconnected to after a restart.
+// The wants, sessions and messages of the client are reported to bi. When
+// HTTP retrieval is enabled, hr filters and tracks the HTTP providers. When
+// cs is set, the peered peers whose cache summary contains a requested block
+// are its first providers.
+func setupBitswapExchange(ctx context.Context, cfg Config, h host.Host, dhtAddrs peerstore.AddrBook, cr routing.ContentRouting, bstore blockstore.Blockstore, rep *providerReputation, wp *warmPeers, pm *peeringManager, ring *shardRing, cs *cacheSummaries, bi *bitswapInspector, hr *httpRetrieval, limiter *servingLimiter) exchange.Interface {
 	bsctx := metri.CtxScope(ctx, "ipfs_bitswap")
 
 	connEvtMgr := network.NewConnectEventManager()
@@ -99,24 +106,53 @@ func setupBitswapExchange(ctx context.Context, cfg Config, h host.Host, dhtAddrs
 	bn := bsnet.NewFromIpfsHost(bitswapHost, bsnet.WithConnectEventManager(connEvtMgr))
 
 	if cfg.HTTPRetrievalEnable {
-
+		// hr also enforces the allowlist and the denylist, as changed at
+		// runtime with /mgr/http-retrieval. Hosts added to the allowlist
+		// or removed from the denylist at runtime are still checked
+		// against the startup lists by httpnet.
 		htnet := httpnet.New(h,
-			httpnet.WithHTTPWorkers(cfg.HTTPRetrievalWorkers),
-			httpnet.WithMaxDontHaveErrors(cfg.HTTPRetrievalMaxDontHaveErrors),
 			httpnet.WithAllowlist(cfg.HTTPRetrievalAllowlist),
 			httpnet.WithDenylist(cfg.HTTPRetrievalDenylist),
+			httpnet.WithHTTPWorkers(cfg.HTTPRetrievalWorkers),
+			httpnet.WithMaxDontHaveErrors(cfg.HTTPRetrievalMaxDontHaveErrors),
 			httpnet.WithUserAgent("rainbow/"+buildVersion()),
 			httpnet.WithMetricsLabelsForEndpoints(cfg.HTTPRetrievalMetricsLabelsForEndpoints),
 			httpnet.WithConnectEventManager(connEvtMgr),
 		)
-		exnet = network.New(h.Peerstore(), bn, htnet)
+		hr.net = htnet
+		hr.addrs = h.Peerstore()
+		observed := &observingNetwork{BitSwapNetwork: htnet, sent: []messageHook{hr.sent}, received: []messageHook{hr.received}}
+		exnet = network.New(h.Peerstore(), bn, &httpRetrievalNetwork{BitSwapNetwork: observed, hr: hr})
 	} else {
 		exnet = bn
 	}
 
+	observed := &observingNetwork{BitSwapNetwork: exnet}
+	if bi != nil {
+		observed.sent = append(observed.sent, bi.sent)
+		observed.received = append(observed.received, bi.received)
+	}
+	if wp != nil {
+		observed.received = append(observed.received, wp.received)
+	}
+	if rep != nil {
+		observed.sent = append(observed.sent, rep.sent)
+		observed.received = append(observed.received, rep.received)
+		cr = &reputationRouter{ContentRouting: cr, rep: rep}
+	}
+	if ring != nil {
+		cr = &shardRouter{ContentRouting: cr, ring: ring}
+	}
+
+	publicServer := limiter != nil
+	if publicServer {
+		observed.sent = append(observed.sent, limiter.sent)
+	}
+	exnet = observed
+
 	// Custom query manager with the content router and the host
 	// and our custom options to overwrite the default.
-	pqm, err := providerquerymanager.New(exnet, cr,
+	pqm, err := providerquerymanager.New(exnet, &queryTimeoutRouter{ContentRouting: cr},
 		providerquerymanager.WithMaxInProcessRequests(cfg.RoutingMaxRequests),
 		providerquerymanager.WithMaxProviders(cfg.RoutingMaxProviders),
 		providerquerymanager.WithMaxTimeout(cfg.RoutingMaxTimeout),
@@ -128,19 +164,15 @@ func setupBitswapExchange(ctx context.Context, cfg Config, h host.Host, dhtAddrs
 	context.AfterFunc(ctx, func() {
 		pqm.Close()
 	})
-
-	// --- Client Options
-	// bitswap.RebroadcastDelay: default is 1 minute to search for a random
-	// live-want (1 CID).  I think we want to search for random live-wants more
-	// often although probably it overlaps with general rebroadcasts.
-	const rebroadcastDelay = 10 * time.Second
-	// bitswap.ProviderSearchDelay: default is 1 second.
-	const providerSearchDelay = 1 * time.Second
+	var providerFinder routing.ContentDiscovery = pqm
+	if cs != nil {
+		providerFinder = &summaryFinder{ContentDiscovery: providerFinder, cs: cs}
+	}
 
 	// --- Bitswap Client Options
 	clientOpts := []bsclient.Option{
-		bsclient.RebroadcastDelay(rebroadcastDelay),
-		bsclient.ProviderSearchDelay(providerSearchDelay),
+		bsclient.RebroadcastDelay(cfg.BitswapRebroadcastDelay),
+		bsclient.ProviderSearchDelay(cfg.BitswapProviderSearchDelay),
 		bsclient.WithDefaultProviderQueryManager(false), // we pass it in manually
 	}
 
@@ -148,47 +180,59 @@ func setupBitswapExchange(ctx context.Context, cfg Config, h host.Host, dhtAddrs
 		clientOpts = append(clientOpts, bsclient.WithoutDuplicatedBlockStats())
 	}
 
-	// If peering and shared cache are both enabled, we initialize both a
-	// Client and a Server with custom request filter and custom options.
+	// If peering and shared cache are both enabled, or if we serve the
+	// network (public server, or DHT server mode providing cached roots), we
+	// initialize both a Client and a Server with custom options.
 	// client+server is more expensive but necessary when deployment requires
-	// serving cached blocks to safelisted peerids
-	if cfg.PeeringSharedCache && len(cfg.Peering) > 0 {
-		var peerBlockRequestFilter bsserver.PeerBlockRequestFilter
-
-		// Set up request filter to only respond to request for safelisted (peered) nodes
-		peers := make(map[peer.ID]struct{}, len(cfg.Peering))
-		for _, a := range cfg.Peering {
-			peers[a.ID] = struct{}{}
-		}
-		peerBlockRequestFilter = func(p peer.ID, c cid.Cid) bool {
-			_, ok := peers[p]
-			return ok
-		}
-
+	// serving cached blocks to safelisted peerids, or to anyone.
+	// The server is built even without --peering, so that the peers added at
+	// runtime with /mgr/peering can fetch from the cache.
+	if cfg.PeeringSharedCache || publicServer {
 		// turn bitswap clients option into bitswap options
 		var opts []bitswap.Option
 		for _, o := range clientOpts {
 			opts = append(opts, bitswap.WithClientOption(o))
 		}
 
+		// Set up request filter to only respond to request for safelisted
+		// (peered) nodes, or to anyone within the budgets when serving
+		// publicly. Peers can be added and removed at runtime with
+		// /mgr/peering.
+		var peerBlockRequestFilter bsserver.PeerBlockRequestFilter = func(p peer.ID, c cid.Cid) bool {
+			return cfg.PeeringSharedCache && pm.sharesCache(p)
+		}
+		if publicServer {
+			peerBlockRequestFilter = func(p peer.ID, c cid.Cid) bool {
+				return (cfg.PeeringSharedCache && pm.sharesCache(p)) || limiter.allow(p)
+			}
+		}
+		opts = append(opts, bitswap.WithPeerBlockRequestFilter(peerBlockRequestFilter))
+
 		// ---- Server Options
 		opts = append(opts,
-			bitswap.WithPeerBlockRequestFilter(peerBlockRequestFilter),
 			// When we don't have a block, don't reply. This reduces processment.
 			bitswap.SetSendDontHaves(false),
 			bitswap.WithWantHaveReplaceSize(cfg.BitswapWantHaveReplaceSize),
 		)
 
 		// Initialize client+server
-		bswap := bitswap.New(bsctx, exnet, pqm, bstore, opts...)
+		bswap := bitswap.New(bsctx, exnet, providerFinder, bstore, opts...)
 		exnet.Start(bswap)
-		return &noNotifyExchange{bswap}
+		if bi == nil {
+			return &noNotifyExchange{bswap}
+		}
+		bi.client, bi.server = bswap.Client, bswap.Server
+		return &noNotifyExchange{&inspectingExchange{SessionExchange: bswap, bi: bi}}
 	}
 
 	// By default, rainbow runs with bitswap client alone
-	bswap := bsclient.New(bsctx, exnet, pqm, bstore, clientOpts...)
+	bswap := bsclient.New(bsctx, exnet, providerFinder, bstore, clientOpts...)
 	exnet.Start(bswap)
-	return bswap
+	if bi == nil {
+		return bswap
+	}
+	bi.client = bswap
+	return &inspectingExchange{SessionExchange: bswap, bi: bi}
 }
 
 type noNotifyExchange struct {
@@ -199,3 +243,72 @@ func (e *noNotifyExchange) NotifyNewBlocks(ctx context.Context, blocks ...blocks
 	// Rainbow does not notify when we get new blocks in our Blockservice.
 	return nil
 }
+
+// messageHook is called with the Bitswap messages sent to or received from
+// a peer.
+type messageHook func(p peer.ID, msg bsmsg.BitSwapMessage)
+
+// observingNetwork calls the sent hooks with the messages sent over the
+// network, and the received hooks with the messages received from it.
+type observingNetwork struct {
+	network.BitSwapNetwork
+	sent     []messageHook
+	received []messageHook
+}
+
+func (n *observingNetwork) SendMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+	for _, hook := range n.sent {
+		hook(p, msg)
+	}
+	return n.BitSwapNetwork.SendMessage(ctx, p, msg)
+}
+
+func (n *observingNetwork) NewMessageSender(ctx context.Context, p peer.ID, opts *network.MessageSenderOpts) (network.MessageSender, error) {
+	ms, err := n.BitSwapNetwork.NewMessageSender(ctx, p, opts)
+	if err != nil || len(n.sent) == 0 {
+		return ms, err
+	}
+	return &observingMessageSender{MessageSender: ms, p: p, sent: n.sent}, nil
+}
+
+func (n *observingNetwork) Start(receivers ...network.Receiver) {
+	if len(n.received) > 0 {
+		wrapped := make([]network.Receiver, 0, len(receivers))
+		for _, r := range receivers {
+			wrapped = append(wrapped, &observingReceiver{Receiver: r, received: n.received})
+		}
+		receivers = wrapped
+	}
+	n.BitSwapNetwork.Start(receivers...)
+}
+
+type observingMessageSender struct {
+	network.MessageSender
+	p    peer.ID
+	sent []messageHook
+}
+
+func (ms *observingMessageSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	for _, hook := range ms.sent {
+		hook(ms.p, msg)
+	}
+	return ms.MessageSender.SendMsg(ctx, msg)
+}
+
+type observingReceiver struct {
+	network.Receiver
+	received []messageHook
+}
+
+func (r *observingReceiver) ReceiveMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) {
+	for _, hook := range r.received {
+		hook(p, msg)
+	}
+	r.Receiver.ReceiveMessage(ctx, p, msg)
+}
+
+var (
+	_ network.BitSwapNetwork = (*observingNetwork)(nil)
+	_ network.MessageSender  = (*observingMessageSender)(nil)
+	_ network.Receiver       = (*observingReceiver)(nil)
+)
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	ocprom "contrib.go.opencensus.io/exporter/prometheus"
@@ -50,7 +52,7 @@ func init() {
 	view.SetReportingPeriod(2 * time.Second)
 }
 
-func setupDelegatedRouting(cfg Config, dnsCache *cachedDNS) ([]routing.Routing, error) {
+func setupDelegatedRouting(cfg Config, dnsCache *cachedDNS, rhs *routersHealth) ([]routing.Routing, error) {
 	// Set configurable timeout with 30s default
 	timeout := cfg.HTTPRoutersTimeout
 	if timeout == 0 {
@@ -108,7 +110,7 @@ func setupDelegatedRouting(cfg Config, dnsCache *cachedDNS) ([]routing.Routing,
 		if err != nil {
 			return nil, err
 		}
-		delegatedRouters = append(delegatedRouters, delegatedRouter)
+		delegatedRouters = append(delegatedRouters, rhs.wrap(baseURL, delegatedRouter, true))
 	}
 
 	return delegatedRouters, nil
@@ -138,7 +140,7 @@ func parseBootstrapPeers(peers []string, warnOnAuto bool) ([]peer.AddrInfo, erro
 	return bootstrapPeers, nil
 }
 
-func setupDHTRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr network.ResourceManager, bwc metrics.Reporter) (routing.Routing, host.Host, error) {
+func setupDHTRouting(cfg Config, h host.Host, ds, mds datastore.Batching, dhtRcMgr network.ResourceManager, bwc metrics.Reporter) (routing.Routing, host.Host, error) {
 	if cfg.DHTRouting == DHTOff {
 		return nil, nil, nil
 	}
@@ -154,6 +156,9 @@ func setupDHTRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr ne
 		if !cfg.SeedPeering {
 			return nil, nil, fmt.Errorf("no valid bootstrap peers configured - provide bootstrap peers or enable autoconf")
 		}
+		if isPrivateNetwork(cfg) {
+			return nil, nil, errors.New("no valid bootstrap peers configured for the private network")
+		}
 		// Use default bootstrap peers for seed peering
 		bootstrapPeers = dht.GetDefaultBootstrapPeerAddrInfos()
 	}
@@ -162,23 +167,29 @@ func setupDHTRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr ne
 	if cfg.DHTSharedHost {
 		dhtHost = h
 	} else {
-		dhtHost, err = libp2p.New(
-			libp2p.UserAgent("rainbow/"+buildVersion()),
+		opts := []libp2p.Option{
+			libp2p.UserAgent("rainbow/" + buildVersion()),
 			libp2p.NoListenAddrs,
 			libp2p.BandwidthReporter(bwc),
-			libp2p.DefaultTransports,
 			libp2p.DefaultMuxers,
 			libp2p.ResourceManager(dhtRcMgr),
-		)
+		}
+		dhtHost, err = libp2p.New(append(opts, transportOptions(cfg)...)...)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
+	dhtMode := dht.ModeClient
+	if cfg.DHTServer {
+		dhtMode = dht.ModeServer
+	}
+
 	standardClient, err := dht.New(dhtHost,
+		dht.ProtocolPrefix(dhtProtocolPrefix(cfg)),
 		dht.Datastore(ds),
 		dht.BootstrapPeers(bootstrapPeers...),
-		dht.Mode(dht.ModeClient),
+		dht.Mode(dhtMode),
 	)
 	if err != nil {
 		return nil, nil, err
@@ -189,7 +200,15 @@ func setupDHTRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr ne
 	}
 
 	if cfg.DHTRouting == DHTAccelerated {
-		fullRTClient, err := fullrt.NewFullRT(dhtHost, dht.DefaultPrefix,
+		// The crawled routing table is saved so that the accelerated client
+		// does not need to crawl the whole network again after a restart.
+		rtFilter := dhtRoutingTableFilter(cfg)
+		crawler, err := newPersistentCrawler(dhtHost, mds, dhtProtocolPrefix(cfg), rtFilter)
+		if err != nil {
+			return nil, nil, err
+		}
+		fullRTClient, err := fullrt.NewFullRT(dhtHost, dhtProtocolPrefix(cfg),
+			fullrt.WithCrawler(crawler),
 			fullrt.DHTOption(
 				dht.Validator(record.NamespacedValidator{
 					"pk":   record.PublicKeyValidator{},
@@ -198,10 +217,13 @@ func setupDHTRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr ne
 				dht.Datastore(ds),
 				dht.BootstrapPeers(bootstrapPeers...),
 				dht.BucketSize(20),
+				dht.RoutingTableFilter(rtFilter),
 			))
 		if err != nil {
 			return nil, nil, err
 		}
+		refresh := fullRTClient.TriggerRefresh
+		crawler.refresh.Store(&refresh)
 		return &bundledDHT{
 			standard: standardClient,
 			fullRT:   fullRTClient,
@@ -216,7 +238,7 @@ func setupCompositeRouting(delegatedRouters []routing.Routing, dht routing.Routi
 	var router routing.Routing
 	router = &routinghelpers.Null{}
 
-	if len(delegatedRouters) == 0 && dht != nil {
+	if len(delegatedRouters) == 0 && dht != nil && cfg.RoutingPolicy == nil {
 		router = dht
 	} else {
 		var routers []*routinghelpers.ParallelRouter
@@ -245,23 +267,48 @@ func setupCompositeRouting(delegatedRouters []routing.Routing, dht routing.Routi
 			})
 		}
 
+		if cfg.RoutingPolicy != nil {
+			routers = applyRoutingPolicy(cfg.RoutingPolicy, routers)
+		}
+
 		if len(routers) > 0 {
 			router = routinghelpers.NewComposableParallel(routers)
+			if cfg.RoutingPolicy != nil {
+				router = &resultsTrackingRouter{Routing: router}
+			}
 		}
 	}
 
 	return router
 }
 
-func setupRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr network.ResourceManager, bwc metrics.Reporter, dnsCache *cachedDNS) (routing.ContentRouting, routing.PeerRouting, routing.ValueStore, host.Host, error) {
-	delegatedRouters, err := setupDelegatedRouting(cfg, dnsCache)
+func setupRouting(ctx context.Context, wg *sync.WaitGroup, cfg Config, h host.Host, ds, mds datastore.Batching, dhtRcMgr network.ResourceManager, bwc metrics.Reporter, dnsCache *cachedDNS, rhs *routersHealth) (routing.ContentRouting, routing.PeerRouting, routing.ValueStore, routing.Routing, host.Host, error) {
+	delegatedRouters, err := setupDelegatedRouting(cfg, dnsCache, rhs)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
 	}
 
-	dhtRouter, dhtHost, err := setupDHTRouting(cfg, h, ds, dhtRcMgr, bwc)
+	if cfg.RoutingStaticFile != "" {
+		sr, err := newStaticRouter(cfg.RoutingStaticFile)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		sr.startReloader(ctx, wg)
+		// Static providers are known to be right: list them first.
+		delegatedRouters = append([]routing.Routing{rhs.wrap(staticRouterName, &routinghelpers.Compose{
+			ContentRouting: sr,
+			PeerRouting:    sr,
+		}, false)}, delegatedRouters...)
+	}
+
+	dhtRouter, dhtHost, err := setupDHTRouting(cfg, h, ds, mds, dhtRcMgr, bwc)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
+	}
+	if dhtRouter != nil {
+		// The DHT is our fallback of last resort: it is monitored, but never
+		// benched.
+		dhtRouter = rhs.wrap(dhtRouterName, dhtRouter, false)
 	}
 
 	router := setupCompositeRouting(delegatedRouters, dhtRouter, cfg)
@@ -277,7 +324,7 @@ func setupRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr netwo
 	if len(cfg.RemoteBackends) > 0 && cfg.RemoteBackendsIPNS {
 		remoteValueStore, err := gateway.NewRemoteValueStore(cfg.RemoteBackends, nil)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, err
 		}
 		vs = setupCompositeRouting(append(delegatedRouters, &routinghelpers.Compose{
 			ValueStore: remoteValueStore,
@@ -291,11 +338,12 @@ func setupRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr netwo
 		// Parse bootstrap peers for seed peering DHT (don't warn on auto since it's expected)
 		seedBootstrapPeers, err := parseBootstrapPeers(cfg.Bootstrap, false)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, err
 		}
 
 		// Use provided bootstrap peers or fall back to defaults
 		dhtOpts := []dht.Option{
+			dht.ProtocolPrefix(dhtProtocolPrefix(cfg)),
 			dht.Datastore(ds),
 			dht.Mode(dht.ModeClient),
 		}
@@ -308,15 +356,15 @@ func setupRouting(cfg Config, h host.Host, ds datastore.Batching, dhtRcMgr netwo
 
 		pr, err = dht.New(h, dhtOpts...)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, err
 		}
 	}
 
-	return cr, pr, vs, dhtHost, nil
+	return cr, pr, vs, dhtRouter, dhtHost, nil
 }
 
-func setupRoutingNoLibp2p(cfg Config, dnsCache *cachedDNS) (routing.ValueStore, error) {
-	delegatedRouters, err := setupDelegatedRouting(cfg, dnsCache)
+func setupRoutingNoLibp2p(cfg Config, dnsCache *cachedDNS, rhs *routersHealth) (routing.ValueStore, error) {
+	delegatedRouters, err := setupDelegatedRouting(cfg, dnsCache, rhs)
 	if err != nil {
 		return nil, err
 	}
@@ -374,6 +422,10 @@ func (b *bundledDHT) Bootstrap(ctx context.Context) error {
 	return b.standard.Bootstrap(ctx)
 }
 
+func (b *bundledDHT) Close() error {
+	return errors.Join(b.fullRT.Close(), b.standard.Close())
+}
+
 var _ routing.Routing = (*bundledDHT)(nil)
 
 // delegatedHTTPContentRouterWithCapabilities creates a routing client with selective capabilities
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// shardVirtualNodes is the number of points every instance has on the
+	// hash ring, so that CIDs are spread evenly.
+	shardVirtualNodes = 128
+)
+
+var (
+	shardBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "sharding_blocks_total",
+		Help:      "Number of blocks written by owner: 'local' blocks are cached on disk, 'remote' ones only in memory.",
+	}, []string{"owner"})
+	shardMembers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "rainbow",
+		Name:      "sharding_members",
+		Help:      "Number of instances on the cache sharding hash ring, including this one.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(shardBlocks, shardMembers)
+}
+
+type shardPoint struct {
+	hash uint64
+	id   peer.ID
+}
+
+// shardRing assigns every CID to an owner among the instances of the fleet
+// using consistent hashing, so that only the CIDs of an instance move when it
+// joins or leaves. Only the instances we are connected to are on the ring.
+type shardRing struct {
+	h     host.Host
+	fleet map[peer.ID]struct{}
+
+	points atomic.Pointer[[]shardPoint]
+}
+
+func newShardRing(h host.Host, fleet []peer.ID) *shardRing {
+	r := &shardRing{
+		h:     h,
+		fleet: make(map[peer.ID]struct{}, len(fleet)),
+	}
+	for _, p := range fleet {
+		r.fleet[p] = struct{}{}
+	}
+	r.update()
+	return r
+}
+
+func shardHash(b []byte) uint64 {
+	sum := sha256.Sum256(b)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// update rebuilds the ring with ourselves and the connected instances.
+func (r *shardRing) update() {
+	members := []peer.ID{r.h.ID()}
+	for p := range r.fleet {
+		if r.h.Network().Connectedness(p) == network.Connected {
+			members = append(members, p)
+		}
+	}
+
+	points := make([]shardPoint, 0, len(members)*shardVirtualNodes)
+	for _, p := range members {
+		for i := range shardVirtualNodes {
+			points = append(points, shardPoint{
+				hash: shardHash(strconv.AppendInt([]byte(p), int64(i), 10)),
+				id:   p,
+			})
+		}
+	}
+	slices.SortFunc(points, func(a, b shardPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+
+	r.points.Store(&points)
+	shardMembers.Set(float64(len(members)))
+}
+
+// owner returns the instance owning c. CIDs with the same multihash have the
+// same owner.
+func (r *shardRing) owner(c cid.Cid) peer.ID {
+	points := *r.points.Load()
+	h := shardHash(c.Hash())
+	i, _ := slices.BinarySearchFunc(points, h, func(p shardPoint, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(points) {
+		i = 0
+	}
+	return points[i].id
+}
+
+// owns reports whether we own c.
+func (r *shardRing) owns(c cid.Cid) bool {
+	return r.owner(c) == r.h.ID()
+}
+
+// start updates the ring as instances connect and disconnect, until ctx is
+// cancelled. The updating goroutine is added to wg.
+func (r *shardRing) start(ctx context.Context, wg *sync.WaitGroup) error {
+	sub, err := r.h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		return err
+	}
+	wg.Go(func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				if _, ok := r.fleet[e.(event.EvtPeerConnectednessChanged).Peer]; ok {
+					r.update()
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// shardRouter returns the owner of a CID as its first provider, so that it is
+// asked before the rest of the network.
+type shardRouter struct {
+	routing.ContentRouting
+	ring *shardRing
+}
+
+func (r *shardRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	owner := r.ring.owner(c)
+	if owner == r.ring.h.ID() {
+		return r.ContentRouting.FindProvidersAsync(ctx, c, count)
+	}
+
+	in := r.ContentRouting.FindProvidersAsync(ctx, c, count)
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		select {
+		case out <- peer.AddrInfo{ID: owner, Addrs: r.ring.h.Peerstore().Addrs(owner)}:
+		case <-ctx.Done():
+			return
+		}
+		for ai := range in {
+			if ai.ID == owner {
+				continue
+			}
+			select {
+			case out <- ai:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// shardingBlockstore only writes the blocks we own to disk. The blocks owned
+// by other instances are kept in a bounded in-memory cache, long enough to
+// serve the requests that fetched them. memSize bounds the memory used by these
+// blocks.
+type shardingBlockstore struct {
+	blockstore.Blockstore
+	ring *shardRing
+	mem  *blockMemCache
+}
+
+func newShardingBlockstore(bs blockstore.Blockstore, ring *shardRing, memSize int) *shardingBlockstore {
+	return &shardingBlockstore{
+		Blockstore: bs,
+		ring:       ring,
+		mem:        newBlockMemCache(memSize),
+	}
+}
+
+func (s *shardingBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if s.mem.get(c) != nil {
+		return true, nil
+	}
+	return s.Blockstore.Has(ctx, c)
+}
+
+func (s *shardingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if b := s.mem.get(c); b != nil {
+		// Blocks are cached by multihash, like in the blockstore.
+		return blocks.NewBlockWithCid(b.RawData(), c)
+	}
+	return s.Blockstore.Get(ctx, c)
+}
+
+func (s *shardingBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if b := s.mem.get(c); b != nil {
+		return len(b.RawData()), nil
+	}
+	return s.Blockstore.GetSize(ctx, c)
+}
+
+func (s *shardingBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	return s.PutMany(ctx, []blocks.Block{b})
+}
+
+func (s *shardingBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	owned := make([]blocks.Block, 0, len(blks))
+	for _, b := range blks {
+		if s.ring.owns(b.Cid()) {
+			owned = append(owned, b)
+			continue
+		}
+		s.mem.add(b)
+	}
+	shardBlocks.WithLabelValues("local").Add(float64(len(owned)))
+	shardBlocks.WithLabelValues("remote").Add(float64(len(blks) - len(owned)))
+	if len(owned) == 0 {
+		return nil
+	}
+	return s.Blockstore.PutMany(ctx, owned)
+}
+
+func (s *shardingBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	s.mem.remove(c)
+	return s.Blockstore.DeleteBlock(ctx, c)
+}
+
+var _ blockstore.Blockstore = (*shardingBlockstore)(nil)
+
+// blockMemCache is a LRU cache of blocks bounded by their total size.
+type blockMemCache struct {
+	max int
+
+	// mu serializes the changes to the cache, so that size is updated by
+	// the eviction callback.
+	mu    sync.Mutex
+	size  int
+	cache *lru.Cache[string, blocks.Block]
+}
+
+func newBlockMemCache(max int) *blockMemCache {
+	m := &blockMemCache{max: max}
+	// The cache is bounded by size, not by the number of blocks.
+	m.cache, _ = lru.NewWithEvict(math.MaxInt, func(_ string, b blocks.Block) {
+		m.size -= len(b.RawData())
+	})
+	return m
+}
+
+func (m *blockMemCache) get(c cid.Cid) blocks.Block {
+	b, _ := m.cache.Get(string(c.Hash()))
+	return b
+}
+
+func (m *blockMemCache) add(b blocks.Block) {
+	size := len(b.RawData())
+	if size > m.max {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := string(b.Cid().Hash())
+	if _, ok := m.cache.Get(key); ok {
+		return
+	}
+	m.cache.Add(key, b)
+	m.size += size
+	for m.size > m.max {
+		m.cache.RemoveOldest()
+	}
+}
+
+func (m *blockMemCache) remove(c cid.Cid) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache.Remove(string(c.Hash()))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardRing(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	hosts := make([]host.Host, 3)
+	for i := range hosts {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		require.NoError(t, err)
+		t.Cleanup(func() { h.Close() })
+		hosts[i] = h
+	}
+	for _, a := range hosts {
+		for _, b := range hosts {
+			if a != b {
+				require.NoError(t, a.Connect(ctx, peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()}))
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(wg.Wait)
+	rings := make([]*shardRing, len(hosts))
+	for i, h := range hosts {
+		var fleet []peer.ID
+		for _, o := range hosts {
+			if o != h {
+				fleet = append(fleet, o.ID())
+			}
+		}
+		rings[i] = newShardRing(h, fleet)
+		require.NoError(t, rings[i].start(ctx, &wg))
+	}
+
+	cids := make([]cid.Cid, 3000)
+	for i := range cids {
+		cids[i] = blocks.NewBlock([]byte(strconv.Itoa(i))).Cid()
+	}
+
+	// Every instance agrees on the owner of every CID, and CIDs are spread
+	// across the instances.
+	owners := make(map[cid.Cid]peer.ID, len(cids))
+	counts := make(map[peer.ID]int)
+	for _, c := range cids {
+		owner := rings[0].owner(c)
+		for _, r := range rings[1:] {
+			require.Equal(t, owner, r.owner(c))
+		}
+		// CIDv0 and CIDv1 of the same block have the same owner.
+		require.Equal(t, owner, rings[0].owner(cid.NewCidV1(cid.DagProtobuf, c.Hash())))
+		owners[c] = owner
+		counts[owner]++
+	}
+	for _, h := range hosts {
+		require.Greater(t, counts[h.ID()], len(cids)/6, "uneven distribution: %v", counts)
+	}
+
+	// When an instance leaves, only its CIDs move.
+	require.NoError(t, hosts[2].Close())
+	require.Eventually(t, func() bool {
+		for _, c := range cids {
+			if rings[0].owner(c) == hosts[2].ID() {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+	for _, c := range cids {
+		if owners[c] != hosts[2].ID() {
+			require.Equal(t, owners[c], rings[0].owner(c))
+		}
+	}
+}
+
+func TestShardingBlockstore(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	defer h.Close()
+	other, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer other.Close()
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()}))
+
+	ring := newShardRing(h, []peer.ID{other.ID()})
+	base := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	bs := newShardingBlockstore(base, ring, 8)
+
+	var owned, remote []blocks.Block
+	for i := 0; len(owned) < 2 || len(remote) < 10; i++ {
+		b := blocks.NewBlock([]byte(strconv.Itoa(i)))
+		if ring.owns(b.Cid()) {
+			owned = append(owned, b)
+		} else {
+			remote = append(remote, b)
+		}
+	}
+	require.NoError(t, bs.PutMany(ctx, []blocks.Block{owned[0], owned[1], remote[0]}))
+
+	// Blocks we own are written to disk, the others are kept in memory.
+	for _, b := range owned[:2] {
+		has, err := base.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	has, err := base.Has(ctx, remote[0].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	got, err := bs.Get(ctx, remote[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, remote[0].RawData(), got.RawData())
+	size, err := bs.GetSize(ctx, remote[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, len(remote[0].RawData()), size)
+
+	// The in-memory cache is bounded: older blocks are evicted.
+	for _, b := range remote[1:] {
+		require.NoError(t, bs.Put(ctx, b))
+	}
+	has, err = bs.Has(ctx, remote[0].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+	require.LessOrEqual(t, bs.mem.size, 8)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/libp2p/go-libp2p/core/host"
+	libp2pnet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoreds"
+)
+
+const (
+	// warmPeersSaveInterval is how often the most useful peers are saved.
+	warmPeersSaveInterval = 5 * time.Minute
+	// warmPeersDecayInterval is how often block counts are halved, so that
+	// peers that stopped being useful are eventually replaced.
+	warmPeersDecayInterval = time.Hour
+	// warmPeersConnectTimeout bounds each reconnection at startup.
+	warmPeersConnectTimeout = 10 * time.Second
+	// warmPeersWorkers is the number of concurrent reconnections at startup.
+	warmPeersWorkers = 16
+	// warmPeersTag protects the connections to useful peers from the
+	// connection manager.
+	warmPeersTag = "rainbow-warm-peer"
+	// warmPeersAddrTTL is how long the saved addresses of the useful peers
+	// are kept, which bounds the downtime after which they are forgotten.
+	warmPeersAddrTTL = 24 * time.Hour
+)
+
+var (
+	warmPeersKey = datastore.NewKey("warm-peers")
+	peerstoreKey = datastore.NewKey("peerstore")
+)
+
+// warmPeer is a peer that sent us blocks over Bitswap.
+type warmPeer struct {
+	ID       peer.ID
+	Blocks   float64
+	Bytes    float64
+	LastSeen time.Time
+}
+
+// warmPeers tracks the peers that sent us blocks and persists the most useful
+// ones, so that they can be reconnected to after a restart. Only their
+// addresses are saved in a datastore-backed address book, the peerstore of
+// the host stays in memory.
+type warmPeers struct {
+	h     host.Host
+	ds    datastore.Datastore
+	addrs interface {
+		peerstore.AddrBook
+		io.Closer
+	}
+	max int
+
+	mu    sync.Mutex
+	peers map[peer.ID]*warmPeer
+}
+
+func newWarmPeers(ctx context.Context, h host.Host, ds datastore.Batching, max int) (*warmPeers, error) {
+	addrs, err := pstoreds.NewAddrBook(ctx, namespace.Wrap(ds, peerstoreKey), pstoreds.DefaultOpts())
+	if err != nil {
+		return nil, err
+	}
+	wp := &warmPeers{
+		h:     h,
+		ds:    ds,
+		addrs: addrs,
+		max:   max,
+		peers: make(map[peer.ID]*warmPeer),
+	}
+	if err := wp.load(ctx); err != nil {
+		addrs.Close()
+		return nil, err
+	}
+	return wp, nil
+}
+
+// load reads the saved peers, and adds their saved addresses to the peerstore
+// of the host. The addresses of the other peers are removed from the address
+// book.
+func (wp *warmPeers) load(ctx context.Context) error {
+	data, err := wp.ds.Get(ctx, warmPeersKey)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return err
+	}
+
+	var saved []*warmPeer
+	if err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			goLog.Warnw("ignoring invalid warm peers", "err", err)
+		}
+	}
+	for _, p := range saved {
+		addrs := wp.addrs.Addrs(p.ID)
+		if p.ID == wp.h.ID() || len(addrs) == 0 {
+			continue
+		}
+		wp.h.Peerstore().AddAddrs(p.ID, addrs, warmPeersAddrTTL)
+		wp.peers[p.ID] = p
+	}
+	for _, p := range wp.addrs.PeersWithAddrs() {
+		if _, ok := wp.peers[p]; !ok {
+			wp.addrs.ClearAddrs(p)
+		}
+	}
+	return nil
+}
+
+// received records the blocks sent by p.
+func (wp *warmPeers) received(p peer.ID, msg bsmsg.BitSwapMessage) {
+	blks := msg.Blocks()
+	if len(blks) == 0 {
+		return
+	}
+
+	// Only libp2p peers are worth reconnecting to: HTTP retrieval providers
+	// have no connection on the host.
+	connected := wp.h.Network().Connectedness(p) == libp2pnet.Connected
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	st, ok := wp.peers[p]
+	if !ok {
+		if !connected {
+			return
+		}
+		st = &warmPeer{ID: p}
+		wp.peers[p] = st
+	}
+	for _, b := range blks {
+		st.Blocks++
+		st.Bytes += float64(len(b.RawData()))
+	}
+	st.LastSeen = time.Now()
+}
+
+// top returns the most useful peers, best first.
+func (wp *warmPeers) top() []*warmPeer {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	out := make([]*warmPeer, 0, len(wp.peers))
+	for _, p := range wp.peers {
+		cp := *p
+		out = append(out, &cp)
+	}
+	slices.SortFunc(out, func(a, b *warmPeer) int {
+		if c := cmp.Compare(b.Blocks, a.Blocks); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Bytes, a.Bytes)
+	})
+	if len(out) > wp.max {
+		out = out[:wp.max]
+	}
+	return out
+}
+
+// decay halves the block counts and forgets the peers that were not useful
+// lately, keeping at most twice the number of peers saved.
+func (wp *warmPeers) decay() {
+	keep := make(map[peer.ID]struct{})
+	for _, p := range wp.top() {
+		keep[p.ID] = struct{}{}
+	}
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	for id, p := range wp.peers {
+		p.Blocks /= 2
+		p.Bytes /= 2
+		if _, ok := keep[id]; !ok && (p.Blocks < 1 || len(wp.peers) > 2*wp.max) {
+			delete(wp.peers, id)
+		}
+	}
+}
+
+// save persists the most useful peers and their current addresses, and keeps
+// these addresses in the peerstore of the host for warmPeersAddrTTL, even once
+// disconnected. The addresses of the peers no longer saved are removed from
+// the address book.
+func (wp *warmPeers) save(ctx context.Context) error {
+	top := wp.top()
+	saved := make(map[peer.ID]struct{}, len(top))
+	for _, p := range top {
+		saved[p.ID] = struct{}{}
+		if addrs := wp.h.Peerstore().Addrs(p.ID); len(addrs) > 0 {
+			wp.h.Peerstore().SetAddrs(p.ID, addrs, warmPeersAddrTTL)
+			wp.addrs.SetAddrs(p.ID, addrs, warmPeersAddrTTL)
+		}
+	}
+	for _, p := range wp.addrs.PeersWithAddrs() {
+		if _, ok := saved[p]; !ok {
+			wp.addrs.ClearAddrs(p)
+		}
+	}
+	data, err := json.Marshal(top)
+	if err != nil {
+		return err
+	}
+	return wp.ds.Put(ctx, warmPeersKey, data)
+}
+
+// connect reconnects to the saved peers, and protects their connections from
+// the connection manager.
+func (wp *warmPeers) connect(ctx context.Context) {
+	peers := wp.top()
+	if len(peers) == 0 {
+		return
+	}
+
+	start := time.Now()
+	ch := make(chan peer.AddrInfo)
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		connected int
+	)
+	for range warmPeersWorkers {
+		wg.Go(func() {
+			for ai := range ch {
+				cctx, cancel := context.WithTimeout(ctx, warmPeersConnectTimeout)
+				err := wp.h.Connect(cctx, ai)
+				cancel()
+				if err != nil {
+					goLog.Debugw("cannot reconnect to warm peer", "peer", ai.ID, "err", err)
+					continue
+				}
+				wp.h.ConnManager().TagPeer(ai.ID, warmPeersTag, 10)
+				mu.Lock()
+				connected++
+				mu.Unlock()
+			}
+		})
+	}
+feed:
+	for _, p := range peers {
+		select {
+		case ch <- peer.AddrInfo{ID: p.ID}:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	goLog.Infow("reconnected to warm peers", "connected", connected, "saved", len(peers), "took", time.Since(start))
+}
+
+// start reconnects to the saved peers, then saves and decays the most
+// useful peers until ctx is cancelled, when they are saved one last time and
+// the address book is closed. The reconnecting and saving goroutines are
+// added to wg.
+func (wp *warmPeers) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Go(func() {
+		wp.connect(ctx)
+	})
+	wg.Go(func() {
+		save := time.NewTicker(warmPeersSaveInterval)
+		defer save.Stop()
+		decay := time.NewTicker(warmPeersDecayInterval)
+		defer decay.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				if err := wp.save(context.Background()); err != nil {
+					goLog.Warnw("error saving warm peers", "err", err)
+				}
+				wp.addrs.Close()
+				return
+			case <-decay.C:
+				wp.decay()
+			case <-save.C:
+				if err := wp.save(ctx); err != nil {
+					goLog.Warnw("error saving warm peers", "err", err)
+				}
+			}
+		}
+	})
+}
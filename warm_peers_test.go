@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmPeers(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	newHost := func(opts ...libp2p.Option) host.Host {
+		h, err := libp2p.New(append(opts, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))...)
+		require.NoError(t, err)
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	h := newHost()
+	good, other, http := newHost(), newHost(), newHost()
+	for _, p := range []host.Host{good, other} {
+		require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: p.ID(), Addrs: p.Addrs()}))
+	}
+
+	wp, err := newWarmPeers(ctx, h, ds, 1)
+	require.NoError(t, err)
+
+	msg := func(n int) bsmsg.BitSwapMessage {
+		m := bsmsg.New(false)
+		for i := range n {
+			m.AddBlock(blocks.NewBlock([]byte{byte(i)}))
+		}
+		return m
+	}
+	wp.received(good.ID(), msg(3))
+	wp.received(other.ID(), msg(1))
+	// Peers we are not connected to, e.g. HTTP providers, are not tracked.
+	wp.received(http.ID(), msg(10))
+
+	top := wp.top()
+	require.Len(t, top, 1)
+	require.Equal(t, good.ID(), top[0].ID)
+	require.EqualValues(t, 3, top[0].Blocks)
+	require.NoError(t, wp.save(ctx))
+	require.NoError(t, h.Close())
+
+	// Only the addresses of the saved peers are persisted.
+	require.ElementsMatch(t, good.Addrs(), wp.addrs.Addrs(good.ID()))
+	require.Empty(t, wp.addrs.Addrs(other.ID()))
+	require.NoError(t, wp.addrs.Close())
+
+	// After a restart, the most useful peers are reconnected to, at the
+	// addresses saved in the address book.
+	h2 := newHost()
+	wp, err = newWarmPeers(ctx, h2, ds, 1)
+	require.NoError(t, err)
+	t.Cleanup(func() { wp.addrs.Close() })
+	require.ElementsMatch(t, good.Addrs(), h2.Peerstore().Addrs(good.ID()))
+	require.Empty(t, h2.Peerstore().Addrs(other.ID()))
+	require.Len(t, wp.top(), 1)
+	wp.connect(ctx)
+	require.Equal(t, network.Connected, h2.Network().Connectedness(good.ID()))
+	require.NotEqual(t, network.Connected, h2.Network().Connectedness(other.ID()))
+}